@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// statusRecorder records the status code and size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// newAccessLogger returns a logger writing access logs in the given format,
+// either "logfmt" or "json".
+func newAccessLogger(format string) (*logrus.Logger, error) {
+	l := logrus.New()
+	l.Out = os.Stderr
+	switch format {
+	case "logfmt":
+		l.Formatter = &logrus.TextFormatter{DisableColors: true, FullTimestamp: true}
+	case "json":
+		l.Formatter = &logrus.JSONFormatter{}
+	default:
+		return nil, fmt.Errorf("unsupported access log format %q", format)
+	}
+	return l, nil
+}
+
+// withAccessLog wraps h to write an access log entry per request to l.
+func withAccessLog(l *logrus.Logger, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r)
+
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client = r.RemoteAddr
+		}
+		l.WithFields(logrus.Fields{
+			"client":   client,
+			"method":   r.Method,
+			"path":     r.URL.Path,
+			"target":   r.URL.Query().Get("target"),
+			"status":   rec.status,
+			"bytes":    rec.bytes,
+			"duration": time.Since(start).Seconds(),
+		}).Info("access")
+	})
+}
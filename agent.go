@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/log"
+)
+
+var (
+	remoteWriteRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace + "_exporter",
+			Name:      "remote_write_requests_total",
+			Help:      "Number of remote write requests sent in agent mode, by result.",
+		},
+		[]string{"result"},
+	)
+	pushgatewayPushes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace + "_exporter",
+			Name:      "pushgateway_pushes_total",
+			Help:      "Number of pushes to the Pushgateway in agent mode, by result.",
+		},
+		[]string{"result"},
+	)
+)
+
+// runAgent scrapes all known targets in the background every agent interval
+// and pushes the results to the configured remote write endpoint and
+// Pushgateway. It never returns; while the agent is not configured or another
+// instance is the leader, it only watches for changes.
+func runAgent(config *SafeConfig) {
+	for {
+		cfg := config.Agent()
+		if !cfg.Enabled() {
+			time.Sleep(10 * time.Second)
+			continue
+		}
+		if !isLeader(config) {
+			exposedResults.retain(nil)
+			time.Sleep(time.Second)
+			continue
+		}
+		start := time.Now()
+		scrapeAll(config, cfg)
+		time.Sleep(cfg.Interval - time.Since(start))
+	}
+}
+
+// scrapeAll scrapes all known targets, at most cfg.Concurrency at a time, and
+// pushes the results.
+func scrapeAll(config *SafeConfig, cfg AgentConfig) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, cfg.Concurrency)
+	targets := config.KnownTargets()
+	for _, t := range targets {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(t KnownTarget) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			ctx := context.Background()
+			mfs, err := scrapeTarget(ctx, config, t.Name, cfg.Interval)
+			if err != nil {
+				log.Errorf("Error gathering metrics of target %s in agent mode: %s", t.Name, err)
+				exposedResults.set(t.Name, nil)
+				return
+			}
+			if cfg.Expose {
+				exposedResults.set(t.Name, mfs)
+			}
+			labels := map[string]string{"instance": t.Name}
+			for k, v := range t.Labels {
+				labels[k] = v
+			}
+			if cfg.RemoteWrite.URL != "" {
+				pushRemoteWrite(ctx, cfg, t.Name, mfs, labels)
+			}
+			if cfg.Pushgateway.URL != "" {
+				pushPushgateway(ctx, cfg, t.Name, mfs, labels)
+			}
+		}(t)
+	}
+	wg.Wait()
+	if !cfg.Expose {
+		targets = nil
+	}
+	exposedResults.retain(targets)
+}
+
+// targetResults holds the latest metrics of each target scraped in the
+// background, for exposition on /metrics.
+type targetResults struct {
+	sync.Mutex
+	results map[string][]*dto.MetricFamily
+}
+
+var exposedResults = &targetResults{results: make(map[string][]*dto.MetricFamily)}
+
+func (r *targetResults) set(target string, mfs []*dto.MetricFamily) {
+	r.Lock()
+	defer r.Unlock()
+	if mfs == nil {
+		delete(r.results, target)
+		return
+	}
+	r.results[target] = mfs
+}
+
+// retain removes the results of all targets not in targets.
+func (r *targetResults) retain(targets []KnownTarget) {
+	keep := make(map[string]bool)
+	for _, t := range targets {
+		keep[t.Name] = true
+	}
+	r.Lock()
+	defer r.Unlock()
+	for name := range r.results {
+		if !keep[name] {
+			delete(r.results, name)
+		}
+	}
+}
+
+// Gather implements prometheus.Gatherer. It returns the latest metrics of all
+// targets, see gather.
+func (r *targetResults) Gather() ([]*dto.MetricFamily, error) {
+	return r.gather(nil)
+}
+
+// gatherer returns a prometheus.Gatherer for the latest metrics of the
+// targets for which allow returns true.
+func (r *targetResults) gatherer(allow func(target string) bool) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return r.gather(allow)
+	})
+}
+
+// gather returns the latest metrics of the targets for which allow returns
+// true, or of all targets if allow is nil. Each metric is labeled with the
+// target name; a target label the metric already has, e.g. the address, is
+// moved to the address label.
+func (r *targetResults) gather(allow func(target string) bool) ([]*dto.MetricFamily, error) {
+	r.Lock()
+	defer r.Unlock()
+	byName := make(map[string]*dto.MetricFamily)
+	for target, mfs := range r.results {
+		if allow != nil && !allow(target) {
+			continue
+		}
+		for _, mf := range mfs {
+			result, ok := byName[mf.GetName()]
+			if !ok {
+				result = &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type}
+				byName[mf.GetName()] = result
+			}
+			for _, m := range mf.GetMetric() {
+				// Copy the metric, the stored one must not be modified.
+				c := *m
+				c.Label = withTargetLabel(m.GetLabel(), target)
+				result.Metric = append(result.Metric, &c)
+			}
+		}
+	}
+	var result []*dto.MetricFamily
+	for _, mf := range byName {
+		result = append(result, mf)
+	}
+	return result, nil
+}
+
+// withTargetLabel returns a copy of labels with the target label set to
+// target. A different value of an existing target label is kept in the
+// address label, unless there is one already.
+func withTargetLabel(labels []*dto.LabelPair, target string) []*dto.LabelPair {
+	var (
+		result     []*dto.LabelPair
+		old        string
+		hasAddress bool
+	)
+	for _, l := range labels {
+		switch l.GetName() {
+		case "target":
+			old = l.GetValue()
+			continue
+		case "address":
+			hasAddress = true
+		}
+		result = append(result, l)
+	}
+	result = append(result, &dto.LabelPair{Name: proto.String("target"), Value: proto.String(target)})
+	if old != "" && old != target && !hasAddress {
+		result = append(result, &dto.LabelPair{Name: proto.String("address"), Value: proto.String(old)})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].GetName() < result[j].GetName() })
+	return result
+}
+
+func pushRemoteWrite(ctx context.Context, cfg AgentConfig, target string, mfs []*dto.MetricFamily, labels map[string]string) {
+	seriesLabels := map[string]string{"job": cfg.Job}
+	for k, v := range labels {
+		seriesLabels[k] = v
+	}
+	series := relabelSeries(toTimeSeries(mfs, seriesLabels, time.Now()), cfg.RemoteWrite.WriteRelabelConfigs)
+	err := remoteWrite(ctx, cfg.RemoteWrite, series)
+	if err != nil {
+		remoteWriteRequests.WithLabelValues("error").Inc()
+		log.Errorf("Error pushing metrics of target %s: %s", target, err)
+		return
+	}
+	remoteWriteRequests.WithLabelValues("success").Inc()
+}
+
+func pushPushgateway(ctx context.Context, cfg AgentConfig, target string, mfs []*dto.MetricFamily, labels map[string]string) {
+	grouping := make(map[string]string)
+	for k, v := range labels {
+		grouping[k] = v
+	}
+	for k, v := range cfg.Pushgateway.GroupingLabels {
+		grouping[k] = v
+	}
+	err := pushgatewayPush(ctx, cfg.Pushgateway, cfg.Job, grouping, mfs)
+	if err != nil {
+		pushgatewayPushes.WithLabelValues("error").Inc()
+		log.Errorf("Error pushing metrics of target %s to the Pushgateway: %s", target, err)
+		return
+	}
+	pushgatewayPushes.WithLabelValues("success").Inc()
+}
+
+// scrapeTarget collects the metrics of target like a request to the /ipmi
+// endpoint would.
+func scrapeTarget(ctx context.Context, config *SafeConfig, target string, timeout time.Duration) ([]*dto.MetricFamily, error) {
+	config = config.Snapshot()
+	address, credentials := config.LookupTarget(target)
+	log.Debugf("Scraping target '%s' (%s) in agent mode", target, address)
+	registry := prometheus.NewRegistry()
+	collector := collector{ctx: ctx, name: target, target: address, credentials: credentials, config: config, timeout: timeout}
+	if err := registry.Register(collector); err != nil {
+		return nil, err
+	}
+	gatherer := withLabels(registry, config.CredentialsLabels(credentials))
+	return withNamespace(gatherer, *metricsNamespace).Gather()
+}
+
+// toTimeSeries converts metric families into remote write time series, adding
+// the given labels to every series. They replace labels of the same name the
+// metrics have, as remote write receivers reject duplicate label names.
+// Histograms and summaries are split into their _bucket/quantile, _sum and
+// _count series.
+func toTimeSeries(mfs []*dto.MetricFamily, labels map[string]string, now time.Time) []*prompbTimeSeries {
+	ts := now.UnixNano() / int64(time.Millisecond)
+	var result []*prompbTimeSeries
+	add := func(name string, m *dto.Metric, value float64, extra ...string) {
+		merged := make(map[string]string)
+		for _, lp := range m.GetLabel() {
+			merged[lp.GetName()] = lp.GetValue()
+		}
+		for i := 0; i+1 < len(extra); i += 2 {
+			merged[extra[i]] = extra[i+1]
+		}
+		for k, v := range labels {
+			merged[k] = v
+		}
+		merged["__name__"] = name
+		series := &prompbTimeSeries{
+			Samples: []*prompbSample{{Value: value, Timestamp: ts}},
+		}
+		for k, v := range merged {
+			series.Labels = append(series.Labels, &prompbLabel{Name: k, Value: v})
+		}
+		// Remote write requires labels to be sorted by name.
+		sort.Slice(series.Labels, func(i, j int) bool { return series.Labels[i].Name < series.Labels[j].Name })
+		if m.TimestampMs != nil {
+			series.Samples[0].Timestamp = m.GetTimestampMs()
+		}
+		result = append(result, series)
+	}
+	for _, mf := range mfs {
+		name := mf.GetName()
+		for _, m := range mf.GetMetric() {
+			switch mf.GetType() {
+			case dto.MetricType_GAUGE:
+				add(name, m, m.GetGauge().GetValue())
+			case dto.MetricType_COUNTER:
+				add(name, m, m.GetCounter().GetValue())
+			case dto.MetricType_UNTYPED:
+				add(name, m, m.GetUntyped().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				inf := false
+				for _, b := range h.GetBucket() {
+					inf = math.IsInf(b.GetUpperBound(), 1)
+					add(name+"_bucket", m, float64(b.GetCumulativeCount()), "le", formatFloat(b.GetUpperBound()))
+				}
+				if !inf {
+					add(name+"_bucket", m, float64(h.GetSampleCount()), "le", "+Inf")
+				}
+				add(name+"_sum", m, h.GetSampleSum())
+				add(name+"_count", m, float64(h.GetSampleCount()))
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					add(name, m, q.GetValue(), "quantile", formatFloat(q.GetQuantile()))
+				}
+				add(name+"_sum", m, s.GetSampleSum())
+				add(name+"_count", m, float64(s.GetSampleCount()))
+			}
+		}
+	}
+	return result
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// gatherTestTarget returns the metrics a scrape of a target at address would
+// store, with the scrape duration labeled as the collector does.
+func gatherTestTarget(t *testing.T, name, address string) []*dto.MetricFamily {
+	t.Helper()
+	registry := prometheus.NewRegistry()
+	up := prometheus.NewGauge(prometheus.GaugeOpts{Name: "ipmi_up", Help: "up"})
+	up.Set(1)
+	duration := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "ipmi_scrape_duration_seconds", Help: "duration"}, []string{"target", "address"})
+	duration.WithLabelValues(name, address).Set(2)
+	// Metrics from older collectors may carry the address as target label.
+	legacy := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "ipmi_legacy", Help: "legacy"}, []string{"target"})
+	legacy.WithLabelValues(address).Set(3)
+	registry.MustRegister(up, duration, legacy)
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mfs
+}
+
+func TestTargetResultsGatherTargetLabel(t *testing.T) {
+	results := &targetResults{results: map[string][]*dto.MetricFamily{
+		"node1": gatherTestTarget(t, "node1", "10.0.0.1"),
+		"node2": gatherTestTarget(t, "node2", "10.0.0.1"),
+	}}
+	// Gatherers checks the consistency of the metrics like /metrics does.
+	gathered, err := prometheus.Gatherers{results}.Gather()
+	if err != nil {
+		t.Fatalf("aliases of the same address are inconsistent: %s", err)
+	}
+	var buf bytes.Buffer
+	for _, mf := range gathered {
+		if _, err := expfmt.MetricFamilyToText(&buf, mf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var parser expfmt.TextParser
+	parsed, err := parser.TextToMetricFamilies(&buf)
+	if err != nil {
+		t.Fatalf("exposed metrics do not parse: %s\n%s", err, buf.String())
+	}
+	for _, name := range []string{"ipmi_up", "ipmi_scrape_duration_seconds", "ipmi_legacy"} {
+		mf, ok := parsed[name]
+		if !ok || len(mf.Metric) != 2 {
+			t.Fatalf("expected two series of %s, got %v", name, mf)
+		}
+		targets := make(map[string]bool)
+		for _, m := range mf.Metric {
+			labels := make(map[string]string)
+			for _, l := range m.Label {
+				if _, ok := labels[l.GetName()]; ok {
+					t.Errorf("%s has label %s more than once", name, l.GetName())
+				}
+				labels[l.GetName()] = l.GetValue()
+			}
+			targets[labels["target"]] = true
+			if name != "ipmi_up" && labels["address"] != "10.0.0.1" {
+				t.Errorf("%s of %s has address %q, expected 10.0.0.1", name, labels["target"], labels["address"])
+			}
+		}
+		if !targets["node1"] || !targets["node2"] {
+			t.Errorf("expected %s for targets node1 and node2, got %v", name, targets)
+		}
+	}
+}
+
+func TestTargetResultsGatherer(t *testing.T) {
+	results := &targetResults{results: map[string][]*dto.MetricFamily{
+		"node1": gatherTestTarget(t, "node1", "10.0.0.1"),
+		"node2": gatherTestTarget(t, "node2", "10.0.0.2"),
+	}}
+	gathered, err := results.gatherer(func(target string) bool { return target == "node2" }).Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range gathered {
+		for _, m := range mf.Metric {
+			for _, l := range m.Label {
+				if l.GetName() == "target" && l.GetValue() != "node2" {
+					t.Errorf("%s of target %s exposed, expected only node2", mf.GetName(), l.GetValue())
+				}
+			}
+		}
+	}
+}
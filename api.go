@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/common/log"
+)
+
+type apiSensor struct {
+	ID    int64    `json:"id"`
+	Name  string   `json:"name"`
+	Type  string   `json:"type"`
+	State string   `json:"state"`
+	Value *float64 `json:"value"`
+	Unit  string   `json:"unit"`
+	Event string   `json:"event"`
+}
+
+type apiBMCInfo struct {
+	FirmwareRevision      string `json:"firmware_revision"`
+	ManufacturerID        string `json:"manufacturer_id"`
+	ProductID             string `json:"product_id,omitempty"`
+	DeviceID              string `json:"device_id,omitempty"`
+	IPMIVersion           string `json:"ipmi_version,omitempty"`
+	SystemFirmwareVersion string `json:"system_firmware_version,omitempty"`
+}
+
+type apiSensorsResponse struct {
+	Target                string      `json:"target"`
+	BMC                   *apiBMCInfo `json:"bmc,omitempty"`
+	PowerConsumptionWatts *float64    `json:"power_consumption_watts,omitempty"`
+	Sensors               []apiSensor `json:"sensors"`
+	Errors                []string    `json:"errors,omitempty"`
+}
+
+// apiHandler serves /api/v1/targets/<target>/sensors, returning the current
+// sensor readings and BMC information of a target as JSON.
+func apiHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/targets/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] != "sensors" {
+		http.NotFound(w, r)
+		return
+	}
+	target := parts[0]
+	if !authorize(w, r, target) {
+		return
+	}
+	if rateLimited(w, r) {
+		return
+	}
+	config := sc.Snapshot()
+	if !config.TargetAllowed(target) {
+		log.Warnf("Refusing to scrape target '%s' not listed in allowed_targets", target)
+		http.Error(w, fmt.Sprintf("target '%s' is not allowed", target), http.StatusForbidden)
+		return
+	}
+	address, credentials := config.LookupTarget(target)
+	c := collector{ctx: r.Context(), name: target, target: address, credentials: credentials, config: config}
+	creds, err := config.CredentialsForTarget(credentials)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := apiSensorsResponse{Target: target, Sensors: []apiSensor{}}
+	if info, err := c.getBmcInfo(r.Context(), creds); err != nil {
+		resp.Errors = append(resp.Errors, fmt.Sprintf("bmc-info: %s", err))
+	} else {
+		resp.BMC = &apiBMCInfo{
+			FirmwareRevision:      info.FirmwareRevision,
+			ManufacturerID:        info.ManufacturerID,
+			ProductID:             info.ProductID,
+			DeviceID:              info.DeviceID,
+			IPMIVersion:           info.IPMIVersion,
+			SystemFirmwareVersion: info.SystemFirmwareVersion,
+		}
+	}
+	if watts, err := c.getPowerConsumption(r.Context(), creds); err != nil {
+		resp.Errors = append(resp.Errors, fmt.Sprintf("ipmi-dcmi: %s", err))
+	} else {
+		resp.PowerConsumptionWatts = &watts
+	}
+	if sensors, _, err := c.getSensorData(r.Context(), creds); err != nil {
+		resp.Errors = append(resp.Errors, fmt.Sprintf("ipmimonitoring: %s", err))
+	} else {
+		for _, data := range sensors {
+			s := apiSensor{
+				ID:    data.ID,
+				Name:  data.Name,
+				Type:  data.Type,
+				State: data.State,
+				Unit:  data.Unit,
+				Event: data.Event,
+			}
+			// NaN can not be represented in JSON.
+			if !math.IsNaN(data.Value) {
+				value := data.Value
+				s.Value = &value
+			}
+			resp.Sensors = append(resp.Sensors, s)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(resp.Errors) == 3 {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Errorf("Error writing API response: %s", err)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// bearerToken returns the bearer token of r, if any.
+func bearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, prefix) {
+		return ""
+	}
+	return strings.TrimSpace(h[len(prefix):])
+}
+
+// exposedGatherer returns a prometheus.Gatherer for the metrics of the targets
+// scraped in agent mode that the bearer token of r may see. Without a valid
+// token, no target is exposed, while the metrics of the exporter itself are
+// still served on /metrics.
+func exposedGatherer(r *http.Request) prometheus.Gatherer {
+	if !sc.AuthRequired() {
+		return exposedResults
+	}
+	token := bearerToken(r)
+	return exposedResults.gatherer(func(target string) bool {
+		_, allowed := sc.TokenAllows(token, target)
+		return allowed
+	})
+}
+
+// authorize checks whether r may access target if auth_tokens are configured.
+// An empty target only requires a valid token. If access is denied, an error
+// is written to w and false is returned.
+func authorize(w http.ResponseWriter, r *http.Request, target string) bool {
+	if !sc.AuthRequired() {
+		return true
+	}
+	known, allowed := sc.TokenAllows(bearerToken(r), target)
+	if !known {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="ipmi_exporter"`)
+		http.Error(w, "valid bearer token required", http.StatusUnauthorized)
+		return false
+	}
+	if target != "" && !allowed {
+		log.Warnf("Refusing to scrape target '%s' not allowed for token", target)
+		http.Error(w, fmt.Sprintf("target '%s' is not allowed for this token", target), http.StatusForbidden)
+		return false
+	}
+	return true
+}
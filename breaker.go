@@ -0,0 +1,54 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// breakerState tracks the consecutive failures of a target.
+type breakerState struct {
+	failures  int
+	openUntil time.Time
+}
+
+// circuitBreaker short-circuits scrapes of targets that failed repeatedly.
+type circuitBreaker struct {
+	mtx     sync.Mutex
+	targets map[string]*breakerState
+}
+
+// Open reports whether scrapes of key are currently short-circuited, and if
+// so, until when.
+func (cb *circuitBreaker) Open(key string) (time.Time, bool) {
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+	s, ok := cb.targets[key]
+	if !ok || time.Now().After(s.openUntil) {
+		return time.Time{}, false
+	}
+	return s.openUntil, true
+}
+
+// Record records the outcome of a scrape of key. Once threshold consecutive
+// scrapes have failed, further scrapes are short-circuited for backoff. A
+// successful scrape resets the state.
+func (cb *circuitBreaker) Record(key string, success bool, threshold int, backoff time.Duration) {
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+	if success {
+		delete(cb.targets, key)
+		return
+	}
+	if cb.targets == nil {
+		cb.targets = make(map[string]*breakerState)
+	}
+	s, ok := cb.targets[key]
+	if !ok {
+		s = &breakerState{}
+		cb.targets[key] = s
+	}
+	s.failures++
+	if s.failures >= threshold {
+		s.openUntil = time.Now().Add(backoff)
+	}
+}
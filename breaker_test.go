@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var cb circuitBreaker
+	cb.Record("node1", false, 2, time.Minute)
+	if _, open := cb.Open("node1"); open {
+		t.Error("expected the breaker to stay closed below the threshold")
+	}
+	cb.Record("node1", false, 2, time.Minute)
+	until, open := cb.Open("node1")
+	if !open {
+		t.Fatal("expected the breaker to open at the threshold")
+	}
+	if d := time.Until(until); d <= 0 || d > time.Minute {
+		t.Errorf("expected the breaker to be open for a minute, got %s", d)
+	}
+	if _, open := cb.Open("node2"); open {
+		t.Error("expected other targets not to be affected")
+	}
+
+	// Once the backoff has passed, the breaker lets a scrape through, and
+	// another failure opens it again right away.
+	cb.targets["node1"].openUntil = time.Now().Add(-time.Second)
+	if _, open := cb.Open("node1"); open {
+		t.Error("expected the breaker to close after the backoff")
+	}
+	cb.Record("node1", false, 2, time.Minute)
+	if _, open := cb.Open("node1"); !open {
+		t.Error("expected the breaker to open again after another failure")
+	}
+
+	cb.Record("node1", true, 2, time.Minute)
+	if _, open := cb.Open("node1"); open {
+		t.Error("expected a success to reset the breaker")
+	}
+	cb.Record("node1", false, 2, time.Minute)
+	if _, open := cb.Open("node1"); open {
+		t.Error("expected the failures to be counted from zero after a success")
+	}
+}
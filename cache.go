@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// scrapeResult holds the metrics of a scrape of a target.
+type scrapeResult struct {
+	metrics []prometheus.Metric
+	success bool
+	time    time.Time
+	// duration is how long the scrape took in seconds.
+	duration float64
+}
+
+// resultCache holds the result of the last successful scrape per target.
+type resultCache struct {
+	mtx     sync.Mutex
+	results map[string]scrapeResult
+}
+
+// Get returns the cached result for key if it is not older than ttl.
+func (rc *resultCache) Get(key string, ttl time.Duration) (scrapeResult, bool) {
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+	r, ok := rc.results[key]
+	if !ok || time.Since(r.time) > ttl {
+		return scrapeResult{}, false
+	}
+	return r, true
+}
+
+// Put stores r as the result for key and drops all entries older than ttl.
+func (rc *resultCache) Put(key string, r scrapeResult, ttl time.Duration) {
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+	if rc.results == nil {
+		rc.results = make(map[string]scrapeResult)
+	}
+	for k, old := range rc.results {
+		if time.Since(old.time) > ttl {
+			delete(rc.results, k)
+		}
+	}
+	rc.results[key] = r
+}
+
+// Flush drops the results of all scrapes of target, or of all targets if
+// target is empty, and returns the number of results dropped.
+func (rc *resultCache) Flush(target string) int {
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+	n := 0
+	for k := range rc.results {
+		if target == "" || strings.HasPrefix(k, target+"\x00") {
+			delete(rc.results, k)
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResultCache(t *testing.T) {
+	var rc resultCache
+	if _, ok := rc.Get("10.0.0.1\x00default", time.Minute); ok {
+		t.Error("expected an empty cache to miss")
+	}
+	rc.Put("10.0.0.1\x00default", scrapeResult{success: true, time: time.Now()}, time.Minute)
+	rc.Put("10.0.0.1\x00other", scrapeResult{success: true, time: time.Now()}, time.Minute)
+	rc.Put("10.0.0.10\x00default", scrapeResult{success: true, time: time.Now()}, time.Minute)
+	if r, ok := rc.Get("10.0.0.1\x00default", time.Minute); !ok || !r.success {
+		t.Error("expected a fresh result to be returned")
+	}
+	if _, ok := rc.Get("10.0.0.1\x00default", 0); ok {
+		t.Error("expected a result older than the TTL to be ignored")
+	}
+
+	if n := rc.Flush("10.0.0.1"); n != 2 {
+		t.Errorf("expected the 2 results of 10.0.0.1 to be flushed, got %d", n)
+	}
+	if _, ok := rc.Get("10.0.0.10\x00default", time.Minute); !ok {
+		t.Error("expected the results of other targets to be kept")
+	}
+	if n := rc.Flush(""); n != 1 {
+		t.Errorf("expected the remaining result to be flushed, got %d", n)
+	}
+}
+
+func TestResultCacheExpiry(t *testing.T) {
+	var rc resultCache
+	rc.Put("old", scrapeResult{time: time.Now().Add(-time.Hour)}, time.Hour)
+	rc.Put("new", scrapeResult{time: time.Now()}, time.Minute)
+	if _, ok := rc.results["old"]; ok {
+		t.Error("expected results older than the TTL to be dropped on Put")
+	}
+	if _, ok := rc.results["new"]; !ok {
+		t.Error("expected the new result to be stored")
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// capabilityProbe checks whether a BMC supports the commands needed by a
+// collector, or by the power state check in the case of "chassis". The
+// probes are cheap commands that fail like the real ones if the BMC does not
+// support them.
+type capabilityProbe struct {
+	name    string
+	cmd     string
+	args    []string
+	enabled func(*SafeConfig) bool
+}
+
+var capabilityProbes = []capabilityProbe{
+	{"chassis", "ipmi-chassis", []string{"--get-chassis-status"}, func(config *SafeConfig) bool { return config.SkipWhenPoweredOff() }},
+	{"dcmi", "ipmi-dcmi", []string{"--get-dcmi-capability-info"}, nil},
+	{"sel", "ipmi-sel", []string{"--info"}, selEnabled},
+}
+
+// capabilityCache remembers the outcome of the probes for each target.
+type capabilityCache struct {
+	sync.Mutex
+	// probed maps targets to the time each capability was found to be
+	// supported or not.
+	probed map[string]map[string]capabilityResult
+}
+
+type capabilityResult struct {
+	supported bool
+	at        time.Time
+}
+
+var capabilities = &capabilityCache{probed: make(map[string]map[string]capabilityResult)}
+
+func (cc *capabilityCache) get(target, name string, maxAge time.Duration) (capabilityResult, bool) {
+	cc.Lock()
+	defer cc.Unlock()
+	r, ok := cc.probed[target][name]
+	if !ok || time.Since(r.at) > maxAge {
+		return capabilityResult{}, false
+	}
+	return r, true
+}
+
+func (cc *capabilityCache) set(target, name string, supported bool) {
+	cc.Lock()
+	defer cc.Unlock()
+	if cc.probed[target] == nil {
+		cc.probed[target] = make(map[string]capabilityResult)
+	}
+	cc.probed[target][name] = capabilityResult{supported, time.Now()}
+}
+
+// unsupportedCapabilities returns the names of the capabilities the target
+// does not support, probing those that are not known yet. A probe that fails
+// for another reason than the command being unsupported, e.g. a timeout, is
+// not cached and the capability is assumed to be supported, so that the
+// collector reports the actual error.
+func (c collector) unsupportedCapabilities(ctx context.Context, creds Credentials) []string {
+	cfg := c.config.CapabilityProbing()
+	if !cfg.Enabled {
+		return nil
+	}
+	var result []string
+	for _, p := range capabilityProbes {
+		if p.enabled != nil && !p.enabled(c.config) {
+			continue
+		}
+		r, ok := capabilities.get(c.target, p.name, cfg.Interval)
+		if !ok {
+			pctx, cancel := c.withCollectorTimeout(ctx, p.name)
+			_, err := freeipmiOutput(pctx, c.getExecutor(), p.cmd, c.target, creds.User, creds.Password, p.args...)
+			cancel()
+			if err != nil && failureReason(err) != reasonUnsupported {
+				continue
+			}
+			r.supported = err == nil
+			capabilities.set(c.target, p.name, r.supported)
+			if !r.supported {
+				log.Infof("Target %s does not support %s, skipping it for %s", c.target, p.cmd, cfg.Interval)
+			}
+		}
+		if !r.supported {
+			result = append(result, p.name)
+		}
+	}
+	return result
+}
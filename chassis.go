@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"regexp"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+var (
+	chassisPowerStateRegex = regexp.MustCompile(`^System Power\s*:\s*(?P<value>on|off)`)
+
+	collectorSkippedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "collector", "skipped"),
+		"Constant metric with value '1' for each collector that was not run, labeled with the reason.",
+		[]string{"collector", "reason"},
+		nil,
+	)
+)
+
+// Reasons for skipped collectors, as exported in the reason label.
+const (
+	// skipReasonPoweredOff is the reason for collectors skipped because the
+	// system is powered off.
+	skipReasonPoweredOff = "powered_off"
+	// skipReasonUnsupported is the reason for collectors skipped because
+	// capability probing found the BMC not to support them.
+	skipReasonUnsupported = "unsupported"
+	// skipReasonSuppressed is the reason for collectors skipped because they
+	// failed repeatedly for the target, see collector_suppression.
+	skipReasonSuppressed = "suppressed"
+)
+
+// skippedWhenPoweredOff are the collectors that cannot read anything useful
+// while the system is powered off.
+var skippedWhenPoweredOff = map[string]bool{
+	"dcmi":           true,
+	"ipmimonitoring": true,
+}
+
+func ipmiChassisOutput(ctx context.Context, e executor, host, user, password string) ([]byte, error) {
+	return freeipmiOutput(ctx, e, "ipmi-chassis", host, user, password, "--get-chassis-status")
+}
+
+// poweredOff reports whether ipmi-chassis reports the system as powered off.
+func (c collector) poweredOff(ctx context.Context, creds Credentials) (bool, error) {
+	output, err := ipmiChassisOutput(ctx, c.getExecutor(), c.target, creds.User, creds.Password)
+	if err != nil {
+		return false, err
+	}
+	state, err := getValue(output, chassisPowerStateRegex)
+	if err != nil {
+		return false, &parseError{err}
+	}
+	return state == "off", nil
+}
+
+// skippedCollectors returns the collectors that are not to be run for the
+// target, with the reason why. If the power state cannot be determined, all
+// supported collectors are run.
+func (c collector) skippedCollectors(ctx context.Context, creds Credentials) map[string]string {
+	skipped := make(map[string]string)
+	for _, name := range c.unsupportedCapabilities(ctx, creds) {
+		skipped[name] = skipReasonUnsupported
+	}
+	if !c.config.SkipWhenPoweredOff() || skipped["chassis"] != "" {
+		return skipped
+	}
+	ctx, cancel := c.withCollectorTimeout(ctx, "chassis")
+	defer cancel()
+	off, err := c.poweredOff(ctx, creds)
+	if err != nil {
+		log.Errorf("Could not determine power state of target %s: %s", c.target, err)
+		return skipped
+	}
+	if !off {
+		return skipped
+	}
+	log.Debugf("Target %s is powered off, skipping sensor collectors.", c.target)
+	for name := range skippedWhenPoweredOff {
+		if skipped[name] == "" {
+			skipped[name] = skipReasonPoweredOff
+		}
+	}
+	return skipped
+}
@@ -2,14 +2,18 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/csv"
+	"errors"
 	"fmt"
+	"io"
 	"math"
-	"os/exec"
-	"path"
+	"net"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -18,15 +22,48 @@ import (
 
 const namespace = "ipmi"
 
+// sharedScrapeTimeout bounds a scrape shared by concurrent requests, which
+// each wait for it only as long as their own timeout allows.
+const sharedScrapeTimeout = 2 * time.Minute
+
 var (
-	ipmiDCMICurrentPowerRegex    = regexp.MustCompile(`^Current Power\s*:\s*(?P<value>[0-9.]*)\s*Watts.*`)
-	bmcInfoFirmwareRevisionRegex = regexp.MustCompile(`^Firmware Revision\s*:\s*(?P<value>[0-9.]*).*`)
-	bmcInfoManufacturerIDRegex   = regexp.MustCompile(`^Manufacturer ID\s*:\s*(?P<value>.*)`)
+	ipmiDCMICurrentPowerRegex    = regexp.MustCompile(`^Current Power\s*:\s*(?P<value>[0-9.,]*)\s*(?i:watts?|w)\b.*`)
+	bmcInfoFirmwareRevisionRegex = regexp.MustCompile(`^(?P<value>[0-9.,]*)`)
 )
 
 type collector struct {
-	target string
-	config *SafeConfig
+	// ctx is the context of the scrape request. Cancelling it aborts the
+	// scrape and kills the FreeIPMI processes spawned for it, except in
+	// Collect, where it only ends the wait for the shared scrape.
+	ctx context.Context
+	// name is the target as requested, e.g. an alias. target is its
+	// address.
+	name        string
+	target      string
+	credentials string
+	config      *SafeConfig
+	// executor runs the FreeIPMI commands. If nil, defaultExecutor is used,
+	// or a freeipmiExecutor with config if that is not set either.
+	executor executor
+	// timeout bounds the whole scrape, including the FreeIPMI processes
+	// spawned for it. Zero means no timeout.
+	timeout time.Duration
+}
+
+func (c collector) getExecutor() executor {
+	e := c.executor
+	if e == nil {
+		e = defaultExecutor
+	}
+	if e == nil {
+		// The commands of a scrape use the same config snapshot as the
+		// scrape itself, even if the config is reloaded meanwhile.
+		e = freeipmiExecutor{config: c.config}
+	}
+	if cfg := c.config.Retry(); cfg.MaxRetries > 0 {
+		e = retryExecutor{executor: e, cfg: cfg}
+	}
+	return e
 }
 
 type sensorData struct {
@@ -39,6 +76,15 @@ type sensorData struct {
 	Event string
 }
 
+type bmcInfoData struct {
+	FirmwareRevision      string
+	ManufacturerID        string
+	ProductID             string
+	DeviceID              string
+	IPMIVersion           string
+	SystemFirmwareVersion string
+}
+
 var (
 	sensorStateDesc = prometheus.NewDesc(
 		prometheus.BuildFQName(namespace, "sensor", "state"),
@@ -47,6 +93,13 @@ var (
 		nil,
 	)
 
+	sensorReadingTimestampDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "sensor", "reading_timestamp_seconds"),
+		"Unix timestamp of the time the reading of an IPMI sensor was obtained.",
+		[]string{"id", "name", "type"},
+		nil,
+	)
+
 	sensorValueDesc = prometheus.NewDesc(
 		prometheus.BuildFQName(namespace, "sensor", "value"),
 		"Generic data read from an IPMI sensor of unknown type, relying on labels for context.",
@@ -134,7 +187,7 @@ var (
 	bmcInfo = prometheus.NewDesc(
 		prometheus.BuildFQName(namespace, "bmc", "info"),
 		"Constant metric with value '1' providing details about the BMC.",
-		[]string{"firmware_revision", "manufacturer_id"},
+		[]string{"firmware_revision", "manufacturer_id", "product_id", "device_id", "ipmi_version", "system_firmware_version"},
 		nil,
 	)
 
@@ -145,84 +198,329 @@ var (
 		nil,
 	)
 
+	failureReasonDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "collector", "failure_reason"),
+		"Constant metric with value '1' for each collector that failed, labeled with the reason of the failure.",
+		[]string{"collector", "reason"},
+		nil,
+	)
+
+	cacheHitDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "cache_hit"),
+		"'1' if the metrics were served from the cache, '0' otherwise.",
+		nil,
+		nil,
+	)
+
 	durationDesc = prometheus.NewDesc(
 		prometheus.BuildFQName(namespace, "scrape_duration", "seconds"),
 		"Returns how long the scrape took to complete in seconds.",
+		[]string{"target", "address"},
+		nil,
+	)
+
+	sensorCountDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "sensor", "count"),
+		"Number of sensors reported by the target.",
+		nil,
+		nil,
+	)
+
+	sensorsByStateDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "sensors", "by_state"),
+		"Number of sensors reported by the target, by sensor type and state.",
+		[]string{"type", "state"},
+		nil,
+	)
+
+	sensorsSkippedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "sensors", "skipped"),
+		"Number of sensors reported by the target that were not exported, by reason.",
+		[]string{"reason"},
+		nil,
+	)
+
+	sensorLimitExceededDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "sensor", "limit_exceeded"),
+		"'1' if the target reported more sensors than the configured maximum, '0' otherwise.",
+		nil,
+		nil,
+	)
+
+	dataStaleDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "data", "stale"),
+		"'1' if data of a previous scrape is served because the scrape failed, '0' otherwise.",
+		nil,
+		nil,
+	)
+
+	dataAgeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "data_age", "seconds"),
+		"Age of the stale data served in seconds, '0' if the data is fresh.",
+		nil,
 		nil,
+	)
+
+	lastSuccessDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "last_scrape_success", "timestamp_seconds"),
+		"Unix timestamp of the last time the collector succeeded for the target.",
+		[]string{"collector"},
+		nil,
+	)
+
+	stderrLinesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "collector", "stderr_lines"),
+		"Number of lines the FreeIPMI commands of the collector printed to standard error, usually warnings.",
+		[]string{"collector"},
+		nil,
+	)
+
+	queueWaitDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "scrape_queue_wait", "seconds"),
+		"Returns how long the commands of the scrape waited for free slots in seconds, summed up.",
+		nil,
+		nil,
+	)
+
+	collectorDurationDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "collector_duration", "seconds"),
+		"Returns how long the collector took to complete in seconds.",
+		[]string{"collector"},
 		nil,
 	)
 )
 
-func freeipmiOutput(cmd, host, user, password string, arg ...string) ([]byte, error) {
-	fqcmd := path.Join(*executablesPath, cmd)
+type stderrLinesKey struct{}
+
+// withStderrLines returns a context counting the lines printed to standard
+// error by the commands run with it in lines.
+func withStderrLines(ctx context.Context, lines *int64) context.Context {
+	return context.WithValue(ctx, stderrLinesKey{}, lines)
+}
+
+// countStderrLines adds the number of lines in stderr to the count of ctx,
+// if any.
+func countStderrLines(ctx context.Context, stderr string) {
+	lines, ok := ctx.Value(stderrLinesKey{}).(*int64)
+	if !ok || stderr == "" {
+		return
+	}
+	atomic.AddInt64(lines, int64(strings.Count(stderr, "\n")+1))
+}
+
+// freeipmiHost converts a target address, a host name or IP address with an
+// optional port such as "[2001:db8::1]:6230", to the form FreeIPMI expects
+// for its -h option, where IPv6 addresses are only enclosed in brackets if a
+// port is given.
+func freeipmiHost(address string) (string, error) {
+	if strings.HasPrefix(address, "[") && strings.HasSuffix(address, "]") {
+		host := address[1 : len(address)-1]
+		if ip := net.ParseIP(host); ip == nil || ip.To4() != nil {
+			return "", fmt.Errorf("invalid IPv6 address %q", host)
+		}
+		return host, nil
+	}
+	if !strings.HasPrefix(address, "[") && strings.Count(address, ":") != 1 {
+		// A host name, an IPv4 address or an IPv6 address without port.
+		return address, nil
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	if p, err := strconv.ParseUint(port, 10, 16); err != nil || p == 0 {
+		return "", fmt.Errorf("invalid port %q", port)
+	}
+	if host == "" {
+		return "", fmt.Errorf("missing host in %q", address)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// freeipmiConfigValue formats v as the argument of an option in a FreeIPMI
+// config file, whose parser splits lines at whitespace and treats '#' as the
+// start of a comment. Such values are quoted. It returns false for values
+// with characters that cannot be represented, such as line breaks or double
+// quotes.
+func freeipmiConfigValue(v string) (string, bool) {
+	for _, r := range v {
+		if r < 0x20 || r == 0x7f || r == '"' || r == '\\' {
+			return "", false
+		}
+	}
+	if strings.ContainsAny(v, " #") {
+		return `"` + v + `"`, true
+	}
+	return v, true
+}
+
+// freeipmiCredentials returns the config file and the arguments that pass the
+// given credentials to FreeIPMI. They are passed in the config file, so that
+// they do not show up in the process list, unless they cannot be represented
+// there. Those are passed as arguments instead.
+func freeipmiCredentials(user, password string) (string, []string) {
+	var (
+		config string
+		args   []string
+	)
+	if u, ok := freeipmiConfigValue(user); ok {
+		config += fmt.Sprintf("username %s\n", u)
+	} else {
+		args = append(args, "-u", user)
+	}
+	if p, ok := freeipmiConfigValue(password); ok {
+		config += fmt.Sprintf("password %s\n", p)
+	} else {
+		args = append(args, "-p", password)
+	}
+	return config, args
+}
+
+// splitAddress returns the host of a target address without brackets, and
+// its port, if any.
+func splitAddress(address string) (string, string) {
+	host, err := freeipmiHost(address)
+	if err != nil {
+		return address, ""
+	}
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		return h, port
+	}
+	return host, ""
+}
+
+func freeipmiOutput(ctx context.Context, e executor, cmd, host, user, password string, arg ...string) ([]byte, error) {
+	address, err := commandAddress(ctx, host)
+	if err != nil {
+		err = &commandError{cmd: cmd, err: err}
+		log.Errorf("Error while resolving %s for %s: %s", host, cmd, err)
+		return nil, err
+	}
+	hostArg, err := freeipmiHost(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target address %q: %s", host, err)
+	}
+	// The credentials are passed in a config file on stdin, as far as
+	// possible.
+	config, credentialsArgs := freeipmiCredentials(user, password)
 	args := []string{
+		"--config-file", "/dev/stdin",
 		"-D", "LAN_2_0",
 		"-l", "admin",
-		"-h", host,
-		"-u", user,
-		"-p", password,
-		"-W", "authcap",
+		"-h", hostArg,
 	}
+	args = append(args, credentialsArgs...)
+	args = append(args, "-W", "authcap")
 	args = append(args, arg...)
-	out, err := exec.Command(fqcmd, args...).CombinedOutput()
+	ctx, sp := startSpan(ctx, "exec "+cmd, map[string]string{"command": cmd, "target": host})
+	defer sp.End()
+	start := time.Now()
+	result, err := e.Execute(ctx, cmd, args, []byte(config))
+	sp.SetError(err)
+	recordCommand(ctx, start, host, password, cmd, args, err, result)
+	// Make sure the password does not end up in the log, even if FreeIPMI
+	// echoes it back.
+	stderr := redact(strings.TrimSpace(string(result.stderr)), password)
+	countStderrLines(ctx, stderr)
 	if err != nil {
-		log.Errorf("Error while calling %s for %s: %s", cmd, host, out)
+		err = &commandError{cmd: cmd, err: err, stderr: stderr}
+		log.Errorf("Error while calling %s for %s: %s", cmd, host, err)
+		return result.stdout, err
+	}
+	if stderr != "" {
+		log.Debugf("%s for %s printed to stderr: %s", cmd, host, stderr)
 	}
-	return out, err
+	return result.stdout, nil
 }
 
-func ipmiMonitoringOutput(host, user, password string) ([]byte, error) {
-	return freeipmiOutput("ipmimonitoring", host, user, password, "-Q", "--comma-separated-output", "--no-header-output", "--sdr-cache-recreate")
+func ipmiMonitoringOutput(ctx context.Context, e executor, host, user, password string, arg ...string) ([]byte, error) {
+	args := append([]string{"-Q", "--comma-separated-output", "--no-header-output"}, arg...)
+	return freeipmiOutput(ctx, e, "ipmimonitoring", host, user, password, args...)
 }
 
-func ipmiDCMIOutput(host, user, password string) ([]byte, error) {
-	return freeipmiOutput("ipmi-dcmi", host, user, password, "--get-system-power-statistics")
+func ipmiDCMIOutput(ctx context.Context, e executor, host, user, password string) ([]byte, error) {
+	return freeipmiOutput(ctx, e, "ipmi-dcmi", host, user, password, "--get-system-power-statistics")
 }
 
-func bmcInfoOutput(host, user, password string) ([]byte, error) {
-	return freeipmiOutput("bmc-info", host, user, password, "--get-device-id")
+func bmcInfoOutput(ctx context.Context, e executor, host, user, password string) ([]byte, error) {
+	// Only the device ID and system info sections are parsed, so the channel
+	// information is not fetched.
+	return freeipmiOutput(ctx, e, "bmc-info", host, user, password, "--get-device-id", "--get-system-info")
 }
 
-func splitMonitoringOutput(impiOutput []byte, excludeSensorIds []int64) ([]sensorData, error) {
+// splitMonitoringOutput parses the CSV output of ipmimonitoring. Rows that
+// cannot be parsed are logged and skipped, so that a single malformed sensor
+// does not take down all others, and their number is returned; an error is
+// only returned if the output contained rows but none of them could be
+// parsed.
+func splitMonitoringOutput(impiOutput []byte) ([]sensorData, int, error) {
 	var result []sensorData
 
 	r := csv.NewReader(bytes.NewReader(impiOutput))
-	fields, err := r.ReadAll()
-	if err != nil {
-		return result, err
-	}
-
-	for _, line := range fields {
-		var data sensorData
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
 
-		data.ID, err = strconv.ParseInt(line[0], 10, 64)
-		if err != nil {
-			return result, err
-		}
-		if contains(excludeSensorIds, data.ID) {
-			continue
+	var rows, skipped int
+	var lastErr error
+	for {
+		line, err := r.Read()
+		if err == io.EOF {
+			break
 		}
-
-		data.Name = line[1]
-		data.Type = line[2]
-		data.State = line[3]
-
-		value := line[4]
-		if value != "N/A" {
-			data.Value, err = strconv.ParseFloat(value, 64)
+		rows++
+		if err == nil {
+			pos, _ := r.FieldPos(0)
+			var data sensorData
+			data, err = parseSensorRow(line)
 			if err != nil {
-				return result, err
+				err = fmt.Errorf("line %d: %s", pos, err)
+			} else {
+				result = append(result, data)
 			}
-		} else {
-			data.Value = math.NaN()
 		}
+		if err != nil {
+			log.Warnf("Skipping sensor row: %s", err)
+			skipped++
+			lastErr = err
+		}
+	}
+	if rows > 0 && skipped == rows {
+		return nil, skipped, fmt.Errorf("could not parse any of %d sensor rows: %s", rows, lastErr)
+	}
+	return result, skipped, nil
+}
 
-		data.Unit = line[5]
-		data.Event = strings.Trim(line[6], "'")
+// parseSensorRow parses a single row of ipmimonitoring output. Additional
+// trailing columns are ignored.
+func parseSensorRow(line []string) (sensorData, error) {
+	var data sensorData
+	if len(line) < 7 {
+		return data, fmt.Errorf("expected at least 7 columns, got %d", len(line))
+	}
+
+	var err error
+	data.ID, err = strconv.ParseInt(strings.TrimSpace(line[0]), 10, 64)
+	if err != nil {
+		return data, fmt.Errorf("invalid sensor ID: %s", err)
+	}
+
+	data.Name = line[1]
+	data.Type = line[2]
+	data.State = line[3]
 
-		result = append(result, data)
+	value := strings.TrimSpace(line[4])
+	if value != "N/A" {
+		data.Value, err = parseFloat(value)
+		if err != nil {
+			return data, fmt.Errorf("invalid value for sensor %d: %s", data.ID, err)
+		}
+	} else {
+		data.Value = math.NaN()
 	}
-	return result, err
+
+	data.Unit = line[5]
+	data.Event = strings.Trim(line[6], "'")
+	return data, nil
 }
 
 func getValue(ipmiOutput []byte, regex *regexp.Regexp) (string, error) {
@@ -246,15 +544,46 @@ func getCurrentPowerConsumption(ipmiOutput []byte) (float64, error) {
 	if err != nil {
 		return -1, err
 	}
-	return strconv.ParseFloat(value, 64)
+	return parseFloat(value)
 }
 
-func getBMCInfoFirmwareRevision(ipmiOutput []byte) (string, error) {
-	return getValue(ipmiOutput, bmcInfoFirmwareRevisionRegex)
+// parseFloat parses a number printed by FreeIPMI, accepting a comma as
+// decimal separator in case a locale other than C slipped through.
+func parseFloat(value string) (float64, error) {
+	return strconv.ParseFloat(strings.Replace(value, ",", ".", 1), 64)
 }
 
-func getBMCInfoManufacturerID(ipmiOutput []byte) (string, error) {
-	return getValue(ipmiOutput, bmcInfoManufacturerIDRegex)
+// parseBMCInfo parses the "key : value" lines printed by bmc-info. Only the
+// first occurrence of a key is used, as some keys are repeated in the
+// sections describing additional devices.
+func parseBMCInfo(ipmiOutput []byte) (bmcInfoData, error) {
+	var info bmcInfoData
+	values := make(map[string]string)
+	for _, line := range strings.Split(string(ipmiOutput), "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(parts[0])
+		if _, ok := values[key]; !ok {
+			values[key] = strings.TrimSpace(parts[1])
+		}
+	}
+
+	firmwareRevision, ok := values["Firmware Revision"]
+	if !ok {
+		return info, fmt.Errorf("Could not find firmware revision in output: %s", string(ipmiOutput))
+	}
+	info.FirmwareRevision = bmcInfoFirmwareRevisionRegex.FindString(firmwareRevision)
+	info.ManufacturerID, ok = values["Manufacturer ID"]
+	if !ok {
+		return info, fmt.Errorf("Could not find manufacturer ID in output: %s", string(ipmiOutput))
+	}
+	info.ProductID = values["Product ID"]
+	info.DeviceID = values["Device ID"]
+	info.IPMIVersion = values["IPMI Version"]
+	info.SystemFirmwareVersion = values["System Firmware Version"]
+	return info, nil
 }
 
 // Describe implements Prometheus.Collector.
@@ -266,7 +595,25 @@ func (c collector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- powerConsumption
 	ch <- bmcInfo
 	ch <- upDesc
+	ch <- failureReasonDesc
+	ch <- cacheHitDesc
 	ch <- durationDesc
+	ch <- collectorDurationDesc
+	ch <- queueWaitDesc
+	ch <- stderrLinesDesc
+	ch <- collectorSkippedDesc
+	ch <- lastSuccessDesc
+	ch <- sensorCountDesc
+	ch <- sensorLimitExceededDesc
+	ch <- sensorsSkippedDesc
+	ch <- sensorsByStateDesc
+	ch <- sensorReadingTimestampDesc
+	ch <- dataStaleDesc
+	ch <- dataAgeDesc
+	ch <- selEntriesDesc
+	ch <- selFreeSpaceDesc
+	ch <- selSizeDesc
+	ch <- selUtilizationDesc
 }
 
 func collectTypedSensor(ch chan<- prometheus.Metric, desc, stateDesc *prometheus.Desc, state float64, data sensorData) {
@@ -305,37 +652,156 @@ func collectGenericSensor(ch chan<- prometheus.Metric, state float64, data senso
 	)
 }
 
-func (c collector) collectMonitoring(ch chan<- prometheus.Metric, creds Credentials) error {
-	output, err := ipmiMonitoringOutput(c.target, creds.User, creds.Password)
+// collectSensorsByState emits the number of sensors by type and state.
+func collectSensorsByState(ch chan<- prometheus.Metric, results []sensorData) {
+	type typeState struct{ sensorType, state string }
+	counts := make(map[typeState]int)
+	for _, data := range results {
+		counts[typeState{data.Type, data.State}]++
+	}
+	for ts, count := range counts {
+		ch <- prometheus.MustNewConstMetric(
+			sensorsByStateDesc,
+			prometheus.GaugeValue,
+			float64(count),
+			ts.sensorType, ts.state,
+		)
+	}
+}
+
+// Reasons for sensors not being exported, as exported in the reason label.
+const (
+	skipReasonExcluded     = "excluded"
+	skipReasonNotAvailable = "not_available"
+	skipReasonMalformed    = "malformed"
+	skipReasonLimit        = "limit"
+)
+
+// getSensorData returns the sensors of the target, and the number of sensors
+// that were skipped by reason.
+func (c collector) getSensorData(ctx context.Context, creds Credentials) ([]sensorData, map[string]int, error) {
+	args, recreate := sdrCacheArgs(c.target, c.config.SDRCache())
+	sensorsConfig := c.config.Sensors()
+	args = append(args, sensorsConfig.args()...)
+	output, err := ipmiMonitoringOutput(ctx, c.getExecutor(), c.target, creds.User, creds.Password, args...)
+	if recreate {
+		sdrCaches.recreated(c.target, err == nil)
+	}
 	if err != nil {
 		log.Errorln(err)
-		return err
+		return nil, nil, err
 	}
-	excludeIds := c.config.ExcludeSensorIDs()
-	results, err := splitMonitoringOutput(output, excludeIds)
+	results, malformed, err := splitMonitoringOutput(output)
 	if err != nil {
 		log.Errorln(err)
-		return err
+		return nil, nil, &parseError{err}
 	}
+
+	skipped := map[string]int{skipReasonMalformed: malformed}
+	excludeIds := c.config.ExcludeSensorIDs()
+	filtered := results[:0]
 	for _, data := range results {
-		var state float64
-
-		switch data.State {
-		case "Nominal":
-			state = 0
-		case "Warning":
-			state = 1
-		case "Critical":
-			state = 2
-		case "N/A":
-			state = math.NaN()
+		switch {
+		case contains(excludeIds, data.ID):
+			skipped[skipReasonExcluded]++
+		case sensorsConfig.NotAvailable == "drop" && math.IsNaN(data.Value):
+			skipped[skipReasonNotAvailable]++
 		default:
+			if sensorsConfig.NormalizeUnits {
+				data = normalizeUnit(data, sensorsConfig.FanMaxRPM)
+			}
+			if sensorsConfig.NotAvailable == "zero" && math.IsNaN(data.Value) {
+				data.Value = 0
+			}
+			filtered = append(filtered, data)
+		}
+	}
+
+	// Some BMCs report several sensors with the same record ID and name,
+	// which would result in duplicate series and fail the whole scrape. They
+	// are told apart by numbering the later ones.
+	type sensorKey struct {
+		id   int64
+		name string
+	}
+	seen := make(map[sensorKey]int)
+	for i, data := range filtered {
+		k := sensorKey{data.ID, data.Name}
+		seen[k]++
+		if n := seen[k]; n > 1 {
+			filtered[i].Name = fmt.Sprintf("%s #%d", data.Name, n)
+		}
+	}
+	return filtered, skipped, nil
+}
+
+func (c collector) collectMonitoring(ctx context.Context, ch chan<- prometheus.Metric, creds Credentials) error {
+	results, skipped, err := c.getSensorData(ctx, creds)
+	if err != nil {
+		return err
+	}
+	readAt := float64(time.Now().UnixNano()) / 1e9
+	// The sensors skipped so far were reported by the target as well.
+	reported := len(results)
+	for _, n := range skipped {
+		reported += n
+	}
+	ch <- prometheus.MustNewConstMetric(
+		sensorCountDesc,
+		prometheus.GaugeValue,
+		float64(reported),
+	)
+	inventory.setSensorCount(c.targetName(), c.target, reported)
+	if max := c.config.Sensors().MaxSensors; max > 0 {
+		exceeded := reported > max
+		ch <- prometheus.MustNewConstMetric(
+			sensorLimitExceededDesc,
+			prometheus.GaugeValue,
+			boolToFloat(exceeded),
+		)
+		if exceeded {
+			log.Warnf("Target %s reported %d sensors, more than the configured maximum of %d", c.target, reported, max)
+			if c.config.Sensors().TruncateSensors && len(results) > max {
+				skipped[skipReasonLimit] += len(results) - max
+				results = results[:max]
+			}
+		}
+	}
+	for _, reason := range []string{skipReasonExcluded, skipReasonNotAvailable, skipReasonMalformed, skipReasonLimit} {
+		ch <- prometheus.MustNewConstMetric(
+			sensorsSkippedDesc,
+			prometheus.GaugeValue,
+			float64(skipped[reason]),
+			reason,
+		)
+	}
+	aggregate := c.config.Sensors().Aggregate
+	if aggregate != "" {
+		collectSensorsByState(ch, results)
+		if aggregate == "only" {
+			return nil
+		}
+	}
+	for _, data := range results {
+		state, ok := c.config.SensorState(data.Type, data.State)
+		if !ok {
 			log.Errorf("Unknown sensor state: '%s'\n", data.State)
 			state = math.NaN()
 		}
 
 		log.Debugf("Got values: %v\n", data)
 
+		if c.config.Sensors().ReadingTimestamps {
+			ch <- prometheus.MustNewConstMetric(
+				sensorReadingTimestampDesc,
+				prometheus.GaugeValue,
+				readAt,
+				strconv.FormatInt(data.ID, 10),
+				data.Name,
+				data.Type,
+			)
+		}
+
 		switch data.Unit {
 		case "RPM":
 			collectTypedSensor(ch, fanSpeedDesc, fanSpeedStateDesc, state, data)
@@ -354,31 +820,55 @@ func (c collector) collectMonitoring(ch chan<- prometheus.Metric, creds Credenti
 	return nil
 }
 
-func (c collector) getPowerConsumption(creds Credentials) (float64, error) {
-	output, err := ipmiDCMIOutput(c.target, creds.User, creds.Password)
+func (c collector) getPowerConsumption(ctx context.Context, creds Credentials) (float64, error) {
+	output, err := ipmiDCMIOutput(ctx, c.getExecutor(), c.target, creds.User, creds.Password)
 	if err != nil {
 		log.Errorln(err)
 		return float64(-1), err
 	}
-	return getCurrentPowerConsumption(output)
+	watts, err := getCurrentPowerConsumption(output)
+	if err != nil {
+		return float64(-1), &parseError{err}
+	}
+	return watts, nil
 }
 
-func (c collector) getBmcInfo(creds Credentials) (string, string, error) {
-	output, err := bmcInfoOutput(c.target, creds.User, creds.Password)
+func (c collector) getBmcInfo(ctx context.Context, creds Credentials) (bmcInfoData, error) {
+	output, err := bmcInfoOutput(ctx, c.getExecutor(), c.target, creds.User, creds.Password)
 	if err != nil {
 		log.Errorln(err)
-		return "", "", err
+		return bmcInfoData{}, err
 	}
-	firmwareRevision, err := getBMCInfoFirmwareRevision(output)
+	info, err := parseBMCInfo(output)
 	if err != nil {
-		return "", "", err
-	}
-	manufacturerID, err := getBMCInfoManufacturerID(output)
-	if err != nil {
-		return "", "", err
+		return bmcInfoData{}, &parseError{err}
 	}
+	return info, nil
+}
 
-	return firmwareRevision, manufacturerID, nil
+func (c collector) markCollectorFailed(ch chan<- prometheus.Metric, ic ipmiCollector, reason string) {
+	scrapeErrors.WithLabelValues(ic.name, reason).Inc()
+	ch <- prometheus.MustNewConstMetric(
+		failureReasonDesc,
+		prometheus.GaugeValue,
+		1,
+		ic.name, reason,
+	)
+}
+
+// collectLastSuccess emits the time each collector last succeeded for the
+// target, if it ever did.
+func (c collector) collectLastSuccess(ch chan<- prometheus.Metric) {
+	for _, ic := range enabledCollectors(c.config) {
+		if t, ok := lastSuccess.Get(c.target, ic.name); ok {
+			ch <- prometheus.MustNewConstMetric(
+				lastSuccessDesc,
+				prometheus.GaugeValue,
+				float64(t.UnixNano())/1e9,
+				ic.name,
+			)
+		}
+	}
 }
 
 func (c collector) markAsDown(ch chan<- prometheus.Metric) {
@@ -389,63 +879,446 @@ func (c collector) markAsDown(ch chan<- prometheus.Metric) {
 	)
 }
 
+func (c collector) collectPowerConsumption(ctx context.Context, ch chan<- prometheus.Metric, creds Credentials) error {
+	currentPowerConsumption, err := c.getPowerConsumption(ctx, creds)
+	if err != nil {
+		return err
+	}
+	ch <- prometheus.MustNewConstMetric(
+		powerConsumption,
+		prometheus.GaugeValue,
+		currentPowerConsumption,
+	)
+	return nil
+}
+
+func (c collector) collectBmcInfo(ctx context.Context, ch chan<- prometheus.Metric, creds Credentials) error {
+	info, err := c.getBmcInfo(ctx, creds)
+	if err != nil {
+		return err
+	}
+	ch <- prometheus.MustNewConstMetric(
+		bmcInfo,
+		prometheus.GaugeValue,
+		1,
+		info.FirmwareRevision, info.ManufacturerID, info.ProductID,
+		info.DeviceID, info.IPMIVersion, info.SystemFirmwareVersion,
+	)
+	inventory.setBMCInfo(c.targetName(), c.target, info)
+	return nil
+}
+
+// ipmiCollector is one of the sets of metrics collected during a scrape,
+// usually backed by a single FreeIPMI command.
+type ipmiCollector struct {
+	name        string
+	description string
+	// command is the FreeIPMI command the collector runs.
+	command string
+	collect func(c collector, ctx context.Context, ch chan<- prometheus.Metric, creds Credentials) error
+	// enabled reports whether the collector is enabled in the config. If
+	// nil, the collector is always enabled.
+	enabled func(config *SafeConfig) bool
+}
+
+var ipmiCollectors = []ipmiCollector{
+	{"bmc", "bmc-info", "bmc-info", collector.collectBmcInfo, nil},
+	{"dcmi", "ipmi-dcmi power", "ipmi-dcmi", collector.collectPowerConsumption, nil},
+	{"ipmimonitoring", "ipmimonitoring sensor", "ipmimonitoring", collector.collectMonitoring, nil},
+	{"lan", "BMC LAN channel", "ipmi-raw", collector.collectLANInfo, lanInfoEnabled},
+	{"sel", "ipmi-sel", "ipmi-sel", collector.collectSEL, selEnabled},
+	{"fru", "ipmi-fru", "ipmi-fru", collector.collectFRU, fruEnabled},
+}
+
+// knownCollector reports whether there is a collector with the given name.
+func knownCollector(name string) bool {
+	for _, ic := range ipmiCollectors {
+		if ic.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// withCollectorTimeout returns a context that expires after the timeout
+// configured for the named collector, if any.
+func (c collector) withCollectorTimeout(ctx context.Context, name string) (context.Context, context.CancelFunc) {
+	if timeout := c.config.CollectorTimeout(name); timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// enabledCollectors returns the collectors enabled in config.
+func enabledCollectors(config *SafeConfig) []ipmiCollector {
+	var result []ipmiCollector
+	for _, ic := range ipmiCollectors {
+		if ic.enabled == nil || ic.enabled(config) {
+			result = append(result, ic)
+		}
+	}
+	return result
+}
+
+var (
+	// scrapes coalesces concurrent scrapes of the same target.
+	scrapes scrapeGroup
+	// results caches the last successful scrape of each target.
+	results resultCache
+	// staleResults holds the last successful scrape of each target for the
+	// stale data fallback.
+	staleResults resultCache
+	// breaker short-circuits scrapes of targets that failed repeatedly.
+	breaker circuitBreaker
+	// collectorBreaker suppresses collectors that failed repeatedly for a
+	// target.
+	collectorBreaker circuitBreaker
+	// lastSuccess tracks when each collector last succeeded for a target.
+	lastSuccess successTracker
+
+	scrapesInFlight = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace + "_exporter",
+			Name:      "scrapes_in_flight",
+			Help:      "Number of scrapes of IPMI devices currently running.",
+		},
+	)
+
+	// scrapeDurations is only registered if enabled on the command line.
+	scrapeDurations = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: namespace + "_exporter",
+			Name:      "scrape_duration_seconds",
+			Help:      "Time scrapes of IPMI devices took to complete.",
+			Buckets:   []float64{.1, .25, .5, 1, 2.5, 5, 10, 20, 30, 60},
+		},
+	)
+)
+
 // Collect implements Prometheus.Collector.
 func (c collector) Collect(ch chan<- prometheus.Metric) {
-	start := time.Now()
-	defer func() {
-		duration := time.Since(start).Seconds()
-		log.Debugf("Scrape of target %s took %f seconds.", c.target, duration)
-		ch <- prometheus.MustNewConstMetric(
-			durationDesc,
-			prometheus.GaugeValue,
-			duration,
-		)
-	}()
+	key := c.target + "\x00" + c.credentials
+	ttl := c.config.CacheTTL()
+	if ttl > 0 {
+		if r, ok := results.Get(key, ttl); ok {
+			log.Debugf("Serving cached result of target %s from %s.", c.target, r.time)
+			c.emit(ch, r, true)
+			if c.config.StaleDataMaxAge() > 0 {
+				c.emitStaleness(ch, false, 0)
+			}
+			return
+		}
+	}
 
-	creds, err := c.config.CredentialsForTarget(c.target)
-	if err != nil {
-		log.Errorf("No credentials available for target %s.", c.target)
-		c.markAsDown(ch)
-		return
+	cbc := c.config.CircuitBreaker()
+	if cbc.Threshold > 0 {
+		if until, open := breaker.Open(key); open {
+			log.Debugf("Not scraping target %s after repeated failures until %s.", c.target, until)
+			c.emitStale(ch, key, c.shortCircuit())
+			return
+		}
 	}
 
-	firmwareRevision, manufacturerID, err := c.getBmcInfo(creds)
+	ctx := c.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	r, shared, err := scrapes.Do(ctx, key, c.sharedScrape(key))
 	if err != nil {
-		log.Errorf("Could not collect bmc-info metrics: %s", err)
-		c.markAsDown(ch)
+		log.Warnf("Giving up waiting for the scrape of target %s: %s", c.target, err)
+		c.emitStale(ch, key, c.shortCircuit())
 		return
 	}
+	if shared {
+		log.Debugf("Sharing result of concurrent scrape of target %s.", c.target)
+	}
+	c.emitStale(ch, key, r)
+}
 
-	currentPowerConsumption, err := c.getPowerConsumption(creds)
-	if err != nil {
-		log.Errorf("Could not collect ipmi-dcmi power metrics: %s", err)
-		c.markAsDown(ch)
-		return
+// sharedScrape returns the scrape shared by all concurrent requests for key.
+// It does not depend on the request that starts it, so that it completes for
+// the other requests even if that one is cancelled or times out first, and it
+// records its result in the cache and the circuit breaker.
+func (c collector) sharedScrape(key string) func() scrapeResult {
+	s := c
+	s.ctx = context.Background()
+	s.timeout = sharedScrapeTimeout
+	return func() scrapeResult {
+		r := s.scrape()
+		if ttl := s.config.CacheTTL(); r.success && ttl > 0 {
+			results.Put(key, r, ttl)
+		}
+		if maxAge := s.config.StaleDataMaxAge(); r.success && maxAge > 0 {
+			staleResults.Put(key, r, maxAge)
+		}
+		if cbc := s.config.CircuitBreaker(); cbc.Threshold > 0 {
+			breaker.Record(key, r.success, cbc.Threshold, cbc.Backoff)
+		}
+		return r
 	}
+}
 
-	err = c.collectMonitoring(ch, creds)
-	if err != nil {
-		log.Errorf("Could not collect ipmimonitoring sensor metrics: %s", err)
+// shortCircuit returns the result of a scrape that is skipped because the
+// circuit breaker of the target is open.
+func (c collector) shortCircuit() scrapeResult {
+	r := scrapeResult{time: time.Now()}
+	ch := make(chan prometheus.Metric)
+	go func() {
 		c.markAsDown(ch)
+		c.collectLastSuccess(ch)
+		close(ch)
+	}()
+	for m := range ch {
+		r.metrics = append(r.metrics, m)
+	}
+	return r
+}
+
+// emitStale emits r. If the stale data fallback is enabled and the scrape
+// failed, the metrics missing from r are taken from the last successful
+// scrape of the target, if it is recent enough.
+func (c collector) emitStale(ch chan<- prometheus.Metric, key string, r scrapeResult) {
+	maxAge := c.config.StaleDataMaxAge()
+	if maxAge <= 0 {
+		c.emit(ch, r, false)
+		return
+	}
+	stale, ok := staleResults.Get(key, maxAge)
+	if r.success || !ok {
+		c.emit(ch, r, false)
+		c.emitStaleness(ch, false, 0)
 		return
 	}
 
+	// Metrics of collectors that failed are missing from r entirely, so
+	// everything whose descriptor does not occur in r is taken from the
+	// stale result.
+	fresh := make(map[*prometheus.Desc]bool)
+	for _, m := range r.metrics {
+		fresh[m.Desc()] = true
+	}
+	for _, m := range stale.metrics {
+		if !fresh[m.Desc()] {
+			r.metrics = append(r.metrics, m)
+		}
+	}
+	log.Debugf("Serving stale data of target %s from %s.", c.target, stale.time)
+	c.emit(ch, r, false)
+	c.emitStaleness(ch, true, time.Since(stale.time).Seconds())
+}
+
+func (c collector) emitStaleness(ch chan<- prometheus.Metric, stale bool, age float64) {
 	ch <- prometheus.MustNewConstMetric(
-		bmcInfo,
+		dataStaleDesc,
 		prometheus.GaugeValue,
-		1,
-		firmwareRevision, manufacturerID,
+		boolToFloat(stale),
 	)
 	ch <- prometheus.MustNewConstMetric(
-		powerConsumption,
+		dataAgeDesc,
 		prometheus.GaugeValue,
-		currentPowerConsumption,
+		age,
 	)
+}
+
+func (c collector) emit(ch chan<- prometheus.Metric, r scrapeResult, cacheHit bool) {
+	for _, m := range r.metrics {
+		ch <- m
+	}
+	// The result may be shared by aliases of the same address, so the
+	// duration is labeled with the name only here.
+	ch <- prometheus.MustNewConstMetric(
+		durationDesc,
+		prometheus.GaugeValue,
+		r.duration,
+		c.targetName(), c.target,
+	)
+	if c.config.CacheTTL() > 0 {
+		ch <- prometheus.MustNewConstMetric(
+			cacheHitDesc,
+			prometheus.GaugeValue,
+			boolToFloat(cacheHit),
+		)
+	}
+}
+
+// scrape runs all collectors and returns the resulting metrics.
+func (c collector) scrape() scrapeResult {
+	r := scrapeResult{time: time.Now()}
+	ch := make(chan prometheus.Metric)
+	go func() {
+		r.success = c.collect(ch)
+		close(ch)
+	}()
+	for m := range ch {
+		r.metrics = append(r.metrics, m)
+	}
+	r.duration = time.Since(r.time).Seconds()
+	log.Debugf("Scrape of target %s took %f seconds.", c.target, r.duration)
+	scrapeDurations.Observe(r.duration)
+	return r
+}
+
+// targetName returns the name of the target as requested.
+func (c collector) targetName() string {
+	if c.name == "" {
+		return c.target
+	}
+	return c.name
+}
+
+// collect runs all collectors and reports whether all of them succeeded.
+func (c collector) collect(ch chan<- prometheus.Metric) bool {
+	scrapesInFlight.Inc()
+	defer scrapesInFlight.Dec()
+	start := time.Now()
+
+	ctx := c.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	sr := &scrapeRecord{start: start}
+	ctx = withScrapeRecord(ctx, sr)
+	defer storeLastScrape(c.target, sr)
+
+	ctx, sp := startSpan(ctx, "scrape", map[string]string{"target": c.target})
+	defer sp.End()
+
+	var waited int64
+	ctx = withWaitTime(ctx, &waited)
+	defer func() {
+		ch <- prometheus.MustNewConstMetric(
+			queueWaitDesc,
+			prometheus.GaugeValue,
+			time.Duration(atomic.LoadInt64(&waited)).Seconds(),
+		)
+	}()
+
+	creds, err := c.config.CredentialsForTarget(c.credentials)
+	if err != nil {
+		sp.SetError(err)
+		log.Errorf("No credentials available for target %s.", c.target)
+		for _, ic := range enabledCollectors(c.config) {
+			c.markCollectorFailed(ch, ic, reasonNoCredentials)
+		}
+		c.markAsDown(ch)
+		return false
+	}
+
+	if ctx, err = withScrapeResolution(ctx, c.config, c.target, c.credentials); err != nil {
+		sp.SetError(err)
+		log.Errorf("Could not resolve target %s: %s", c.target, err)
+		for _, ic := range enabledCollectors(c.config) {
+			c.markCollectorFailed(ch, ic, reasonDNS)
+		}
+		c.markAsDown(ch)
+		return false
+	}
+
+	// Run the collectors concurrently, but never more of them at once than
+	// configured, as BMCs only support a limited number of sessions.
+	collectors := enabledCollectors(c.config)
+	slots := c.config.MaxConcurrentCommands()
+	if slots == 0 {
+		slots = len(collectors)
+	}
+	var (
+		wg     sync.WaitGroup
+		failed int32
+		sem    = make(chan struct{}, slots)
+	)
+	skipped := c.skippedCollectors(ctx, creds)
+	csc := c.config.CollectorSuppression()
+	for _, ic := range collectors {
+		breakerKey := c.target + "\x00" + ic.name
+		if _, ok := skipped[ic.name]; !ok && csc.Threshold > 0 {
+			if until, open := collectorBreaker.Open(breakerKey); open {
+				log.Debugf("Not running %s collector for target %s after repeated failures until %s.", ic.name, c.target, until)
+				skipped[ic.name] = skipReasonSuppressed
+			}
+		}
+		if reason, ok := skipped[ic.name]; ok {
+			ch <- prometheus.MustNewConstMetric(
+				collectorSkippedDesc,
+				prometheus.GaugeValue,
+				1,
+				ic.name, reason,
+			)
+			continue
+		}
+		wg.Add(1)
+		go func(ic ipmiCollector) {
+			defer wg.Done()
+			start := time.Now()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			addWaitTime(ctx, time.Since(start))
+			start = time.Now()
+			ctx, cancel := c.withCollectorTimeout(ctx, ic.name)
+			defer cancel()
+			ctx, sp := startSpan(ctx, "collect "+ic.name, map[string]string{"collector": ic.name, "target": c.target})
+			var stderrLines int64
+			err := ic.collect(c, withStderrLines(ctx, &stderrLines), ch, creds)
+			sp.SetError(err)
+			sp.End()
+			ch <- prometheus.MustNewConstMetric(
+				stderrLinesDesc,
+				prometheus.GaugeValue,
+				float64(atomic.LoadInt64(&stderrLines)),
+				ic.name,
+			)
+			ch <- prometheus.MustNewConstMetric(
+				collectorDurationDesc,
+				prometheus.GaugeValue,
+				time.Since(start).Seconds(),
+				ic.name,
+			)
+			if err != nil {
+				log.Errorf("Could not collect %s metrics: %s", ic.description, err)
+				if _, ok := err.(*parseError); ok {
+					parseErrors.WithLabelValues(ic.name).Inc()
+				}
+				c.markCollectorFailed(ch, ic, failureReason(err))
+				atomic.StoreInt32(&failed, 1)
+			} else {
+				lastSuccess.Record(c.target, ic.name, time.Now())
+			}
+			if csc.Threshold > 0 {
+				collectorBreaker.Record(breakerKey, err == nil, csc.Threshold, csc.TTL)
+			}
+		}(ic)
+	}
+	wg.Wait()
+	c.collectLastSuccess(ch)
+
+	if failed != 0 {
+		sp.SetError(errors.New("collector failed"))
+		c.markAsDown(ch)
+		return false
+	}
 	ch <- prometheus.MustNewConstMetric(
 		upDesc,
 		prometheus.GaugeValue,
 		1,
 	)
+	return true
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
 }
 
 func contains(s []int64, elm int64) bool {
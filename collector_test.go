@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestFreeIPMICredentials(t *testing.T) {
+	tests := []struct {
+		user, password string
+		config         string
+		args           []string
+	}{
+		{"admin", "secret", "username admin\npassword secret\n", nil},
+		{"admin", "two words", "username admin\npassword \"two words\"\n", nil},
+		{"admin", "pass#word", "username admin\npassword \"pass#word\"\n", nil},
+		{"ad min", "secret", "username \"ad min\"\npassword secret\n", nil},
+		// Values the config file cannot represent are passed as arguments,
+		// so that they cannot inject options into the config file.
+		{"admin", "secret\nprivilege-level user", "username admin\n", []string{"-p", "secret\nprivilege-level user"}},
+		{"admin", "tab\tbed", "username admin\n", []string{"-p", "tab\tbed"}},
+		{"admin", "quo\"te", "username admin\n", []string{"-p", "quo\"te"}},
+		{"back\\slash", "secret", "password secret\n", []string{"-u", "back\\slash"}},
+	}
+	for _, test := range tests {
+		config, args := freeipmiCredentials(test.user, test.password)
+		if config != test.config {
+			t.Errorf("%q/%q: expected config %q, got %q", test.user, test.password, test.config, config)
+		}
+		if !reflect.DeepEqual(args, test.args) {
+			t.Errorf("%q/%q: expected arguments %q, got %q", test.user, test.password, test.args, args)
+		}
+	}
+}
+
+func TestSplitMonitoringOutput(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		names   []string
+		skipped int
+		err     string
+	}{
+		{
+			name:   "regular rows",
+			output: "1,CPU Temp,Temperature,Nominal,45.00,C,'OK'\n2,PS Status,Power Supply,Nominal,N/A,N/A,'Presence detected'\n",
+			names:  []string{"CPU Temp", "PS Status"},
+		},
+		{
+			name:   "quoted commas",
+			output: "1,\"Fan 1, Front\",Fan,Nominal,3000.00,RPM,'OK'\n",
+			names:  []string{"Fan 1, Front"},
+		},
+		{
+			name:    "embedded newline",
+			output:  "1,\"PS\nStatus\",Power Supply,Nominal,N/A,N/A,'OK'\nx,Bad,Temperature,Nominal,1.00,C,'OK'\n",
+			names:   []string{"PS\nStatus"},
+			skipped: 1,
+		},
+		{
+			name:    "variable column counts",
+			output:  "1,Short,Temperature,Nominal,1.00\n2,Long,Temperature,Nominal,2.00,C,'OK',extra,columns\n",
+			names:   []string{"Long"},
+			skipped: 1,
+		},
+		{
+			name:    "trailing junk",
+			output:  "1,CPU Temp,Temperature,Nominal,45.00,C,'OK'\nipmimonitoring: some warning\n",
+			names:   []string{"CPU Temp"},
+			skipped: 1,
+		},
+		{
+			name:    "invalid value",
+			output:  "1,CPU Temp,Temperature,Nominal,hot,C,'OK'\n",
+			skipped: 1,
+			err:     "line 1: invalid value for sensor 1",
+		},
+		{
+			name:    "line numbers after multi-line records",
+			output:  "x,\"A\nB\",Temperature,Nominal,1.00,C,'OK'\ny,C,Temperature,Nominal,1.00,C,'OK'\n",
+			skipped: 2,
+			err:     "line 3: invalid sensor ID",
+		},
+		{
+			name: "empty output",
+		},
+	}
+	for _, test := range tests {
+		result, skipped, err := splitMonitoringOutput([]byte(test.output))
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected error containing %q, got %v", test.name, test.err, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		}
+		if skipped != test.skipped {
+			t.Errorf("%s: expected %d skipped rows, got %d", test.name, test.skipped, skipped)
+		}
+		var names []string
+		for _, s := range result {
+			names = append(names, s.Name)
+		}
+		if strings.Join(names, "|") != strings.Join(test.names, "|") {
+			t.Errorf("%s: expected sensors %q, got %q", test.name, test.names, names)
+		}
+	}
+}
+
+func FuzzSplitMonitoringOutput(f *testing.F) {
+	f.Add([]byte("1,CPU Temp,Temperature,Nominal,45.00,C,'OK'\n"))
+	f.Add([]byte("2,PS Status,Power Supply,Nominal,N/A,N/A,'Presence detected'\n"))
+	f.Add([]byte("1,\"Fan 1, Front\",Fan,Nominal,3000.00,RPM,'OK'\nx,\"A\nB\",Fan\n"))
+	f.Add([]byte("ipmimonitoring: some warning\n\"unterminated"))
+	f.Fuzz(func(t *testing.T, output []byte) {
+		result, skipped, err := splitMonitoringOutput(output)
+		if skipped < 0 {
+			t.Fatalf("negative skip count %d", skipped)
+		}
+		if err != nil && len(result) > 0 {
+			t.Fatalf("got %d sensors along with error %s", len(result), err)
+		}
+		for _, s := range result {
+			if _, err := parseSensorRow([]string{strconv.FormatInt(s.ID, 10), s.Name, s.Type, s.State, "N/A", s.Unit, s.Event}); err != nil {
+				t.Fatalf("parsed sensor %+v does not parse again: %s", s, err)
+			}
+		}
+	})
+}
+
+// runCollector runs the collect function of an ipmiCollector against a fake
+// executor and returns the metrics it emitted.
+func runCollector(t *testing.T, config string, outputs map[string]string, collect func(collector, context.Context, chan<- prometheus.Metric, Credentials) error) (*fakeExecutor, []prometheus.Metric, error) {
+	t.Helper()
+	e := newFakeExecutor(outputs)
+	c := collector{target: "10.0.0.1", config: loadTestConfig(t, config), executor: e}
+	ch := make(chan prometheus.Metric, 100)
+	err := collect(c, context.Background(), ch, Credentials{User: "admin", Password: "secret"})
+	close(ch)
+	var metrics []prometheus.Metric
+	for m := range ch {
+		metrics = append(metrics, m)
+	}
+	return e, metrics, err
+}
+
+// metricValue returns the value of the metric with desc and the given label
+// values, in the order of the label names of desc.
+func metricValue(t *testing.T, metrics []prometheus.Metric, desc *prometheus.Desc, labels ...string) (float64, bool) {
+	t.Helper()
+	for _, m := range metrics {
+		if m.Desc() != desc {
+			continue
+		}
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			t.Fatal(err)
+		}
+		var values []string
+		for _, l := range pb.Label {
+			values = append(values, l.GetValue())
+		}
+		if len(labels) == 0 && len(values) == 0 || reflect.DeepEqual(values, labels) {
+			return pb.GetGauge().GetValue(), true
+		}
+	}
+	return 0, false
+}
+
+func TestCollectMonitoring(t *testing.T) {
+	e, metrics, err := runCollector(t, "sdr_cache:\n  never_flush: true\n", map[string]string{
+		"ipmimonitoring -Q --comma-separated-output --no-header-output": "1,CPU Temp,Temperature,Nominal,45.00,C,'OK'\n" +
+			"2,Fan 1,Fan,Critical,1200.00,RPM,'At or Below (<=) Lower Critical Threshold'\n" +
+			"3,PS Status,Power Supply,Nominal,N/A,N/A,'Presence detected'\n",
+	}, collector.collectMonitoring)
+	if err != nil {
+		t.Fatalf("unexpected error: %s (commands run: %v)", err, e.calls)
+	}
+	if e.stdin != "username admin\npassword secret\n" {
+		t.Errorf("unexpected credentials config %q", e.stdin)
+	}
+	// The IDs and names are sorted by label name, which puts the ID first.
+	tests := []struct {
+		name   string
+		desc   *prometheus.Desc
+		labels []string
+		value  float64
+	}{
+		{"sensor count", sensorCountDesc, nil, 3},
+		{"temperature", temperatureDesc, []string{"1", "CPU Temp"}, 45},
+		{"temperature state", temperatureStateDesc, []string{"1", "CPU Temp"}, 0},
+		{"fan speed", fanSpeedDesc, []string{"2", "Fan 1"}, 1200},
+		{"fan speed state", fanSpeedStateDesc, []string{"2", "Fan 1"}, 2},
+		{"generic sensor state", sensorStateDesc, []string{"3", "PS Status", "Power Supply"}, 0},
+	}
+	for _, test := range tests {
+		value, ok := metricValue(t, metrics, test.desc, test.labels...)
+		if !ok {
+			t.Errorf("%s: metric not emitted", test.name)
+			continue
+		}
+		if value != test.value {
+			t.Errorf("%s: expected %v, got %v", test.name, test.value, value)
+		}
+	}
+}
+
+func TestCollectMonitoringCommandFailure(t *testing.T) {
+	_, metrics, err := runCollector(t, "", nil, collector.collectMonitoring)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if len(metrics) != 0 {
+		t.Errorf("expected no metrics, got %d", len(metrics))
+	}
+}
+
+func TestCollectPowerConsumption(t *testing.T) {
+	_, metrics, err := runCollector(t, "", map[string]string{
+		"ipmi-dcmi --get-system-power-statistics": "Current Power                        : 70 Watts\n" +
+			"Minimum Power over sampling duration : 50 watts\n",
+	}, collector.collectPowerConsumption)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if value, ok := metricValue(t, metrics, powerConsumption); !ok || value != 70 {
+		t.Errorf("expected power consumption 70, got %v (emitted: %v)", value, ok)
+	}
+
+	_, _, err = runCollector(t, "", map[string]string{
+		"ipmi-dcmi --get-system-power-statistics": "Current Power : not available\n",
+	}, collector.collectPowerConsumption)
+	if _, ok := err.(*parseError); !ok {
+		t.Errorf("expected a parse error, got %v", err)
+	}
+}
+
+func TestCollectBmcInfo(t *testing.T) {
+	_, metrics, err := runCollector(t, "", map[string]string{
+		"bmc-info --get-device-id --get-system-info": "Device ID             : 32\n" +
+			"Firmware Revision     : 2.41\n" +
+			"IPMI Version          : 2.0\n" +
+			"Manufacturer ID       : Dell Inc. (674)\n" +
+			"Product ID            : 256\n" +
+			"System Firmware Version : 2.10.0\n",
+	}, collector.collectBmcInfo)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// The label values are sorted by label name.
+	labels := []string{"32", "2.41", "2.0", "Dell Inc. (674)", "256", "2.10.0"}
+	if value, ok := metricValue(t, metrics, bmcInfo, labels...); !ok || value != 1 {
+		t.Errorf("expected bmc info with labels %v, got %v", labels, metrics)
+	}
+}
+
+func TestCollectSELInfoBestEffort(t *testing.T) {
+	config := "sel:\n  size_metrics: true\n  alertmanager:\n    url: http://127.0.0.1:1\n"
+	sel := "1,Oct-17-2026,03:00:00,PS 1,Power Supply,Critical,Power Supply AC lost\n"
+	_, metrics, err := runCollector(t, config, map[string]string{
+		"ipmi-sel -Q --comma-separated-output --no-header-output --output-event-state": sel,
+		"ipmi-sel --info": "Free space remaining : garbage\n",
+	}, collector.collectSEL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if value, ok := metricValue(t, metrics, selEntriesDesc); !ok || value != 1 {
+		t.Errorf("expected 1 SEL entry, got %v (emitted: %v)", value, ok)
+	}
+	if _, ok := metricValue(t, metrics, selSizeDesc); ok {
+		t.Error("expected no SEL size without valid --info output")
+	}
+	if _, ok := selEntriesSeen.lastID["10.0.0.1"]; !ok {
+		t.Error("expected the SEL entries to be tracked")
+	}
+}
+
+func TestCollectSELSizeOnly(t *testing.T) {
+	e, metrics, err := runCollector(t, "sel:\n  size_metrics: true\n", map[string]string{
+		"ipmi-sel --info": "Number of log entries : 2\n" +
+			"Free space remaining : 15984 bytes\n",
+	}, collector.collectSEL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(e.calls) != 1 {
+		t.Errorf("expected only ipmi-sel --info to run, ran %v", e.calls)
+	}
+	expected := map[*prometheus.Desc]float64{
+		selEntriesDesc:   2,
+		selFreeSpaceDesc: 15984,
+		selSizeDesc:      16016,
+	}
+	for desc, value := range expected {
+		if v, ok := metricValue(t, metrics, desc); !ok || v != value {
+			t.Errorf("%s: expected %v, got %v (emitted: %v)", desc, value, v, ok)
+		}
+	}
+}
+
+func TestCollectMonitoringSensorCount(t *testing.T) {
+	config := "exclude_sensor_ids: [2]\nsensors:\n  max_sensors: 2\n  not_available: drop\nsdr_cache:\n  never_flush: true\n"
+	_, metrics, err := runCollector(t, config, map[string]string{
+		"ipmimonitoring -Q --comma-separated-output --no-header-output": "1,CPU Temp,Temperature,Nominal,45.00,C,'OK'\n" +
+			"2,Fan 1,Fan,Nominal,3000.00,RPM,'OK'\n" +
+			"3,PS Status,Power Supply,Nominal,N/A,N/A,'Presence detected'\n",
+	}, collector.collectMonitoring)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if value, ok := metricValue(t, metrics, sensorCountDesc); !ok || value != 3 {
+		t.Errorf("expected 3 sensors reported, got %v (emitted: %v)", value, ok)
+	}
+	if value, ok := metricValue(t, metrics, sensorLimitExceededDesc); !ok || value != 1 {
+		t.Errorf("expected the sensor limit to be exceeded, got %v (emitted: %v)", value, ok)
+	}
+	for reason, expected := range map[string]float64{skipReasonExcluded: 1, skipReasonNotAvailable: 1} {
+		if value, ok := metricValue(t, metrics, sensorsSkippedDesc, reason); !ok || value != expected {
+			t.Errorf("expected %v sensors skipped as %s, got %v (emitted: %v)", expected, reason, value, ok)
+		}
+	}
+}
+
+func TestDurationLabels(t *testing.T) {
+	c := collector{name: "node1", target: "10.0.0.1", config: loadTestConfig(t, "")}
+	ch := make(chan prometheus.Metric, 10)
+	c.emit(ch, scrapeResult{duration: 1.5}, false)
+	close(ch)
+	var metrics []prometheus.Metric
+	for m := range ch {
+		metrics = append(metrics, m)
+	}
+	// The label values are sorted by label name, which puts the address
+	// first.
+	if value, ok := metricValue(t, metrics, durationDesc, "10.0.0.1", "node1"); !ok || value != 1.5 {
+		t.Errorf("expected scrape duration 1.5 for node1 at 10.0.0.1, got %v (emitted: %v)", value, ok)
+	}
+}
+
+func TestCollectFRU(t *testing.T) {
+	_, metrics, err := runCollector(t, "inventory:\n  asset_tag: true\n", map[string]string{
+		"ipmi-fru": "FRU Inventory Device: Default FRU Device (ID 00h)\n\n" +
+			"  FRU Chassis Type: Rack Mount Chassis\n" +
+			"  FRU Product Name: PowerEdge R640\n" +
+			"  FRU Product Asset Tag: INV-004711\n",
+	}, collector.collectFRU)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if value, ok := metricValue(t, metrics, fruInfoDesc, "INV-004711"); !ok || value != 1 {
+		t.Errorf("expected fru info with asset tag INV-004711, got %v", metrics)
+	}
+	if tag := parseFRUAssetTag([]byte("  FRU Product Name: PowerEdge R640\n")); tag != "" {
+		t.Errorf("expected no asset tag, got %q", tag)
+	}
+}
@@ -1,71 +1,1241 @@
 package main
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"io/ioutil"
+	"math"
+	"net"
+	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
 	yaml "gopkg.in/yaml.v2"
 )
 
+var (
+	configReloadSuccess = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace + "_exporter",
+			Name:      "config_last_reload_successful",
+			Help:      "Whether the last configuration reload attempt was successful.",
+		},
+	)
+
+	configReloadSeconds = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace + "_exporter",
+			Name:      "config_last_reload_success_timestamp_seconds",
+			Help:      "Timestamp of the last successful configuration reload.",
+		},
+	)
+)
+
 // Config is the Go representation of the yaml config file.
 type Config struct {
 	Credentials map[string]Credentials `yaml:"credentials"`
 
-	ExcludeSensorIDs []int64 `yaml:"exclude_sensor_ids"`
+	// CredentialsLabels is a regular expression matched against the name of
+	// the credentials used for a scrape. Its named groups are added as
+	// labels to all metrics of the scrape, e.g. with
+	// "(?P<tenant>[^/]+)/(?P<job_source>.+)" for credentials named like
+	// "baremetal/ironic".
+	CredentialsLabels string `yaml:"credentials_labels"`
+
+	ExcludeSensorIDs []int64 `yaml:"exclude_sensor_ids"`
+
+	// AllowedTargets restricts the values accepted for the target
+	// parameter. Entries are either literal targets or CIDR ranges. An empty
+	// list allows all targets.
+	AllowedTargets []string `yaml:"allowed_targets"`
+
+	// MaxConcurrentCommands is the number of FreeIPMI commands run
+	// concurrently against a single target during a scrape. Zero means no
+	// limit.
+	MaxConcurrentCommands int `yaml:"max_concurrent_commands"`
+
+	// CacheTTL is the time for which the result of a successful scrape is
+	// served to subsequent scrapes of the same target. Zero disables caching.
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+
+	// CollectorTimeouts maps the names of collectors, or "chassis" for the
+	// power state check of skip_when_powered_off, to the time after which
+	// their FreeIPMI commands are aborted, independently of the scrape
+	// timeout.
+	CollectorTimeouts map[string]time.Duration `yaml:"collector_timeouts"`
+
+	// StaleDataMaxAge is the maximum age of the data of the last successful
+	// scrape that is served in place of data that could not be retrieved.
+	// Zero disables the stale data fallback.
+	StaleDataMaxAge time.Duration `yaml:"stale_data_max_age"`
+
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuit_breaker"`
+
+	CollectorSuppression CollectorSuppressionConfig `yaml:"collector_suppression"`
+
+	SDRCache SDRCacheConfig `yaml:"sdr_cache"`
+
+	Sensors SensorsConfig `yaml:"sensors"`
+
+	// SensorStates maps sensor types to the values exported for the states
+	// of sensors of that type, e.g. "Warning: 1". The "default" entry
+	// applies to all types without a specific entry for a state.
+	SensorStates map[string]map[string]float64 `yaml:"sensor_states"`
+
+	Retry RetryConfig `yaml:"retry"`
+
+	// SkipWhenPoweredOff skips the sensor collectors for targets whose
+	// system is powered off.
+	SkipWhenPoweredOff bool `yaml:"skip_when_powered_off"`
+
+	// LANChannel is the channel number of the BMC's LAN interface whose
+	// configuration is collected. Zero disables collecting it.
+	LANChannel uint8 `yaml:"lan_channel"`
+
+	Agent AgentConfig `yaml:"agent"`
+
+	Discovery DiscoveryConfig `yaml:"discovery"`
+
+	SEL SELConfig `yaml:"sel"`
+
+	Inventory InventoryConfig `yaml:"inventory"`
+
+	CapabilityProbing CapabilityProbingConfig `yaml:"capability_probing"`
+
+	// CommandWrappers maps FreeIPMI command names to a command line to
+	// prefix their invocations with, such as "sudo -n". The "default" entry
+	// applies to all commands without a specific entry.
+	CommandWrappers map[string][]string `yaml:"command_wrappers"`
+
+	// DNSResolution controls how host names of targets are resolved: "pass"
+	// (the default) passes them to FreeIPMI, "scrape" resolves them once per
+	// scrape and uses the same IP address for all commands, and "command"
+	// resolves them for every command.
+	DNSResolution string `yaml:"dns_resolution"`
+
+	// Chroot is a directory to run the FreeIPMI commands in as their root
+	// directory, e.g. the host's root filesystem mounted into a container.
+	Chroot string `yaml:"chroot"`
+
+	ResourceLimits ResourceLimitsConfig `yaml:"resource_limits"`
+
+	// Targets maps target aliases to the BMC address and credentials to use.
+	Targets map[string]Target `yaml:"targets"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline"`
+
+	AuthTokens []AuthToken `yaml:"auth_tokens"`
+
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+
+	allowedTargets    targetMatcher
+	credentialsLabels *regexp.Regexp
+}
+
+// SafeConfig wraps Config for concurrency-safe operations.
+type SafeConfig struct {
+	sync.RWMutex
+	C *Config
+
+	// discovered maps the name of a discovery source to the targets it
+	// discovered, by target name. It is kept across config reloads.
+	discovered map[string]map[string]Target
+}
+
+// Credentials is the Go representation of the credentials section in the yaml
+// config file.
+type Credentials struct {
+	User     string `yaml:"user"`
+	Password string `yaml:"pass"`
+	// DNSResolution overrides the global dns_resolution for the targets
+	// using these credentials.
+	DNSResolution string `yaml:"dns_resolution"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// CircuitBreakerConfig is the Go representation of the circuit_breaker
+// section in the yaml config file.
+type CircuitBreakerConfig struct {
+	// Threshold is the number of consecutive failed scrapes after which a
+	// target is not scraped anymore for Backoff. Zero disables the circuit
+	// breaker.
+	Threshold int           `yaml:"failure_threshold"`
+	Backoff   time.Duration `yaml:"backoff"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// CollectorSuppressionConfig is the Go representation of the
+// collector_suppression section in the yaml config file.
+type CollectorSuppressionConfig struct {
+	// Threshold is the number of consecutive failures of a collector for a
+	// target after which the collector is not run for that target anymore
+	// for TTL. Zero disables the suppression.
+	Threshold int           `yaml:"failure_threshold"`
+	TTL       time.Duration `yaml:"ttl"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// RateLimitConfig is the Go representation of the rate_limit section in the
+// yaml config file.
+type RateLimitConfig struct {
+	// Rate is the number of requests per second allowed per client IP. Zero
+	// disables rate limiting.
+	Rate  float64 `yaml:"requests_per_second"`
+	Burst int     `yaml:"burst"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// SDRCacheConfig is the Go representation of the sdr_cache section in the
+// yaml config file.
+type SDRCacheConfig struct {
+	// Directory is where FreeIPMI keeps the SDR caches. If empty, the
+	// FreeIPMI default is used.
+	Directory string `yaml:"directory"`
+	// MaxAge is the age after which the SDR cache of a target is recreated.
+	// Zero means it is recreated on every scrape.
+	MaxAge time.Duration `yaml:"max_age"`
+	// NeverFlush disables recreating SDR caches. FreeIPMI still creates
+	// missing caches.
+	NeverFlush bool `yaml:"never_flush"`
+	// WarmUp enables creating the SDR caches of all known targets on
+	// startup, running WarmUpConcurrency commands at a time.
+	WarmUp            bool `yaml:"warm_up"`
+	WarmUpConcurrency int  `yaml:"warm_up_concurrency"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// SensorsConfig is the Go representation of the sensors section in the yaml
+// config file.
+type SensorsConfig struct {
+	// BridgeSensors enables reading sensors behind satellite management
+	// controllers.
+	BridgeSensors bool `yaml:"bridge_sensors"`
+	// InterpretOEMData enables interpreting OEM specific sensor data.
+	InterpretOEMData bool `yaml:"interpret_oem_data"`
+	// EntitySensorNames prefixes sensor names with their entity, e.g.
+	// "Processor 1 Temp", to make them unique.
+	EntitySensorNames bool `yaml:"entity_sensor_names"`
+	// IgnoreNotAvailable is the older spelling of NotAvailable "drop".
+	IgnoreNotAvailable bool `yaml:"ignore_not_available"`
+	// NotAvailable is the handling of sensors whose reading is not
+	// available: "nan" exports NaN, "zero" exports 0 and "drop" does not
+	// export them at all.
+	NotAvailable string `yaml:"not_available"`
+	// MaxSensors is the number of sensors above which a target is considered
+	// broken. Zero means no limit.
+	MaxSensors int `yaml:"max_sensors"`
+	// TruncateSensors drops the sensors exceeding MaxSensors instead of
+	// only warning about them.
+	TruncateSensors bool `yaml:"truncate_sensors"`
+	// Aggregate controls the export of the number of sensors by type and
+	// state: "" exports per sensor metrics only, "both" exports the
+	// aggregated counts as well, and "only" exports the counts only.
+	Aggregate string `yaml:"aggregate"`
+	// NormalizeUnits converts readings to the units used by the typed
+	// sensor metrics, e.g. Fahrenheit to Celsius.
+	NormalizeUnits bool `yaml:"normalize_units"`
+	// FanMaxRPM is the maximum speed of fans whose speed is reported as a
+	// percentage, used to convert it to RPM if NormalizeUnits is set.
+	FanMaxRPM float64 `yaml:"fan_max_rpm"`
+	// ReadingTimestamps enables exporting the time each sensor reading was
+	// obtained.
+	ReadingTimestamps bool `yaml:"reading_timestamps"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// args returns the ipmimonitoring arguments for the configured options.
+func (s SensorsConfig) args() []string {
+	var args []string
+	if s.BridgeSensors {
+		args = append(args, "--bridge-sensors")
+	}
+	if s.InterpretOEMData {
+		args = append(args, "--interpret-oem-data")
+	}
+	if s.EntitySensorNames {
+		args = append(args, "--entity-sensor-names")
+	}
+	return args
+}
+
+// AgentConfig is the Go representation of the agent section in the yaml
+// config file.
+type AgentConfig struct {
+	// Interval is the time between background scrapes of each target.
+	Interval time.Duration `yaml:"interval"`
+	// Job is the value of the job label of pushed metrics.
+	Job string `yaml:"job"`
+	// Expose makes /metrics return the metrics of all targets, each with a
+	// target label.
+	Expose bool `yaml:"expose"`
+	// Concurrency is the number of targets scraped at the same time.
+	Concurrency int `yaml:"concurrency"`
+
+	RemoteWrite    RemoteWriteConfig    `yaml:"remote_write"`
+	Pushgateway    PushgatewayConfig    `yaml:"pushgateway"`
+	LeaderElection LeaderElectionConfig `yaml:"leader_election"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// Enabled reports whether background scrapes are configured.
+func (a AgentConfig) Enabled() bool {
+	return a.Expose || a.RemoteWrite.URL != "" || a.Pushgateway.URL != ""
+}
+
+// RemoteWriteConfig is the Go representation of the remote_write section in
+// the yaml config file.
+type RemoteWriteConfig struct {
+	URL     string            `yaml:"url"`
+	Timeout time.Duration     `yaml:"timeout"`
+	Headers map[string]string `yaml:"headers"`
+	// WriteRelabelConfigs are applied to all series before they are sent.
+	WriteRelabelConfigs []RelabelConfig `yaml:"write_relabel_configs"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// RelabelConfig is the Go representation of a relabeling rule in the yaml
+// config file, see
+// https://prometheus.io/docs/prometheus/latest/configuration/configuration/#relabel_config.
+type RelabelConfig struct {
+	SourceLabels []string `yaml:"source_labels"`
+	Separator    string   `yaml:"separator"`
+	Regex        string   `yaml:"regex"`
+	Modulus      uint64   `yaml:"modulus"`
+	TargetLabel  string   `yaml:"target_label"`
+	Replacement  string   `yaml:"replacement"`
+	Action       string   `yaml:"action"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline"`
+
+	regex *regexp.Regexp
+}
+
+// InventoryConfig is the Go representation of the inventory section in the
+// yaml config file.
+type InventoryConfig struct {
+	// File is written with the inventory of all scraped targets every
+	// interval, if set.
+	File     string        `yaml:"file"`
+	Format   string        `yaml:"format"`
+	Interval time.Duration `yaml:"interval"`
+	// AssetTag enables reading the asset tag with ipmi-fru during scrapes.
+	AssetTag bool `yaml:"asset_tag"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// CapabilityProbingConfig is the Go representation of the capability_probing
+// section in the yaml config file.
+type CapabilityProbingConfig struct {
+	// Enabled makes the exporter probe which commands a BMC supports on
+	// first contact and skip the collectors it does not support.
+	Enabled bool `yaml:"enabled"`
+	// Interval is the time after which the capabilities are probed again.
+	Interval time.Duration `yaml:"interval"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// SELConfig is the Go representation of the sel section in the yaml config
+// file.
+type SELConfig struct {
+	Alertmanager AlertmanagerConfig `yaml:"alertmanager"`
+	Loki         LokiConfig         `yaml:"loki"`
+	Syslog       SyslogConfig       `yaml:"syslog"`
+	Kafka        KafkaConfig        `yaml:"kafka"`
+	// SizeMetrics enables exporting the size and utilization of the SEL.
+	SizeMetrics bool `yaml:"size_metrics"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// enabled reports whether the SEL needs to be read during scrapes.
+func (s SELConfig) enabled() bool {
+	return s.SizeMetrics || s.Alertmanager.URL != "" || s.Loki.URL != "" || s.Syslog.Destination != "" || len(s.Kafka.Brokers) > 0
+}
+
+// AlertmanagerConfig is the Go representation of the alertmanager section in
+// the yaml config file.
+type AlertmanagerConfig struct {
+	// URL is the base URL of the Alertmanager, e.g. http://localhost:9093.
+	URL     string        `yaml:"url"`
+	Timeout time.Duration `yaml:"timeout"`
+	// Labels are added to every alert.
+	Labels map[string]string `yaml:"labels"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// LokiConfig is the Go representation of the loki section in the yaml config
+// file.
+type LokiConfig struct {
+	// URL is the base URL of Loki, e.g. http://localhost:3100.
+	URL     string        `yaml:"url"`
+	Timeout time.Duration `yaml:"timeout"`
+	// TenantID is sent in the X-Scope-OrgID header, if set.
+	TenantID string `yaml:"tenant_id"`
+	// Labels are added to the stream labels.
+	Labels map[string]string `yaml:"labels"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// SyslogConfig is the Go representation of the syslog section in the yaml
+// config file.
+type SyslogConfig struct {
+	// Destination is "local" for the local syslog daemon, "journald" for
+	// the systemd journal, or a udp:// or tcp:// URL of a syslog server.
+	Destination string `yaml:"destination"`
+	Facility    string `yaml:"facility"`
+	Tag         string `yaml:"tag"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// KafkaConfig is the Go representation of the kafka section in the yaml
+// config file.
+type KafkaConfig struct {
+	// Brokers are the host:port addresses used to look up the leader of the
+	// partition of a target.
+	Brokers  []string      `yaml:"brokers"`
+	Topic    string        `yaml:"topic"`
+	ClientID string        `yaml:"client_id"`
+	Timeout  time.Duration `yaml:"timeout"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// LeaderElectionConfig is the Go representation of the leader_election
+// section in the yaml config file.
+type LeaderElectionConfig struct {
+	// LeaseName is the name of the Kubernetes Lease to hold while scraping.
+	// Leader election is disabled if it is empty.
+	LeaseName string `yaml:"lease_name"`
+	// Namespace of the Lease, defaults to the exporter's own.
+	Namespace     string        `yaml:"namespace"`
+	LeaseDuration time.Duration `yaml:"lease_duration"`
+	RetryPeriod   time.Duration `yaml:"retry_period"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// DiscoveryConfig is the Go representation of the discovery section in the
+// yaml config file.
+type DiscoveryConfig struct {
+	// RefreshInterval is the time between two queries of each source.
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+
+	Netbox NetboxConfig `yaml:"netbox"`
+	Ironic IronicConfig `yaml:"ironic"`
+	Consul ConsulConfig `yaml:"consul"`
+	// DNSSRV lists DNS SRV record names whose targets are BMCs, e.g.
+	// _ipmi._udp.rack01.example.com.
+	DNSSRV []string `yaml:"dns_srv"`
+
+	Kubernetes KubernetesConfig `yaml:"kubernetes"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// NetboxConfig is the Go representation of the netbox section in the yaml
+// config file.
+type NetboxConfig struct {
+	URL   string `yaml:"url"`
+	Token string `yaml:"token"`
+	// Filters are passed as query parameters to the device list, e.g.
+	// "site: fra1" or "role: server".
+	Filters map[string]string `yaml:"filters"`
+	// Credentials is the name of the credentials to use for discovered
+	// targets. If empty, credentials are looked up by address.
+	Credentials string `yaml:"credentials"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// IronicConfig is the Go representation of the ironic section in the yaml
+// config file.
+type IronicConfig struct {
+	// URL is the endpoint of the Ironic API, e.g.
+	// https://baremetal.example.com:6385.
+	URL      string         `yaml:"url"`
+	Keystone KeystoneConfig `yaml:"keystone"`
+	// Credentials is the name of the credentials to use for discovered
+	// targets. If empty, the IPMI credentials from the driver_info of each
+	// node are used if the API returns them unmasked, else credentials are
+	// looked up by address.
+	Credentials string `yaml:"credentials"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// ConsulConfig is the Go representation of the consul section in the yaml
+// config file. Targets are discovered either from the instances of a service
+// in the catalog or from the keys below a KV prefix.
+type ConsulConfig struct {
+	URL        string `yaml:"url"`
+	Token      string `yaml:"token"`
+	Datacenter string `yaml:"datacenter"`
+	Service    string `yaml:"service"`
+	Tag        string `yaml:"tag"`
+	// CredentialsMetaKey is the service meta key naming the credentials to
+	// use for an instance.
+	CredentialsMetaKey string `yaml:"credentials_meta_key"`
+	KVPrefix           string `yaml:"kv_prefix"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// KubernetesConfig is the Go representation of the kubernetes section in the
+// yaml config file.
+type KubernetesConfig struct {
+	// Namespace to read ConfigMaps from, defaults to the exporter's own.
+	Namespace string `yaml:"namespace"`
+	// LabelSelector selects the ConfigMaps describing targets.
+	LabelSelector string `yaml:"label_selector"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// KeystoneConfig is the Go representation of the keystone section in the
+// yaml config file. If AuthURL is empty, no authentication is done.
+type KeystoneConfig struct {
+	AuthURL           string `yaml:"auth_url"`
+	Username          string `yaml:"username"`
+	Password          string `yaml:"password"`
+	UserDomainName    string `yaml:"user_domain_name"`
+	ProjectName       string `yaml:"project_name"`
+	ProjectDomainName string `yaml:"project_domain_name"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// PushgatewayConfig is the Go representation of the pushgateway section in
+// the yaml config file.
+type PushgatewayConfig struct {
+	URL     string        `yaml:"url"`
+	Timeout time.Duration `yaml:"timeout"`
+	// GroupingLabels are added to the grouping key of every push, in
+	// addition to job, instance and the labels of the target alias.
+	GroupingLabels map[string]string `yaml:"grouping_labels"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// RetryConfig is the Go representation of the retry section in the yaml
+// config file.
+type RetryConfig struct {
+	// MaxRetries is the number of times a FreeIPMI command is retried after
+	// a transient failure. Zero disables retries.
+	MaxRetries     int           `yaml:"max_retries"`
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration `yaml:"max_backoff"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// ResourceLimitsConfig is the Go representation of the resource_limits
+// section in the yaml config file.
+type ResourceLimitsConfig struct {
+	// Nice is the niceness FreeIPMI commands run with.
+	Nice int `yaml:"nice"`
+	// CPUTime is the CPU time FreeIPMI commands may use.
+	CPUTime time.Duration `yaml:"cpu_time"`
+	// MaxRuntime is the wall-clock time after which FreeIPMI commands are
+	// killed.
+	MaxRuntime time.Duration `yaml:"max_runtime"`
+	// MaxMemoryBytes is the size of the address space FreeIPMI commands may
+	// use.
+	MaxMemoryBytes int64 `yaml:"max_memory_bytes"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// AuthToken is the Go representation of an entry in the auth_tokens section
+// in the yaml config file.
+type AuthToken struct {
+	Token string `yaml:"token"`
+	// Targets restricts the targets that may be scraped with this token, with
+	// the same syntax as allowed_targets. An empty list allows all targets.
+	Targets []string `yaml:"targets"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline"`
+
+	targets targetMatcher
+}
+
+// Target is the Go representation of a target alias in the yaml config file.
+type Target struct {
+	Address     string            `yaml:"address"`
+	Credentials string            `yaml:"credentials"`
+	Labels      map[string]string `yaml:"labels"`
+
+	// discoveredCredentials are the credentials of a discovered target, if
+	// the discovery source provided them.
+	discoveredCredentials *Credentials
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+func checkOverflow(m map[string]interface{}, ctx string) error {
+	if len(m) > 0 {
+		var keys []string
+		for k := range m {
+			keys = append(keys, k)
+		}
+		return fmt.Errorf("unknown fields in %s: %s", ctx, strings.Join(keys, ", "))
+	}
+	return nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Config
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if err := checkOverflow(s.XXX, "config"); err != nil {
+		return err
+	}
+	if s.MaxConcurrentCommands < 0 {
+		return fmt.Errorf("max_concurrent_commands must not be negative")
+	}
+	var err error
+	if s.allowedTargets, err = newTargetMatcher(s.AllowedTargets); err != nil {
+		return fmt.Errorf("invalid allowed_targets: %s", err)
+	}
+	if s.CredentialsLabels != "" {
+		if s.credentialsLabels, err = regexp.Compile("^(?:" + s.CredentialsLabels + ")$"); err != nil {
+			return fmt.Errorf("invalid credentials_labels: %s", err)
+		}
+	}
+	if err := checkDNSResolution(s.DNSResolution); err != nil {
+		return err
+	}
+	for name, timeout := range s.CollectorTimeouts {
+		if !knownCollector(name) && name != "chassis" {
+			return fmt.Errorf("unknown collector %s in collector_timeouts", name)
+		}
+		if timeout <= 0 {
+			return fmt.Errorf("timeout of collector %s must be positive", name)
+		}
+	}
+	for alias, t := range s.Targets {
+		if t.Address == "" {
+			return fmt.Errorf("no address given for target %s", alias)
+		}
+		if _, ok := s.Credentials[t.Credentials]; t.Credentials != "" && !ok {
+			return fmt.Errorf("unknown credentials %s for target %s", t.Credentials, alias)
+		}
+	}
+	for source, c := range map[string]string{
+		"netbox": s.Discovery.Netbox.Credentials,
+		"ironic": s.Discovery.Ironic.Credentials,
+	} {
+		if _, ok := s.Credentials[c]; c != "" && !ok {
+			return fmt.Errorf("unknown credentials %s for %s discovery", c, source)
+		}
+	}
+	return nil
+}
+
+// targetMatcher matches targets against a list of literal targets and CIDR
+// ranges.
+type targetMatcher struct {
+	hosts    map[string]bool
+	networks []*net.IPNet
+}
+
+func newTargetMatcher(targets []string) (targetMatcher, error) {
+	m := targetMatcher{hosts: make(map[string]bool)}
+	for _, t := range targets {
+		if !strings.Contains(t, "/") {
+			m.hosts[t] = true
+			continue
+		}
+		_, network, err := net.ParseCIDR(t)
+		if err != nil {
+			return m, err
+		}
+		m.networks = append(m.networks, network)
+	}
+	return m, nil
+}
+
+// empty reports whether the matcher was created from an empty list.
+func (m targetMatcher) empty() bool {
+	return len(m.hosts) == 0 && len(m.networks) == 0
+}
+
+// matches reports whether target is one of the literal targets or an IP
+// address in one of the networks. A port in target is ignored unless the
+// literal target includes it.
+func (m targetMatcher) matches(target string) bool {
+	host, _ := splitAddress(target)
+	if m.hosts[target] || m.hosts[host] {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range m.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *Credentials) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Credentials
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if err := checkOverflow(s.XXX, "credentials"); err != nil {
+		return err
+	}
+	return checkDNSResolution(s.DNSResolution)
+}
+
+// checkDNSResolution checks that policy is a valid dns_resolution, or empty.
+func checkDNSResolution(policy string) error {
+	switch policy {
+	case "", dnsResolutionPass, dnsResolutionScrape, dnsResolutionCommand:
+		return nil
+	}
+	return fmt.Errorf("invalid dns_resolution %q, must be 'pass', 'scrape' or 'command'", policy)
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *CircuitBreakerConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain CircuitBreakerConfig
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if err := checkOverflow(s.XXX, "circuit_breaker"); err != nil {
+		return err
+	}
+	if s.Threshold > 0 && s.Backoff <= 0 {
+		return fmt.Errorf("circuit_breaker needs a positive backoff")
+	}
+	return nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *CollectorSuppressionConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain CollectorSuppressionConfig
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if err := checkOverflow(s.XXX, "collector_suppression"); err != nil {
+		return err
+	}
+	if s.Threshold > 0 && s.TTL <= 0 {
+		return fmt.Errorf("collector_suppression needs a positive ttl")
+	}
+	return nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *RateLimitConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain RateLimitConfig
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if err := checkOverflow(s.XXX, "rate_limit"); err != nil {
+		return err
+	}
+	if s.Rate < 0 || s.Burst < 0 {
+		return fmt.Errorf("rate_limit must not be negative")
+	}
+	if s.Rate > 0 && s.Burst == 0 {
+		s.Burst = 1
+	}
+	return nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *SDRCacheConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain SDRCacheConfig
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if err := checkOverflow(s.XXX, "sdr_cache"); err != nil {
+		return err
+	}
+	if s.MaxAge < 0 {
+		return fmt.Errorf("sdr_cache max_age must not be negative")
+	}
+	if s.WarmUpConcurrency < 0 {
+		return fmt.Errorf("sdr_cache warm_up_concurrency must not be negative")
+	}
+	if s.WarmUpConcurrency == 0 {
+		s.WarmUpConcurrency = 4
+	}
+	return nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *SensorsConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain SensorsConfig
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if err := checkOverflow(s.XXX, "sensors"); err != nil {
+		return err
+	}
+	switch s.Aggregate {
+	case "", "both", "only":
+	default:
+		return fmt.Errorf("invalid value %q for aggregate in sensors section, must be 'both' or 'only'", s.Aggregate)
+	}
+	if s.IgnoreNotAvailable {
+		if s.NotAvailable != "" && s.NotAvailable != "drop" {
+			return fmt.Errorf("ignore_not_available conflicts with not_available %q in sensors section", s.NotAvailable)
+		}
+		s.NotAvailable = "drop"
+	}
+	switch s.NotAvailable {
+	case "":
+		s.NotAvailable = "nan"
+	case "nan", "zero", "drop":
+	default:
+		return fmt.Errorf("invalid value %q for not_available in sensors section, must be 'nan', 'zero' or 'drop'", s.NotAvailable)
+	}
+	return nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *AgentConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain AgentConfig
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if err := checkOverflow(s.XXX, "agent"); err != nil {
+		return err
+	}
+	if s.Interval < 0 {
+		return fmt.Errorf("agent interval must not be negative")
+	}
+	if s.Interval == 0 {
+		s.Interval = time.Minute
+	}
+	if s.Job == "" {
+		s.Job = "ipmi"
+	}
+	if s.Concurrency < 0 {
+		return fmt.Errorf("agent concurrency must not be negative")
+	}
+	if s.Concurrency == 0 {
+		s.Concurrency = 16
+	}
+	return nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *RemoteWriteConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain RemoteWriteConfig
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if err := checkOverflow(s.XXX, "remote_write"); err != nil {
+		return err
+	}
+	if s.Timeout == 0 {
+		s.Timeout = 30 * time.Second
+	}
+	return nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *RelabelConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	// Fields not given in the config keep these defaults, so that e.g. an
+	// empty replacement can be told apart from none.
+	*s = RelabelConfig{
+		Separator:   ";",
+		Regex:       "(.*)",
+		Replacement: "$1",
+		Action:      "replace",
+	}
+	type plain RelabelConfig
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if err := checkOverflow(s.XXX, "relabel config"); err != nil {
+		return err
+	}
+	regex, err := regexp.Compile("^(?:" + s.Regex + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid regex %q in relabel config: %s", s.Regex, err)
+	}
+	s.regex = regex
+	switch s.Action {
+	case "replace", "lowercase", "uppercase":
+		if s.TargetLabel == "" {
+			return fmt.Errorf("relabel config with action %s requires target_label", s.Action)
+		}
+	case "hashmod":
+		if s.TargetLabel == "" || s.Modulus == 0 {
+			return fmt.Errorf("relabel config with action hashmod requires target_label and modulus")
+		}
+	case "keep", "drop", "labelmap", "labeldrop", "labelkeep":
+	default:
+		return fmt.Errorf("unknown relabel action %q", s.Action)
+	}
+	return nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *InventoryConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain InventoryConfig
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if err := checkOverflow(s.XXX, "inventory"); err != nil {
+		return err
+	}
+	switch s.Format {
+	case "":
+		s.Format = "json"
+	case "json", "csv":
+	default:
+		return fmt.Errorf("invalid inventory format %q, must be 'json' or 'csv'", s.Format)
+	}
+	if s.Interval == 0 {
+		s.Interval = 5 * time.Minute
+	}
+	return nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *CapabilityProbingConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain CapabilityProbingConfig
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if err := checkOverflow(s.XXX, "capability_probing"); err != nil {
+		return err
+	}
+	if s.Interval < 0 {
+		return fmt.Errorf("capability_probing interval must not be negative")
+	}
+	if s.Interval == 0 {
+		s.Interval = 24 * time.Hour
+	}
+	return nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *SELConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain SELConfig
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	return checkOverflow(s.XXX, "sel")
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *AlertmanagerConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain AlertmanagerConfig
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if err := checkOverflow(s.XXX, "alertmanager"); err != nil {
+		return err
+	}
+	if s.Timeout == 0 {
+		s.Timeout = 10 * time.Second
+	}
+	return nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *LokiConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain LokiConfig
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if err := checkOverflow(s.XXX, "loki"); err != nil {
+		return err
+	}
+	if s.Timeout == 0 {
+		s.Timeout = 10 * time.Second
+	}
+	return nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *SyslogConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain SyslogConfig
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if err := checkOverflow(s.XXX, "syslog"); err != nil {
+		return err
+	}
+	switch {
+	case s.Destination == "", s.Destination == "local", s.Destination == "journald":
+	case strings.HasPrefix(s.Destination, "udp://"), strings.HasPrefix(s.Destination, "tcp://"):
+	default:
+		return fmt.Errorf("invalid syslog destination %q", s.Destination)
+	}
+	if s.Facility == "" {
+		s.Facility = "daemon"
+	}
+	if _, ok := syslogFacilities[s.Facility]; !ok {
+		return fmt.Errorf("unknown syslog facility %q", s.Facility)
+	}
+	if s.Tag == "" {
+		s.Tag = "ipmi_exporter"
+	}
+	return nil
+}
 
-	// Catches all undefined fields and must be empty after parsing.
-	XXX map[string]interface{} `yaml:",inline"`
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *KafkaConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain KafkaConfig
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if err := checkOverflow(s.XXX, "kafka"); err != nil {
+		return err
+	}
+	if len(s.Brokers) > 0 && s.Topic == "" {
+		return fmt.Errorf("no topic given for kafka")
+	}
+	if s.ClientID == "" {
+		s.ClientID = "ipmi_exporter"
+	}
+	if s.Timeout == 0 {
+		s.Timeout = 10 * time.Second
+	}
+	return nil
 }
 
-// SafeConfig wraps Config for concurrency-safe operations.
-type SafeConfig struct {
-	sync.RWMutex
-	C *Config
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *LeaderElectionConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain LeaderElectionConfig
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if err := checkOverflow(s.XXX, "leader_election"); err != nil {
+		return err
+	}
+	if s.LeaseDuration == 0 {
+		s.LeaseDuration = 15 * time.Second
+	}
+	if s.RetryPeriod == 0 {
+		s.RetryPeriod = 2 * time.Second
+	}
+	if s.RetryPeriod >= s.LeaseDuration*2/3 {
+		return fmt.Errorf("leader_election retry_period must be shorter than two thirds of lease_duration")
+	}
+	return nil
 }
 
-// Credentials is the Go representation of the credentials section in the yaml
-// config file.
-type Credentials struct {
-	User     string `yaml:"user"`
-	Password string `yaml:"pass"`
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *DiscoveryConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain DiscoveryConfig
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if err := checkOverflow(s.XXX, "discovery"); err != nil {
+		return err
+	}
+	if s.RefreshInterval < 0 {
+		return fmt.Errorf("discovery refresh_interval must not be negative")
+	}
+	if s.RefreshInterval == 0 {
+		s.RefreshInterval = 5 * time.Minute
+	}
+	return nil
+}
 
-	// Catches all undefined fields and must be empty after parsing.
-	XXX map[string]interface{} `yaml:",inline"`
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *NetboxConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain NetboxConfig
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	return checkOverflow(s.XXX, "netbox")
 }
 
-func checkOverflow(m map[string]interface{}, ctx string) error {
-	if len(m) > 0 {
-		var keys []string
-		for k := range m {
-			keys = append(keys, k)
-		}
-		return fmt.Errorf("unknown fields in %s: %s", ctx, strings.Join(keys, ", "))
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *IronicConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain IronicConfig
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	return checkOverflow(s.XXX, "ironic")
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *ConsulConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain ConsulConfig
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if err := checkOverflow(s.XXX, "consul"); err != nil {
+		return err
+	}
+	if s.URL != "" && (s.Service == "") == (s.KVPrefix == "") {
+		return fmt.Errorf("exactly one of service and kv_prefix must be set for consul discovery")
+	}
+	if s.CredentialsMetaKey == "" {
+		s.CredentialsMetaKey = "ipmi_credentials"
 	}
 	return nil
 }
 
 // UnmarshalYAML implements the yaml.Unmarshaler interface.
-func (s *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
-	type plain Config
+func (s *KubernetesConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain KubernetesConfig
 	if err := unmarshal((*plain)(s)); err != nil {
 		return err
 	}
-	if err := checkOverflow(s.XXX, "config"); err != nil {
+	return checkOverflow(s.XXX, "kubernetes")
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *KeystoneConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain KeystoneConfig
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if err := checkOverflow(s.XXX, "keystone"); err != nil {
 		return err
 	}
+	if s.UserDomainName == "" {
+		s.UserDomainName = "Default"
+	}
+	if s.ProjectDomainName == "" {
+		s.ProjectDomainName = "Default"
+	}
 	return nil
 }
 
 // UnmarshalYAML implements the yaml.Unmarshaler interface.
-func (s *Credentials) UnmarshalYAML(unmarshal func(interface{}) error) error {
-	type plain Credentials
+func (s *PushgatewayConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain PushgatewayConfig
 	if err := unmarshal((*plain)(s)); err != nil {
 		return err
 	}
-	if err := checkOverflow(s.XXX, "credentials"); err != nil {
+	if err := checkOverflow(s.XXX, "pushgateway"); err != nil {
+		return err
+	}
+	if s.Timeout == 0 {
+		s.Timeout = 30 * time.Second
+	}
+	return nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *RetryConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain RetryConfig
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if err := checkOverflow(s.XXX, "retry"); err != nil {
+		return err
+	}
+	if s.MaxRetries < 0 || s.InitialBackoff < 0 || s.MaxBackoff < 0 {
+		return fmt.Errorf("retry settings must not be negative")
+	}
+	if s.InitialBackoff == 0 {
+		s.InitialBackoff = 500 * time.Millisecond
+	}
+	if s.MaxBackoff < s.InitialBackoff {
+		s.MaxBackoff = 10 * s.InitialBackoff
+	}
+	return nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *ResourceLimitsConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain ResourceLimitsConfig
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if err := checkOverflow(s.XXX, "resource_limits"); err != nil {
+		return err
+	}
+	if s.Nice < -20 || s.Nice > 19 {
+		return fmt.Errorf("nice must be between -20 and 19")
+	}
+	if s.CPUTime < 0 || s.MaxRuntime < 0 || s.MaxMemoryBytes < 0 {
+		return fmt.Errorf("resource limits must not be negative")
+	}
+	return nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *AuthToken) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain AuthToken
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if err := checkOverflow(s.XXX, "auth_tokens"); err != nil {
+		return err
+	}
+	if s.Token == "" {
+		return fmt.Errorf("empty token in auth_tokens")
+	}
+	var err error
+	if s.targets, err = newTargetMatcher(s.Targets); err != nil {
+		return fmt.Errorf("invalid targets for token: %s", err)
+	}
+	return nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *Target) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Target
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if err := checkOverflow(s.XXX, "target"); err != nil {
 		return err
 	}
 	return nil
@@ -73,7 +1243,16 @@ func (s *Credentials) UnmarshalYAML(unmarshal func(interface{}) error) error {
 
 // ReloadConfig reloads the config in a concurrency-safe way. If the configFile
 // is unreadable or unparsable, an error is returned and the old config is kept.
-func (sc *SafeConfig) ReloadConfig(configFile string) error {
+func (sc *SafeConfig) ReloadConfig(configFile string) (err error) {
+	defer func() {
+		if err != nil {
+			configReloadSuccess.Set(0)
+		} else {
+			configReloadSuccess.Set(1)
+			configReloadSeconds.SetToCurrentTime()
+		}
+	}()
+
 	var c = &Config{}
 
 	yamlFile, err := ioutil.ReadFile(configFile)
@@ -95,11 +1274,106 @@ func (sc *SafeConfig) ReloadConfig(configFile string) error {
 	return nil
 }
 
-// CredentialsForTarget returns the Credentials for a given target, or the
-// default. It is concurrency-safe.
-func (sc *SafeConfig) CredentialsForTarget(target string) (Credentials, error) {
+// Snapshot returns a copy of sc that is not affected by later config reloads
+// or discovered targets, so that a scrape sees a consistent configuration
+// from start to end. The Config itself is shared, as it is never modified
+// after loading.
+func (sc *SafeConfig) Snapshot() *SafeConfig {
+	sc.RLock()
+	defer sc.RUnlock()
+	discovered := make(map[string]map[string]Target, len(sc.discovered))
+	for source, targets := range sc.discovered {
+		discovered[source] = targets
+	}
+	return &SafeConfig{C: sc.C, discovered: discovered}
+}
+
+// lookupAlias returns the target alias with the given name, either from the
+// config or from discovery. Aliases from the config take precedence. The
+// caller must hold the lock.
+func (sc *SafeConfig) lookupAlias(name string) (Target, bool) {
+	if t, ok := sc.C.Targets[name]; ok {
+		return t, true
+	}
+	for _, targets := range sc.discovered {
+		if t, ok := targets[name]; ok {
+			return t, true
+		}
+	}
+	return Target{}, false
+}
+
+// SetDiscoveredTargets replaces the targets discovered by the named discovery
+// source. It is concurrency-safe.
+func (sc *SafeConfig) SetDiscoveredTargets(source string, targets map[string]Target) {
 	sc.Lock()
 	defer sc.Unlock()
+	if sc.discovered == nil {
+		sc.discovered = make(map[string]map[string]Target)
+	}
+	sc.discovered[source] = targets
+}
+
+// CredentialsLabels returns the labels derived from the name of the
+// credentials used for target, as returned by LookupTarget, according to
+// credentials_labels. It is concurrency-safe.
+func (sc *SafeConfig) CredentialsLabels(target string) map[string]string {
+	sc.RLock()
+	defer sc.RUnlock()
+	re := sc.C.credentialsLabels
+	if re == nil {
+		return nil
+	}
+	if t, ok := sc.lookupAlias(target); ok && t.discoveredCredentials != nil {
+		// Not named, see CredentialsForTarget.
+		return nil
+	}
+	name := target
+	if _, ok := sc.C.Credentials[name]; !ok {
+		name = "default"
+	}
+	match := re.FindStringSubmatch(name)
+	if match == nil {
+		return nil
+	}
+	labels := make(map[string]string)
+	for i, group := range re.SubexpNames() {
+		if group != "" && match[i] != "" {
+			labels[group] = match[i]
+		}
+	}
+	return labels
+}
+
+// LookupTarget resolves a target alias. It returns the address to scrape and
+// the name to look up credentials for. Targets that are not an alias are
+// returned unchanged. It is concurrency-safe.
+func (sc *SafeConfig) LookupTarget(target string) (string, string) {
+	sc.RLock()
+	defer sc.RUnlock()
+	t, ok := sc.lookupAlias(target)
+	if !ok {
+		return target, target
+	}
+	if t.discoveredCredentials != nil {
+		// See CredentialsForTarget.
+		return t.Address, target
+	}
+	if t.Credentials == "" {
+		return t.Address, t.Address
+	}
+	return t.Address, t.Credentials
+}
+
+// CredentialsForTarget returns the Credentials for a given target, or the
+// default. Discovered targets with their own credentials are looked up by
+// their name. It is concurrency-safe.
+func (sc *SafeConfig) CredentialsForTarget(target string) (Credentials, error) {
+	sc.RLock()
+	defer sc.RUnlock()
+	if t, ok := sc.lookupAlias(target); ok && t.discoveredCredentials != nil {
+		return *t.discoveredCredentials, nil
+	}
 	if credentials, ok := sc.C.Credentials[target]; ok {
 		return Credentials{
 			User:     credentials.User,
@@ -118,7 +1392,301 @@ func (sc *SafeConfig) CredentialsForTarget(target string) (Credentials, error) {
 // ExcludeSensorIDs returns the list of excluded sensor IDs in a
 // concurrency-safe way.
 func (sc *SafeConfig) ExcludeSensorIDs() []int64 {
-	sc.Lock()
-	defer sc.Unlock()
+	sc.RLock()
+	defer sc.RUnlock()
 	return sc.C.ExcludeSensorIDs
 }
+
+// TargetAllowed reports whether the given target may be scraped. Target
+// aliases are always allowed. It is concurrency-safe.
+func (sc *SafeConfig) TargetAllowed(target string) bool {
+	sc.RLock()
+	defer sc.RUnlock()
+	return sc.targetAllowed(target)
+}
+
+// targetAllowed is TargetAllowed for callers holding the lock.
+func (sc *SafeConfig) targetAllowed(target string) bool {
+	if _, ok := sc.lookupAlias(target); ok {
+		return true
+	}
+	return sc.C.allowedTargets.empty() || sc.C.allowedTargets.matches(target)
+}
+
+// MaxConcurrentCommands returns the number of FreeIPMI commands that may run
+// concurrently against a single target in a concurrency-safe way. Zero means
+// no limit.
+func (sc *SafeConfig) MaxConcurrentCommands() int {
+	sc.RLock()
+	defer sc.RUnlock()
+	return sc.C.MaxConcurrentCommands
+}
+
+// CacheTTL returns the time for which scrape results are cached in a
+// concurrency-safe way.
+func (sc *SafeConfig) CacheTTL() time.Duration {
+	sc.RLock()
+	defer sc.RUnlock()
+	return sc.C.CacheTTL
+}
+
+// StaleDataMaxAge returns the maximum age of stale data served for failed
+// scrapes in a concurrency-safe way.
+func (sc *SafeConfig) StaleDataMaxAge() time.Duration {
+	sc.RLock()
+	defer sc.RUnlock()
+	return sc.C.StaleDataMaxAge
+}
+
+// CollectorSuppression returns the collector suppression configuration in a
+// concurrency-safe way.
+func (sc *SafeConfig) CollectorSuppression() CollectorSuppressionConfig {
+	sc.RLock()
+	defer sc.RUnlock()
+	return sc.C.CollectorSuppression
+}
+
+// CircuitBreaker returns the circuit breaker configuration in a
+// concurrency-safe way.
+func (sc *SafeConfig) CircuitBreaker() CircuitBreakerConfig {
+	sc.RLock()
+	defer sc.RUnlock()
+	return sc.C.CircuitBreaker
+}
+
+// KnownTarget is a target known to the exporter, as listed for service
+// discovery.
+type KnownTarget struct {
+	Name   string
+	Labels map[string]string
+}
+
+// KnownTargets returns all targets known from the config: target aliases and
+// targets explicitly listed in allowed_targets, as well as all discovered
+// targets. Names of credentials are not targets, as they may just be referred
+// to by aliases. It is concurrency-safe.
+func (sc *SafeConfig) KnownTargets() []KnownTarget {
+	sc.RLock()
+	defer sc.RUnlock()
+	known := make(map[string]KnownTarget)
+	for name := range sc.C.allowedTargets.hosts {
+		known[name] = KnownTarget{Name: name}
+	}
+	for _, targets := range sc.discovered {
+		for name, t := range targets {
+			delete(known, t.Address)
+			known[name] = KnownTarget{Name: name, Labels: t.Labels}
+		}
+	}
+	for name, t := range sc.C.Targets {
+		// Do not list the address of an alias separately.
+		delete(known, t.Address)
+		known[name] = KnownTarget{Name: name, Labels: t.Labels}
+	}
+	var result []KnownTarget
+	for _, t := range known {
+		if sc.targetAllowed(t.Name) {
+			result = append(result, t)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// AuthRequired reports whether requests need to carry one of the configured
+// tokens. It is concurrency-safe.
+func (sc *SafeConfig) AuthRequired() bool {
+	sc.RLock()
+	defer sc.RUnlock()
+	return len(sc.C.AuthTokens) > 0
+}
+
+// TokenAllows reports whether token is a configured token, and if so,
+// whether it may be used to scrape target. Target aliases are allowed if
+// either the alias or its address is allowed. It is concurrency-safe.
+func (sc *SafeConfig) TokenAllows(token, target string) (bool, bool) {
+	sc.RLock()
+	defer sc.RUnlock()
+	for _, t := range sc.C.AuthTokens {
+		if subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) != 1 {
+			continue
+		}
+		if t.targets.empty() || t.targets.matches(target) {
+			return true, true
+		}
+		if alias, ok := sc.lookupAlias(target); ok && t.targets.matches(alias.Address) {
+			return true, true
+		}
+		return true, false
+	}
+	return false, false
+}
+
+// RateLimit returns the rate limit configuration in a concurrency-safe way.
+func (sc *SafeConfig) RateLimit() RateLimitConfig {
+	sc.RLock()
+	defer sc.RUnlock()
+	return sc.C.RateLimit
+}
+
+// SDRCache returns the SDR cache configuration in a concurrency-safe way.
+func (sc *SafeConfig) SDRCache() SDRCacheConfig {
+	sc.RLock()
+	defer sc.RUnlock()
+	return sc.C.SDRCache
+}
+
+// Retry returns the retry configuration in a concurrency-safe way.
+func (sc *SafeConfig) Retry() RetryConfig {
+	sc.RLock()
+	defer sc.RUnlock()
+	return sc.C.Retry
+}
+
+// CommandWrapper returns the command line to prefix invocations of the given
+// FreeIPMI command with, or the default. It is concurrency-safe.
+func (sc *SafeConfig) CommandWrapper(cmd string) []string {
+	sc.RLock()
+	defer sc.RUnlock()
+	wrapper, ok := sc.C.CommandWrappers[cmd]
+	if !ok {
+		wrapper = sc.C.CommandWrappers["default"]
+	}
+	return append([]string(nil), wrapper...)
+}
+
+// defaultSensorStates are the values exported for sensor states not
+// configured in sensor_states.
+var defaultSensorStates = map[string]float64{
+	"Nominal":  0,
+	"Warning":  1,
+	"Critical": 2,
+	"N/A":      math.NaN(),
+}
+
+// SensorState returns the value to export for a sensor of the given type in
+// the given state in a concurrency-safe way, and whether the state is known.
+func (sc *SafeConfig) SensorState(sensorType, state string) (float64, bool) {
+	sc.RLock()
+	defer sc.RUnlock()
+	if value, ok := sc.C.SensorStates[sensorType][state]; ok {
+		return value, true
+	}
+	if value, ok := sc.C.SensorStates["default"][state]; ok {
+		return value, true
+	}
+	value, ok := defaultSensorStates[state]
+	return value, ok
+}
+
+// SkipWhenPoweredOff returns whether sensor collectors are skipped for
+// powered off systems in a concurrency-safe way.
+func (sc *SafeConfig) SkipWhenPoweredOff() bool {
+	sc.RLock()
+	defer sc.RUnlock()
+	return sc.C.SkipWhenPoweredOff
+}
+
+// Discovery returns the target discovery configuration in a
+// concurrency-safe way.
+func (sc *SafeConfig) Discovery() DiscoveryConfig {
+	sc.RLock()
+	defer sc.RUnlock()
+	return sc.C.Discovery
+}
+
+// Agent returns the agent configuration in a concurrency-safe way.
+func (sc *SafeConfig) Agent() AgentConfig {
+	sc.RLock()
+	defer sc.RUnlock()
+	return sc.C.Agent
+}
+
+// SEL returns the SEL configuration in a concurrency-safe way.
+func (sc *SafeConfig) SEL() SELConfig {
+	sc.RLock()
+	defer sc.RUnlock()
+	return sc.C.SEL
+}
+
+// CollectorTimeout returns the timeout configured for the named collector,
+// or zero if there is none, in a concurrency-safe way.
+func (sc *SafeConfig) CollectorTimeout(name string) time.Duration {
+	sc.RLock()
+	defer sc.RUnlock()
+	return sc.C.CollectorTimeouts[name]
+}
+
+// CapabilityProbing returns the capability probing configuration in a
+// concurrency-safe way.
+func (sc *SafeConfig) CapabilityProbing() CapabilityProbingConfig {
+	sc.RLock()
+	defer sc.RUnlock()
+	return sc.C.CapabilityProbing
+}
+
+// Inventory returns the inventory configuration in a concurrency-safe way.
+func (sc *SafeConfig) Inventory() InventoryConfig {
+	sc.RLock()
+	defer sc.RUnlock()
+	return sc.C.Inventory
+}
+
+// LANChannel returns the LAN channel whose configuration is collected in a
+// concurrency-safe way.
+func (sc *SafeConfig) LANChannel() uint8 {
+	sc.RLock()
+	defer sc.RUnlock()
+	return sc.C.LANChannel
+}
+
+// DNSResolution returns the DNS resolution policy for targets using the
+// named credentials, as returned by LookupTarget, falling back to the global
+// policy. It is concurrency-safe.
+func (sc *SafeConfig) DNSResolution(credentials string) string {
+	sc.RLock()
+	defer sc.RUnlock()
+	if t, ok := sc.lookupAlias(credentials); !ok || t.discoveredCredentials == nil {
+		// Discovered credentials have no policy of their own.
+		c, ok := sc.C.Credentials[credentials]
+		if !ok {
+			c = sc.C.Credentials["default"]
+		}
+		if c.DNSResolution != "" {
+			return c.DNSResolution
+		}
+	}
+	if sc.C.DNSResolution == "" {
+		return dnsResolutionPass
+	}
+	return sc.C.DNSResolution
+}
+
+// Chroot returns the directory to run the FreeIPMI commands in as their root
+// directory in a concurrency-safe way.
+func (sc *SafeConfig) Chroot() string {
+	sc.RLock()
+	defer sc.RUnlock()
+	return sc.C.Chroot
+}
+
+// enabled reports whether any limit that is applied before running a command
+// is set.
+func (c ResourceLimitsConfig) enabled() bool {
+	return c.Nice != 0 || c.CPUTime > 0 || c.MaxMemoryBytes > 0
+}
+
+// ResourceLimits returns the resource limits for FreeIPMI commands in a
+// concurrency-safe way.
+func (sc *SafeConfig) ResourceLimits() ResourceLimitsConfig {
+	sc.RLock()
+	defer sc.RUnlock()
+	return sc.C.ResourceLimits
+}
+
+// Sensors returns the sensors configuration in a concurrency-safe way.
+func (sc *SafeConfig) Sensors() SensorsConfig {
+	sc.RLock()
+	defer sc.RUnlock()
+	return sc.C.Sensors
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+func loadTestConfig(t *testing.T, text string) *SafeConfig {
+	t.Helper()
+	c := &Config{}
+	if err := yaml.Unmarshal([]byte(text), c); err != nil {
+		t.Fatalf("error parsing config: %s", err)
+	}
+	return &SafeConfig{C: c}
+}
+
+func TestKnownTargets(t *testing.T) {
+	sc := loadTestConfig(t, `
+credentials:
+  default:
+    user: admin
+    pass: secret
+  baremetal/ironic:
+    user: ironic
+    pass: secret
+  10.0.0.5:
+    user: other
+    pass: secret
+targets:
+  node1:
+    address: 10.0.0.1
+    credentials: baremetal/ironic
+allowed_targets:
+  - 10.0.0.1
+  - 10.0.0.2
+  - 10.1.0.0/16
+`)
+	sc.SetDiscoveredTargets("netbox", map[string]Target{"node2": {Address: "10.1.0.2"}})
+
+	var names []string
+	for _, t := range sc.KnownTargets() {
+		names = append(names, t.Name)
+	}
+	expected := []string{"10.0.0.2", "node1", "node2"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected known targets %v, got %v", expected, names)
+	}
+}
+
+func TestCredentialsSpecialCharacters(t *testing.T) {
+	sc := loadTestConfig(t, "credentials:\n  default:\n    user: admin\n    pass: \"sec\\\"ret\\\\\"\n")
+	creds, err := sc.CredentialsForTarget("10.0.0.1")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if creds.Password != `sec"ret\` {
+		t.Errorf("expected the password to be loaded unchanged, got %q", creds.Password)
+	}
+}
+
+func TestIgnoreNotAvailable(t *testing.T) {
+	sc := loadTestConfig(t, "sensors:\n  ignore_not_available: true\n")
+	if got := sc.Sensors().NotAvailable; got != "drop" {
+		t.Errorf("expected not_available drop, got %q", got)
+	}
+
+	c := &Config{}
+	err := yaml.Unmarshal([]byte("sensors:\n  ignore_not_available: true\n  not_available: zero\n"), c)
+	if err == nil {
+		t.Error("expected ignore_not_available with not_available zero to be rejected")
+	}
+}
+
+func TestDNSResolutionPerCredentials(t *testing.T) {
+	sc := loadTestConfig(t, `
+dns_resolution: scrape
+credentials:
+  default:
+    user: admin
+    pass: secret
+  legacy:
+    user: admin
+    pass: secret
+    dns_resolution: command
+targets:
+  node1:
+    address: bmc1.example.com
+    credentials: legacy
+`)
+	tests := map[string]string{
+		"10.0.0.1": dnsResolutionScrape,
+		"legacy":   dnsResolutionCommand,
+	}
+	if _, credentials := sc.LookupTarget("node1"); credentials != "legacy" {
+		t.Fatalf("expected node1 to use the legacy credentials, got %q", credentials)
+	}
+	for credentials, expected := range tests {
+		if policy := sc.DNSResolution(credentials); policy != expected {
+			t.Errorf("%s: expected %s, got %s", credentials, expected, policy)
+		}
+	}
+
+	if policy := loadTestConfig(t, "").DNSResolution("default"); policy != dnsResolutionPass {
+		t.Errorf("expected %s by default, got %s", dnsResolutionPass, policy)
+	}
+	c := &Config{}
+	if err := yaml.Unmarshal([]byte("credentials:\n  default:\n    dns_resolution: never\n"), c); err == nil {
+		t.Error("expected an invalid dns_resolution in credentials to be rejected")
+	}
+}
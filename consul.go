@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// consulDiscoverer discovers targets from Consul, using blocking queries to
+// be notified of changes, see https://developer.hashicorp.com/consul/api-docs.
+type consulDiscoverer struct {
+	config ConsulConfig
+	// index is the X-Consul-Index of the last response.
+	index uint64
+}
+
+type consulServiceInstance struct {
+	Node           string            `json:"Node"`
+	Address        string            `json:"Address"`
+	Datacenter     string            `json:"Datacenter"`
+	ServiceID      string            `json:"ServiceID"`
+	ServiceAddress string            `json:"ServiceAddress"`
+	ServiceMeta    map[string]string `json:"ServiceMeta"`
+}
+
+type consulKVPair struct {
+	Key   string `json:"Key"`
+	Value []byte `json:"Value"` // base64 encoded in JSON
+}
+
+// consulKVTarget is the JSON format of a target stored in the KV store.
+type consulKVTarget struct {
+	Address     string            `json:"address"`
+	Credentials string            `json:"credentials"`
+	Labels      map[string]string `json:"labels"`
+}
+
+// watches reports whether the next query blocks, which requires the index of
+// a previous response.
+func (d *consulDiscoverer) watches() bool {
+	return d.index > 0
+}
+
+func (d *consulDiscoverer) discover(ctx context.Context) (map[string]Target, error) {
+	if d.config.Service != "" {
+		return d.discoverService(ctx)
+	}
+	return d.discoverKV(ctx)
+}
+
+// discoverService turns the instances of the configured service into
+// targets named after their node.
+func (d *consulDiscoverer) discoverService(ctx context.Context) (map[string]Target, error) {
+	query := url.Values{}
+	if d.config.Tag != "" {
+		query.Set("tag", d.config.Tag)
+	}
+	var instances []consulServiceInstance
+	if err := d.get(ctx, "/v1/catalog/service/"+url.PathEscape(d.config.Service), query, &instances); err != nil {
+		return nil, err
+	}
+	targets := make(map[string]Target)
+	for _, i := range instances {
+		address := i.ServiceAddress
+		if address == "" {
+			address = i.Address
+		}
+		targets[i.Node] = Target{
+			Address:     address,
+			Credentials: i.ServiceMeta[d.config.CredentialsMetaKey],
+			Labels: map[string]string{
+				"consul_node":       i.Node,
+				"consul_datacenter": i.Datacenter,
+			},
+		}
+	}
+	return targets, nil
+}
+
+// discoverKV turns each key below the configured prefix into a target named
+// after the rest of the key. The values are JSON objects with the address,
+// the optional name of the credentials and optional labels.
+func (d *consulDiscoverer) discoverKV(ctx context.Context) (map[string]Target, error) {
+	query := url.Values{}
+	query.Set("recurse", "true")
+	var pairs []consulKVPair
+	if err := d.get(ctx, "/v1/kv/"+strings.TrimPrefix(d.config.KVPrefix, "/"), query, &pairs); err != nil {
+		return nil, err
+	}
+	targets := make(map[string]Target)
+	for _, p := range pairs {
+		name := strings.Trim(strings.TrimPrefix(p.Key, strings.TrimPrefix(d.config.KVPrefix, "/")), "/")
+		if name == "" || len(p.Value) == 0 {
+			continue
+		}
+		var t consulKVTarget
+		if err := json.Unmarshal(p.Value, &t); err != nil {
+			return nil, fmt.Errorf("invalid target in key %s: %s", p.Key, err)
+		}
+		if t.Address == "" {
+			return nil, fmt.Errorf("no address given in key %s", p.Key)
+		}
+		targets[name] = Target{Address: t.Address, Credentials: t.Credentials, Labels: t.Labels}
+	}
+	return targets, nil
+}
+
+// get runs a blocking query against the Consul API. It returns as soon as the
+// result changed since the last query, or shortly before ctx expires.
+func (d *consulDiscoverer) get(ctx context.Context, path string, query url.Values, v interface{}) error {
+	if d.config.Datacenter != "" {
+		query.Set("dc", d.config.Datacenter)
+	}
+	if deadline, ok := ctx.Deadline(); ok && d.index > 0 {
+		query.Set("index", strconv.FormatUint(d.index, 10))
+		query.Set("wait", fmt.Sprintf("%ds", int(time.Until(deadline).Seconds()*0.9)))
+	}
+	u := strings.TrimSuffix(d.config.URL, "/") + path + "?" + query.Encode()
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if d.config.Token != "" {
+		req.Header.Set("X-Consul-Token", d.config.Token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound && strings.HasPrefix(path, "/v1/kv/") {
+		// No keys below the prefix yet.
+		d.updateIndex(resp)
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s from %s", resp.Status, u)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return err
+	}
+	d.updateIndex(resp)
+	return nil
+}
+
+func (d *consulDiscoverer) updateIndex(resp *http.Response) {
+	index, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil || index < d.index {
+		// The index went backwards, e.g. after a restore, so start over.
+		index = 0
+	}
+	d.index = index
+}
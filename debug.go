@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// commandRecord holds the details of a single FreeIPMI invocation.
+type commandRecord struct {
+	start    time.Time
+	duration time.Duration
+	command  string
+	status   string
+	stdout   string
+	stderr   string
+}
+
+// scrapeRecord holds the FreeIPMI invocations of a single scrape.
+type scrapeRecord struct {
+	mtx      sync.Mutex
+	start    time.Time
+	commands []commandRecord
+}
+
+type scrapeRecordKey struct{}
+
+// withScrapeRecord returns a context recording the FreeIPMI invocations run
+// with it in sr.
+func withScrapeRecord(ctx context.Context, sr *scrapeRecord) context.Context {
+	return context.WithValue(ctx, scrapeRecordKey{}, sr)
+}
+
+// recordCommand adds a FreeIPMI invocation to the scrape record of ctx, if
+// any, and dumps it if a dump directory is configured. The password is
+// redacted from the command line and the outputs.
+func recordCommand(ctx context.Context, start time.Time, host, password string, cmd string, args []string, err error, result commandResult) {
+	status := "exit status 0"
+	if err != nil {
+		status = err.Error()
+	}
+	cr := commandRecord{
+		start:    start,
+		duration: time.Since(start),
+		command:  redact(strings.Join(append([]string{cmd}, args...), " "), password),
+		status:   status,
+		stdout:   redact(string(result.stdout), password),
+		stderr:   redact(string(result.stderr), password),
+	}
+	if *dumpDir != "" {
+		dumps.write(*dumpDir, *dumpMaxFiles, host, cmd, cr)
+	}
+
+	sr, ok := ctx.Value(scrapeRecordKey{}).(*scrapeRecord)
+	if !ok {
+		return
+	}
+	sr.mtx.Lock()
+	sr.commands = append(sr.commands, cr)
+	sr.mtx.Unlock()
+}
+
+// writeCommandRecord writes cr to w in a human readable format.
+func writeCommandRecord(w io.Writer, cr commandRecord) {
+	fmt.Fprintf(w, "$ %s\n", cr.command)
+	fmt.Fprintf(w, "# started %s, took %s, %s\n", cr.start.Format(time.RFC3339), cr.duration, cr.status)
+	fmt.Fprintln(w, cr.stdout)
+	if cr.stderr != "" {
+		fmt.Fprintf(w, "# stderr:\n%s\n", cr.stderr)
+	}
+}
+
+// dumpDirectory writes command records to files in a directory, keeping at
+// most a given number of files.
+type dumpDirectory struct {
+	mtx sync.Mutex
+}
+
+var dumps dumpDirectory
+
+// dumpPrefix starts the names of all dump files. Only files with this prefix
+// are removed when rotating, so that other files in the directory are safe.
+const dumpPrefix = "ipmi-dump-"
+
+// write writes cr to a new file in dir named after the time, host and
+// command, then removes the oldest dump files beyond maxFiles.
+func (d *dumpDirectory) write(dir string, maxFiles int, host, cmd string, cr commandRecord) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	name := fmt.Sprintf("%s%s-%s-%s.txt", dumpPrefix, cr.start.UTC().Format("20060102T150405.000000000Z"), host, cmd)
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == ':' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, name)
+	var buf bytes.Buffer
+	writeCommandRecord(&buf, cr)
+	if err := ioutil.WriteFile(filepath.Join(dir, name), buf.Bytes(), 0600); err != nil {
+		log.Errorf("Error dumping output of %s: %s", cmd, err)
+		return
+	}
+
+	if maxFiles <= 0 {
+		return
+	}
+	files, err := filepath.Glob(filepath.Join(dir, dumpPrefix+"*.txt"))
+	if err != nil {
+		log.Errorf("Error listing dump directory: %s", err)
+		return
+	}
+	// The names start with the time after the prefix, so sorting them sorts
+	// by age.
+	sort.Strings(files)
+	for len(files) > maxFiles {
+		if err := os.Remove(files[0]); err != nil {
+			log.Errorf("Error removing old dump: %s", err)
+		}
+		files = files[1:]
+	}
+}
+
+func redact(s, secret string) string {
+	if secret == "" {
+		return s
+	}
+	return strings.Replace(s, secret, "<redacted>", -1)
+}
+
+// lastScrapes holds the record of the most recent scrape per target address.
+var lastScrapes = struct {
+	sync.Mutex
+	records map[string]*scrapeRecord
+}{records: make(map[string]*scrapeRecord)}
+
+func storeLastScrape(target string, sr *scrapeRecord) {
+	lastScrapes.Lock()
+	lastScrapes.records[target] = sr
+	lastScrapes.Unlock()
+}
+
+// debugLastScrapeHandler serves /debug/last-scrape, showing the FreeIPMI
+// invocations of the most recent scrape of a target.
+func debugLastScrapeHandler(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		http.Error(w, "'target' parameter must be specified", 400)
+		return
+	}
+	if !authorize(w, r, target) {
+		return
+	}
+	address, _ := sc.LookupTarget(target)
+	lastScrapes.Lock()
+	sr, ok := lastScrapes.records[address]
+	lastScrapes.Unlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("no scrape of target '%s' recorded", target), http.StatusNotFound)
+		return
+	}
+
+	sr.mtx.Lock()
+	defer sr.mtx.Unlock()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "Scrape of %s (%s) started at %s\n", target, address, sr.start.Format(time.RFC3339))
+	for _, cr := range sr.commands {
+		fmt.Fprintln(w)
+		writeCommandRecord(w, cr)
+	}
+}
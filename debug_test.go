@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestDumpRotationKeepsOtherFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipmi-dumps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("keep me"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2026, 10, 17, 3, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		cr := commandRecord{start: start.Add(time.Duration(i) * time.Second), command: "bmc-info"}
+		dumps.write(dir, 2, "10.0.0.1", "bmc-info", cr)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, filepath.Base(f))
+	}
+	sort.Strings(names)
+	expected := []string{
+		"ipmi-dump-20261017T030001.000000000Z-10.0.0.1-bmc-info.txt",
+		"ipmi-dump-20261017T030002.000000000Z-10.0.0.1-bmc-info.txt",
+		"notes.txt",
+	}
+	if len(names) != len(expected) {
+		t.Fatalf("expected files %v, got %v", expected, names)
+	}
+	for i := range expected {
+		if names[i] != expected[i] {
+			t.Errorf("expected files %v, got %v", expected, names)
+			break
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+var (
+	discoveredTargets = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace + "_exporter",
+			Name:      "discovered_targets",
+			Help:      "Number of targets discovered by the last successful refresh, by discovery source.",
+		},
+		[]string{"source"},
+	)
+	discoveryFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace + "_exporter",
+			Name:      "discovery_failures_total",
+			Help:      "Number of failed target discovery refreshes, by discovery source.",
+		},
+		[]string{"source"},
+	)
+)
+
+// discoverer is a source of target aliases.
+type discoverer interface {
+	// discover returns the current targets of the source, by target name.
+	discover(ctx context.Context) (map[string]Target, error)
+}
+
+// watcher is implemented by discoverers whose discover method blocks until
+// the targets change or a timeout passes. They are called again right away
+// instead of after the refresh interval.
+type watcher interface {
+	watches() bool
+}
+
+// discoverers returns the configured discovery sources by name.
+func discoverers(cfg DiscoveryConfig) map[string]discoverer {
+	result := make(map[string]discoverer)
+	if cfg.Netbox.URL != "" {
+		result["netbox"] = netboxDiscoverer{cfg.Netbox}
+	}
+	if cfg.Ironic.URL != "" {
+		result["ironic"] = ironicDiscoverer{cfg.Ironic}
+	}
+	if cfg.Consul.URL != "" {
+		result["consul"] = &consulDiscoverer{config: cfg.Consul}
+	}
+	if len(cfg.DNSSRV) > 0 {
+		result["dns_srv"] = dnsSRVDiscoverer{names: cfg.DNSSRV}
+	}
+	if cfg.Kubernetes.LabelSelector != "" {
+		result["kubernetes"] = &kubernetesDiscoverer{config: cfg.Kubernetes}
+	}
+	return result
+}
+
+// runDiscovery runs all configured discovery sources. It never returns. When
+// the discovery configuration changes, all sources are restarted. Sources
+// that fail keep their previously discovered targets, sources removed from
+// the config lose them.
+func runDiscovery(config *SafeConfig) {
+	var (
+		current DiscoveryConfig
+		cancel  = func() {}
+		running = make(map[string]bool)
+	)
+	for {
+		cfg := config.Discovery()
+		if !reflect.DeepEqual(cfg, current) {
+			cancel()
+			var ctx context.Context
+			ctx, cancel = context.WithCancel(context.Background())
+			sources := discoverers(cfg)
+			for name := range running {
+				if _, ok := sources[name]; !ok {
+					config.SetDiscoveredTargets(name, nil)
+					discoveredTargets.DeleteLabelValues(name)
+					delete(running, name)
+				}
+			}
+			for name, d := range sources {
+				go runDiscoverer(ctx, config, name, d, cfg.RefreshInterval)
+				running[name] = true
+			}
+			current = cfg
+		}
+		// Check again for config changes.
+		time.Sleep(10 * time.Second)
+	}
+}
+
+// runDiscoverer refreshes the targets of a single discovery source until ctx
+// is cancelled.
+func runDiscoverer(ctx context.Context, config *SafeConfig, name string, d discoverer, interval time.Duration) {
+	for {
+		reqCtx, cancel := context.WithTimeout(ctx, interval)
+		targets, err := d.discover(reqCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Errorf("Error discovering targets from %s: %s", name, err)
+			discoveryFailures.WithLabelValues(name).Inc()
+		} else {
+			log.Debugf("Discovered %d targets from %s", len(targets), name)
+			config.SetDiscoveredTargets(name, targets)
+			discoveredTargets.WithLabelValues(name).Set(float64(len(targets)))
+			if w, ok := d.(watcher); ok && w.watches() {
+				continue
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestConsulDiscoverService(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/catalog/service/ipmi" || r.URL.Query().Get("tag") != "bmc" || r.Header.Get("X-Consul-Token") != "secret" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("X-Consul-Index", "42")
+		w.Write([]byte(`[
+			{"Node": "node1", "Address": "10.0.0.1", "Datacenter": "dc1", "ServiceMeta": {"ipmi_credentials": "rack1"}},
+			{"Node": "node2", "Address": "10.0.0.2", "Datacenter": "dc1", "ServiceAddress": "10.1.0.2"}
+		]`))
+	}))
+	defer srv.Close()
+
+	d := &consulDiscoverer{config: ConsulConfig{URL: srv.URL, Token: "secret", Service: "ipmi", Tag: "bmc", CredentialsMetaKey: "ipmi_credentials"}}
+	targets, err := d.discover(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := map[string]Target{
+		"node1": {Address: "10.0.0.1", Credentials: "rack1", Labels: map[string]string{"consul_node": "node1", "consul_datacenter": "dc1"}},
+		"node2": {Address: "10.1.0.2", Labels: map[string]string{"consul_node": "node2", "consul_datacenter": "dc1"}},
+	}
+	if !reflect.DeepEqual(targets, expected) {
+		t.Errorf("expected %v, got %v", expected, targets)
+	}
+	if d.index != 42 || !d.watches() {
+		t.Errorf("expected to watch from index 42, got %d", d.index)
+	}
+}
+
+func TestConsulDiscoverKV(t *testing.T) {
+	var (
+		index  = "10"
+		status = http.StatusOK
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/kv/ipmi/" || r.URL.Query().Get("recurse") != "true" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("X-Consul-Index", index)
+		w.WriteHeader(status)
+		if status == http.StatusOK {
+			json.NewEncoder(w).Encode([]consulKVPair{
+				{Key: "ipmi/"},
+				{Key: "ipmi/node1", Value: []byte(`{"address": "10.0.0.1", "credentials": "rack1", "labels": {"rack": "r1"}}`)},
+			})
+		}
+	}))
+	defer srv.Close()
+
+	d := &consulDiscoverer{config: ConsulConfig{URL: srv.URL, KVPrefix: "/ipmi/"}}
+	targets, err := d.discover(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := map[string]Target{
+		"node1": {Address: "10.0.0.1", Credentials: "rack1", Labels: map[string]string{"rack": "r1"}},
+	}
+	if !reflect.DeepEqual(targets, expected) {
+		t.Errorf("expected %v, got %v", expected, targets)
+	}
+	if d.index != 10 {
+		t.Errorf("expected index 10, got %d", d.index)
+	}
+
+	// An index going backwards makes the next query start over.
+	index = "5"
+	if _, err := d.discover(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if d.watches() {
+		t.Errorf("expected not to watch after the index went backwards, got index %d", d.index)
+	}
+
+	// No keys below the prefix is not an error.
+	index, status = "11", http.StatusNotFound
+	targets, err = d.discover(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(targets) != 0 {
+		t.Errorf("expected no targets, got %v", targets)
+	}
+}
+
+func TestConsulDiscoverKVInvalid(t *testing.T) {
+	tests := map[string]string{
+		"invalid JSON": `not json`,
+		"no address":   `{"credentials": "rack1"}`,
+	}
+	for name, value := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode([]consulKVPair{{Key: "ipmi/node1", Value: []byte(value)}})
+		}))
+		d := &consulDiscoverer{config: ConsulConfig{URL: srv.URL, KVPrefix: "ipmi"}}
+		if _, err := d.discover(context.Background()); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+		srv.Close()
+	}
+}
+
+func TestNetboxDiscover(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/dcim/devices/" || r.Header.Get("Authorization") != "Token secret" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		q := r.URL.Query()
+		if q.Get("site") != "dc1" || q.Get("has_oob_ip") != "true" {
+			http.Error(w, "unexpected query", http.StatusBadRequest)
+			return
+		}
+		if q.Get("offset") == "" {
+			w.Write([]byte(`{"next": "` + srv.URL + `/api/dcim/devices/?site=dc1&has_oob_ip=true&offset=2", "results": [
+				{"name": "node1", "oob_ip": {"address": "10.0.0.1/24"}, "site": {"slug": "dc1"}, "rack": {"name": "r1"}, "role": {"slug": "compute"}},
+				{"name": "node2"}
+			]}`))
+			return
+		}
+		w.Write([]byte(`{"next": null, "results": [
+			{"name": "node3", "oob_ip": {"address": "2001:db8::3/64"}, "site": {"slug": "dc1"}, "device_role": {"slug": "storage"}}
+		]}`))
+	}))
+	defer srv.Close()
+
+	d := netboxDiscoverer{config: NetboxConfig{URL: srv.URL + "/", Token: "secret", Filters: map[string]string{"site": "dc1"}, Credentials: "netbox"}}
+	targets, err := d.discover(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := map[string]Target{
+		"node1": {Address: "10.0.0.1", Credentials: "netbox", Labels: map[string]string{"netbox_site": "dc1", "netbox_rack": "r1", "netbox_role": "compute"}},
+		"node3": {Address: "2001:db8::3", Credentials: "netbox", Labels: map[string]string{"netbox_site": "dc1", "netbox_role": "storage"}},
+	}
+	if !reflect.DeepEqual(targets, expected) {
+		t.Errorf("expected %v, got %v", expected, targets)
+	}
+}
+
+func TestIronicDiscover(t *testing.T) {
+	keystone := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/v3/auth/tokens" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("X-Subject-Token", "token")
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer keystone.Close()
+
+	var ironic *httptest.Server
+	ironic = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/nodes" || r.Header.Get("X-Auth-Token") != "token" {
+			http.Error(w, "unexpected request", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Query().Get("marker") == "" {
+			w.Write([]byte(`{"next": "` + ironic.URL + `/v1/nodes?detail=true&limit=1000&marker=2", "nodes": [
+				{"uuid": "uuid-1", "name": "node1", "resource_class": "baremetal", "driver_info": {"ipmi_address": "10.0.0.1", "ipmi_username": "admin", "ipmi_password": "secret"}},
+				{"uuid": "uuid-2", "name": "node2", "driver_info": {"redfish_address": "https://10.0.0.2"}}
+			]}`))
+			return
+		}
+		w.Write([]byte(`{"nodes": [
+			{"uuid": "uuid-3", "resource_class": "baremetal", "driver_info": {"ipmi_address": "10.0.0.3", "ipmi_username": "admin", "ipmi_password": "******"}}
+		]}`))
+	}))
+	defer ironic.Close()
+
+	d := ironicDiscoverer{config: IronicConfig{URL: ironic.URL, Keystone: KeystoneConfig{AuthURL: keystone.URL}}}
+	targets, err := d.discover(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := map[string]Target{
+		"node1": {
+			Address:               "10.0.0.1",
+			Labels:                map[string]string{"ironic_node_uuid": "uuid-1", "ironic_resource_class": "baremetal"},
+			discoveredCredentials: &Credentials{User: "admin", Password: "secret"},
+		},
+		"uuid-3": {
+			Address: "10.0.0.3",
+			Labels:  map[string]string{"ironic_node_uuid": "uuid-3", "ironic_resource_class": "baremetal"},
+		},
+	}
+	if !reflect.DeepEqual(targets, expected) {
+		t.Errorf("expected %v, got %v", expected, targets)
+	}
+
+	// Configured credentials take precedence over those of the nodes.
+	d.config.Credentials = "ironic"
+	targets, err = d.discover(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if t1 := targets["node1"]; t1.Credentials != "ironic" || t1.discoveredCredentials != nil {
+		t.Errorf("expected the configured credentials, got %+v", t1)
+	}
+}
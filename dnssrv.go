@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ipmiPort is the standard port of IPMI over LAN, which FreeIPMI uses unless
+// told otherwise.
+const ipmiPort = 623
+
+// dnsSRVDiscoverer discovers targets from the targets of DNS SRV records.
+type dnsSRVDiscoverer struct {
+	names []string
+}
+
+func (d dnsSRVDiscoverer) discover(ctx context.Context) (map[string]Target, error) {
+	targets := make(map[string]Target)
+	for _, name := range d.names {
+		_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range records {
+			host := strings.TrimSuffix(r.Target, ".")
+			address := host
+			if r.Port != 0 && r.Port != ipmiPort {
+				address = net.JoinHostPort(host, strconv.Itoa(int(r.Port)))
+			}
+			targets[address] = Target{
+				Address: address,
+				// Credentials are configured per host, whatever the port.
+				Credentials: host,
+				Labels:      map[string]string{"dns_srv_name": name},
+			}
+		}
+	}
+	return targets, nil
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// executor runs FreeIPMI commands.
+type executor interface {
+	// Execute runs cmd with args, passing stdin on its standard input, and
+	// returns its output.
+	Execute(ctx context.Context, cmd string, args []string, stdin []byte) (commandResult, error)
+}
+
+// commandResult holds the output of a FreeIPMI command.
+type commandResult struct {
+	stdout []byte
+	stderr []byte
+}
+
+// limitedExecArg is the first argument of the exporter when it is run as the
+// helper that applies resource limits to FreeIPMI commands.
+const limitedExecArg = "__exec-limited"
+
+// errCommandTimeout is returned by freeipmiExecutor if a command was killed
+// because its deadline expired.
+var errCommandTimeout = errors.New("command timed out")
+
+// defaultExecutor, if set, is the executor used by collectors that do not
+// have one injected. Otherwise, they run FreeIPMI with their own config.
+var defaultExecutor executor
+
+// freeipmiExecutor runs FreeIPMI commands as subprocesses.
+type freeipmiExecutor struct {
+	config *SafeConfig
+}
+
+// Execute implements executor. If ctx is done before the command exits, the
+// process group of the command is killed. If the deadline of ctx expired,
+// errCommandTimeout is returned.
+func (e freeipmiExecutor) Execute(ctx context.Context, cmd string, args []string, stdin []byte) (commandResult, error) {
+	release, err := acquireCommandSlot(ctx)
+	if err != nil {
+		return commandResult{}, err
+	}
+	defer release()
+
+	limits := e.config.ResourceLimits()
+	if limits.MaxRuntime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, limits.MaxRuntime)
+		defer cancel()
+	}
+
+	var stdout, stderr bytes.Buffer
+	argv := append(e.config.CommandWrapper(cmd), path.Join(*executablesPath, cmd))
+	argv = append(argv, args...)
+	chroot := e.config.Chroot()
+	if limits.enabled() {
+		if argv, err = limitedArgv(argv, limits, chroot); err != nil {
+			return commandResult{}, err
+		}
+		// The helper changes its root itself after applying the limits.
+		chroot = ""
+	}
+	c := exec.Command(argv[0], argv[1:]...)
+	c.Stdin = bytes.NewReader(stdin)
+	// Numbers are parsed assuming the C locale, so do not let the locale of
+	// the exporter leak into the output of FreeIPMI.
+	c.Env = append(os.Environ(), "LC_ALL=C")
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+	if err := setProcAttr(c, chroot); err != nil {
+		return commandResult{}, err
+	}
+	if err := c.Start(); err != nil {
+		return commandResult{}, err
+	}
+	commandStarts.WithLabelValues(cmd).Inc()
+	commandsRunning.Inc()
+	defer commandsRunning.Dec()
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Wait()
+	}()
+
+	select {
+	case err = <-done:
+		if _, ok := err.(*exec.ExitError); ok {
+			commandFailures.WithLabelValues(cmd).Inc()
+		}
+	case <-ctx.Done():
+		commandKills.WithLabelValues(cmd).Inc()
+		if err := killProcessGroup(c); err != nil {
+			log.Errorf("Error killing %s: %s", cmd, err)
+		}
+		<-done
+		err = ctx.Err()
+		if err == context.DeadlineExceeded {
+			err = errCommandTimeout
+		}
+	}
+	return commandResult{stdout: stdout.Bytes(), stderr: stderr.Bytes()}, err
+}
+
+// replayExecutor returns recorded outputs instead of running commands. The
+// standard output of cmd is read from the file cmd.out in dir, regardless of
+// the arguments, and its standard error from cmd.err, if it exists.
+type replayExecutor struct {
+	dir string
+}
+
+// Execute implements executor.
+func (e replayExecutor) Execute(ctx context.Context, cmd string, args []string, stdin []byte) (commandResult, error) {
+	var (
+		r   commandResult
+		err error
+	)
+	if r.stdout, err = ioutil.ReadFile(filepath.Join(e.dir, cmd+".out")); err != nil {
+		return r, err
+	}
+	if r.stderr, err = ioutil.ReadFile(filepath.Join(e.dir, cmd+".err")); err != nil && !os.IsNotExist(err) {
+		return r, err
+	}
+	return r, nil
+}
+
+// commandError is returned if a FreeIPMI command failed. It includes what the
+// command printed on standard error.
+type commandError struct {
+	cmd    string
+	err    error
+	stderr string
+}
+
+func (e *commandError) Error() string {
+	if e.stderr == "" {
+		return fmt.Sprintf("%s: %s", e.cmd, e.err)
+	}
+	return fmt.Sprintf("%s: %s: %s", e.cmd, e.err, e.stderr)
+}
+
+var (
+	// commandSlots limits the number of FreeIPMI processes running at the
+	// same time across all scrapes. It is nil if there is no limit.
+	commandSlots chan struct{}
+
+	commandsWaiting = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace + "_exporter",
+			Name:      "commands_waiting",
+			Help:      "Number of FreeIPMI commands waiting for a free slot.",
+		},
+	)
+
+	commandWaitDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: namespace + "_exporter",
+			Name:      "command_wait_seconds",
+			Help:      "Time FreeIPMI commands waited for a free slot before being started.",
+			Buckets:   []float64{.01, .05, .1, .5, 1, 2.5, 5, 10, 30, 60},
+		},
+	)
+
+	commandStarts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace + "_exporter",
+			Name:      "command_starts_total",
+			Help:      "Number of FreeIPMI processes started.",
+		},
+		[]string{"command"},
+	)
+
+	commandsRunning = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace + "_exporter",
+			Name:      "commands_running",
+			Help:      "Number of FreeIPMI processes currently running.",
+		},
+	)
+
+	commandFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace + "_exporter",
+			Name:      "command_failures_total",
+			Help:      "Number of FreeIPMI processes that exited with a non-zero status.",
+		},
+		[]string{"command"},
+	)
+
+	commandKills = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace + "_exporter",
+			Name:      "command_kills_total",
+			Help:      "Number of FreeIPMI processes killed on timeout or cancellation.",
+		},
+		[]string{"command"},
+	)
+
+	parseErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace + "_exporter",
+			Name:      "parse_errors_total",
+			Help:      "Number of times the output of FreeIPMI could not be parsed.",
+		},
+		[]string{"collector"},
+	)
+)
+
+var commandAvailable = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "collector_cmd_available",
+		Help:      "'1' if the FreeIPMI command of the collector was found, '0' otherwise.",
+	},
+	[]string{"collector"},
+)
+
+// checkCommands checks whether the FreeIPMI command of each collector can be
+// found, and logs and exports the result.
+func checkCommands(config *SafeConfig) {
+	for _, ic := range enabledCollectors(config) {
+		err := findCommand(ic.command, config.Chroot())
+		if err != nil {
+			log.Warnf("Command of collector %s is not available: %s", ic.name, err)
+		}
+		commandAvailable.WithLabelValues(ic.name).Set(boolToFloat(err == nil))
+	}
+}
+
+// findCommand returns an error if cmd cannot be found in the executables
+// path, or $PATH if not set.
+func findCommand(cmd, chroot string) error {
+	if *replayDir != "" {
+		return nil
+	}
+	if *executablesPath == "" {
+		_, err := exec.LookPath(cmd)
+		return err
+	}
+	_, err := exec.LookPath(filepath.Join(chroot, *executablesPath, cmd))
+	return err
+}
+
+type waitTimeKey struct{}
+
+// withWaitTime returns a context accumulating the time spent waiting for
+// free slots by the commands run with it in waited, in nanoseconds.
+func withWaitTime(ctx context.Context, waited *int64) context.Context {
+	return context.WithValue(ctx, waitTimeKey{}, waited)
+}
+
+// addWaitTime adds d to the wait time accumulated for ctx, if any.
+func addWaitTime(ctx context.Context, d time.Duration) {
+	if waited, ok := ctx.Value(waitTimeKey{}).(*int64); ok {
+		atomic.AddInt64(waited, int64(d))
+	}
+}
+
+// acquireCommandSlot blocks until another FreeIPMI process may be started or
+// ctx is done. The returned function must be called once the process exited.
+func acquireCommandSlot(ctx context.Context) (func(), error) {
+	if commandSlots == nil {
+		return func() {}, nil
+	}
+	start := time.Now()
+	commandsWaiting.Inc()
+	defer commandsWaiting.Dec()
+	select {
+	case commandSlots <- struct{}{}:
+		commandWaitDuration.Observe(time.Since(start).Seconds())
+		addWaitTime(ctx, time.Since(start))
+		return func() { <-commandSlots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
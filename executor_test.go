@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// fakeExecutor returns canned outputs instead of running commands. Outputs
+// are looked up by the command and its arguments, without the options
+// freeipmiOutput adds to connect to the target, e.g.
+// "ipmi-dcmi --get-system-power-statistics".
+type fakeExecutor struct {
+	mtx     sync.Mutex
+	outputs map[string]string
+	// calls are the keys of the commands run, in order.
+	calls []string
+	// stdin is what the last command got on its standard input.
+	stdin string
+}
+
+func newFakeExecutor(outputs map[string]string) *fakeExecutor {
+	return &fakeExecutor{outputs: outputs}
+}
+
+// connectionOptions are the options freeipmiOutput passes to every command,
+// each followed by a value.
+var connectionOptions = map[string]bool{
+	"--config-file": true,
+	"-D":            true,
+	"-l":            true,
+	"-h":            true,
+	"-u":            true,
+	"-p":            true,
+	"-W":            true,
+}
+
+func fakeCommandKey(cmd string, args []string) string {
+	key := []string{cmd}
+	for i := 0; i < len(args); i++ {
+		if connectionOptions[args[i]] {
+			i++
+			continue
+		}
+		key = append(key, args[i])
+	}
+	return strings.Join(key, " ")
+}
+
+// Execute implements executor. Commands without a canned output fail.
+func (e *fakeExecutor) Execute(ctx context.Context, cmd string, args []string, stdin []byte) (commandResult, error) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	key := fakeCommandKey(cmd, args)
+	e.calls = append(e.calls, key)
+	e.stdin = string(stdin)
+	output, ok := e.outputs[key]
+	if !ok {
+		return commandResult{stderr: []byte("unexpected command")}, fmt.Errorf("no output for %q", key)
+	}
+	return commandResult{stdout: []byte(output)}, nil
+}
@@ -0,0 +1,30 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+)
+
+// setProcAttr makes cmd run in its own process group, so that it can be
+// killed along with all its children, and in the given chroot, if any.
+func setProcAttr(cmd *exec.Cmd, chroot string) error {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if chroot != "" {
+		if !filepath.IsAbs(cmd.Path) {
+			return fmt.Errorf("running %s in a chroot requires an absolute path", cmd.Path)
+		}
+		cmd.SysProcAttr.Chroot = chroot
+		cmd.Dir = "/"
+	}
+	return nil
+}
+
+// killProcessGroup kills the process group of the started cmd.
+func killProcessGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
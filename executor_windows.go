@@ -0,0 +1,21 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// setProcAttr prepares cmd to be run. Running commands in a chroot is not
+// supported on Windows.
+func setProcAttr(cmd *exec.Cmd, chroot string) error {
+	if chroot != "" {
+		return errors.New("chroot is not supported on Windows")
+	}
+	return nil
+}
+
+// killProcessGroup kills the started cmd. Windows has no process groups that
+// could be killed at once, so only the process itself is killed.
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
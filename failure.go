@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os/exec"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Reasons for failed collections, as exported in the reason label.
+const (
+	reasonAuth          = "auth"
+	reasonTimeout       = "timeout"
+	reasonUnsupported   = "unsupported"
+	reasonParse         = "parse"
+	reasonExec          = "exec"
+	reasonNoCredentials = "no_credentials"
+	reasonDNS           = "dns"
+	reasonUnknown       = "unknown"
+)
+
+var scrapeErrors = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "scrape_errors_total",
+		Help:      "Number of times a collector failed, by reason of the failure.",
+	},
+	[]string{"collector", "reason"},
+)
+
+// parseError is returned if the output of a FreeIPMI command could not be
+// parsed.
+type parseError struct {
+	err error
+}
+
+func (e *parseError) Error() string {
+	return "could not parse output: " + e.err.Error()
+}
+
+// failureMessages maps messages printed by FreeIPMI to failure reasons.
+var failureMessages = []struct {
+	msg    string
+	reason string
+}{
+	{"password invalid", reasonAuth},
+	{"username invalid", reasonAuth},
+	{"k_g invalid", reasonAuth},
+	{"privilege level insufficient", reasonAuth},
+	{"privilege level cannot be obtained", reasonAuth},
+	{"authentication type unavailable", reasonAuth},
+	{"connection timeout", reasonTimeout},
+	{"session timeout", reasonTimeout},
+	// The messages FreeIPMI prints for the IPMI completion codes that
+	// mean the BMC does not implement a command.
+	{"invalid command", reasonUnsupported},
+	{"command invalid for given lun", reasonUnsupported},
+	{"request parameter(s) not supported", reasonUnsupported},
+	{"command illegal for specified sensor or record type", reasonUnsupported},
+	{"not supported in present state", reasonUnsupported},
+	{"command sub-function has been disabled or is unavailable", reasonUnsupported},
+}
+
+// failureReason classifies err, as returned by a collector.
+func failureReason(err error) string {
+	switch e := err.(type) {
+	case *parseError:
+		return reasonParse
+	case *rawCompletionError:
+		if e.code == completionCodeInvalidCommand {
+			return reasonUnsupported
+		}
+		return reasonUnknown
+	case *commandError:
+		if e.err == errCommandTimeout || e.err == context.DeadlineExceeded {
+			return reasonTimeout
+		}
+		if _, ok := e.err.(*exec.Error); ok {
+			return reasonExec
+		}
+		if _, ok := e.err.(*net.DNSError); ok {
+			return reasonDNS
+		}
+		stderr := strings.ToLower(e.stderr)
+		for _, fm := range failureMessages {
+			if strings.Contains(stderr, strings.ToLower(fm.msg)) {
+				return fm.reason
+			}
+		}
+		if _, ok := e.err.(*exec.ExitError); !ok {
+			return reasonExec
+		}
+	}
+	return reasonUnknown
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"os/exec"
+	"testing"
+)
+
+func TestFailureReason(t *testing.T) {
+	tests := []struct {
+		stderr string
+		reason string
+	}{
+		{"ipmi-dcmi: password invalid", reasonAuth},
+		{"ipmi-dcmi: connection timeout", reasonTimeout},
+		{"ipmi_cmd_get_dcmi_capability_info: Invalid command", reasonUnsupported},
+		{"ipmi_cmd_get_sel_info: Command sub-function has been disabled or is unavailable", reasonUnsupported},
+		{"ipmi_cmd_get_power_reading: Request parameter(s) not supported", reasonUnsupported},
+		// Messages that merely mention something being unavailable do not
+		// mean the command is unsupported.
+		{"ipmi-sel: SEL not available, device busy", reasonUnknown},
+		{"ipmimonitoring: IPMI 2.0 not supported by this BMC configuration", reasonUnknown},
+	}
+	for _, test := range tests {
+		err := &commandError{cmd: "test", err: &exec.ExitError{}, stderr: test.stderr}
+		if reason := failureReason(err); reason != test.reason {
+			t.Errorf("%q: expected reason %s, got %s", test.stderr, test.reason, reason)
+		}
+	}
+}
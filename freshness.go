@@ -0,0 +1,35 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// successTracker remembers when each collector last succeeded for a target.
+type successTracker struct {
+	mtx     sync.Mutex
+	targets map[string]map[string]time.Time
+}
+
+// Record records that collector succeeded for target at t.
+func (st *successTracker) Record(target, collector string, t time.Time) {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	if st.targets == nil {
+		st.targets = make(map[string]map[string]time.Time)
+	}
+	collectors, ok := st.targets[target]
+	if !ok {
+		collectors = make(map[string]time.Time)
+		st.targets[target] = collectors
+	}
+	collectors[collector] = t
+}
+
+// Get returns the time collector last succeeded for target, if ever.
+func (st *successTracker) Get(target, collector string) (time.Time, bool) {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	t, ok := st.targets[target][collector]
+	return t, ok
+}
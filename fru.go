@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	fruInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "fru", "info"),
+		"Constant metric with value '1' providing the asset tag from the FRU data of the system.",
+		[]string{"asset_tag"},
+		nil,
+	)
+
+	fruAssetTagRegex = regexp.MustCompile(`^\s*FRU Product Asset Tag\s*:\s*(?P<value>.*)$`)
+)
+
+func fruEnabled(config *SafeConfig) bool {
+	return config.Inventory().AssetTag
+}
+
+func ipmiFRUOutput(ctx context.Context, e executor, host, user, password string) ([]byte, error) {
+	return freeipmiOutput(ctx, e, "ipmi-fru", host, user, password)
+}
+
+// parseFRUAssetTag returns the asset tag of the product info area in the
+// output of ipmi-fru, or an empty string if there is none.
+func parseFRUAssetTag(output []byte) string {
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		if match := fruAssetTagRegex.FindStringSubmatch(scanner.Text()); match != nil {
+			return strings.TrimSpace(match[1])
+		}
+	}
+	return ""
+}
+
+func (c collector) collectFRU(ctx context.Context, ch chan<- prometheus.Metric, creds Credentials) error {
+	output, err := ipmiFRUOutput(ctx, c.getExecutor(), c.target, creds.User, creds.Password)
+	if err != nil {
+		return err
+	}
+	tag := parseFRUAssetTag(output)
+	ch <- prometheus.MustNewConstMetric(
+		fruInfoDesc,
+		prometheus.GaugeValue,
+		1,
+		tag,
+	)
+	inventory.setAssetTag(c.targetName(), c.target, tag)
+	return nil
+}
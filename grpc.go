@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/common/log"
+)
+
+// The types below mirror the messages of the control API in control.proto.
+// The API is served with the gRPC protocol on top of the HTTP/2 support of
+// net/http, see
+// https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-HTTP2.md. Only unary
+// calls without compression are supported, which is all the API needs.
+
+type grpcScrapeTargetRequest struct {
+	Target         string  `protobuf:"bytes,1,opt,name=target,proto3"`
+	TimeoutSeconds float64 `protobuf:"fixed64,2,opt,name=timeout_seconds,proto3"`
+}
+
+func (m *grpcScrapeTargetRequest) Reset()         { *m = grpcScrapeTargetRequest{} }
+func (m *grpcScrapeTargetRequest) String() string { return proto.CompactTextString(m) }
+func (*grpcScrapeTargetRequest) ProtoMessage()    {}
+
+type grpcScrapeTargetResponse struct {
+	Up      bool   `protobuf:"varint,1,opt,name=up,proto3"`
+	Metrics string `protobuf:"bytes,2,opt,name=metrics,proto3"`
+}
+
+func (m *grpcScrapeTargetResponse) Reset()         { *m = grpcScrapeTargetResponse{} }
+func (m *grpcScrapeTargetResponse) String() string { return proto.CompactTextString(m) }
+func (*grpcScrapeTargetResponse) ProtoMessage()    {}
+
+type grpcFlushCacheRequest struct {
+	Target string `protobuf:"bytes,1,opt,name=target,proto3"`
+}
+
+func (m *grpcFlushCacheRequest) Reset()         { *m = grpcFlushCacheRequest{} }
+func (m *grpcFlushCacheRequest) String() string { return proto.CompactTextString(m) }
+func (*grpcFlushCacheRequest) ProtoMessage()    {}
+
+type grpcFlushCacheResponse struct {
+	Flushed int32 `protobuf:"varint,1,opt,name=flushed,proto3"`
+}
+
+func (m *grpcFlushCacheResponse) Reset()         { *m = grpcFlushCacheResponse{} }
+func (m *grpcFlushCacheResponse) String() string { return proto.CompactTextString(m) }
+func (*grpcFlushCacheResponse) ProtoMessage()    {}
+
+type grpcListTargetsRequest struct{}
+
+func (m *grpcListTargetsRequest) Reset()         { *m = grpcListTargetsRequest{} }
+func (m *grpcListTargetsRequest) String() string { return proto.CompactTextString(m) }
+func (*grpcListTargetsRequest) ProtoMessage()    {}
+
+type grpcListTargetsResponse struct {
+	Targets []*grpcTarget `protobuf:"bytes,1,rep,name=targets"`
+}
+
+func (m *grpcListTargetsResponse) Reset()         { *m = grpcListTargetsResponse{} }
+func (m *grpcListTargetsResponse) String() string { return proto.CompactTextString(m) }
+func (*grpcListTargetsResponse) ProtoMessage()    {}
+
+type grpcTarget struct {
+	Name    string            `protobuf:"bytes,1,opt,name=name,proto3"`
+	Address string            `protobuf:"bytes,2,opt,name=address,proto3"`
+	Labels  map[string]string `protobuf:"bytes,3,rep,name=labels" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+}
+
+func (m *grpcTarget) Reset()         { *m = grpcTarget{} }
+func (m *grpcTarget) String() string { return proto.CompactTextString(m) }
+func (*grpcTarget) ProtoMessage()    {}
+
+// gRPC status codes, see
+// https://github.com/grpc/grpc/blob/master/doc/statuscodes.md.
+const (
+	grpcInvalidArgument   = 3
+	grpcPermissionDenied  = 7
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcInternal          = 13
+	grpcUnauthenticated   = 16
+)
+
+// grpcMaxMessageSize is the maximum size of a request message. The requests of
+// the API are tiny, so anything bigger is not a valid call.
+const grpcMaxMessageSize = 64 << 10
+
+// grpcError is an error with a gRPC status code.
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e *grpcError) Error() string {
+	return e.msg
+}
+
+// grpcMethod handles a call. It decodes the request from body and returns the
+// response. config is the configuration snapshot to use for the whole call.
+type grpcMethod func(config *SafeConfig, r *http.Request, body []byte) (proto.Message, error)
+
+var grpcMethods = map[string]grpcMethod{
+	"/ipmi_exporter.v1.Control/ScrapeTarget": grpcScrapeTarget,
+	"/ipmi_exporter.v1.Control/FlushCache":   grpcFlushCache,
+	"/ipmi_exporter.v1.Control/ListTargets":  grpcListTargets,
+}
+
+// serveGRPC serves the control API on l. It only accepts unencrypted HTTP/2
+// connections, which is what gRPC clients use without TLS.
+func serveGRPC(l net.Listener) error {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	srv := &http.Server{
+		Handler:   http.HandlerFunc(grpcHandler),
+		Protocols: &protocols,
+	}
+	return srv.Serve(l)
+}
+
+func grpcHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC request expected", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	method, ok := grpcMethods[r.URL.Path]
+	if !ok {
+		grpcWriteStatus(w, &grpcError{grpcUnimplemented, fmt.Sprintf("unknown method %s", r.URL.Path)})
+		return
+	}
+	config := sc.Snapshot()
+	// Callers are authenticated before their request is read, the targets
+	// they may access are checked by the methods.
+	if err := grpcAuthorize(config, r, ""); err != nil {
+		grpcWriteStatus(w, err)
+		return
+	}
+	body, err := grpcReadMessage(r.Body)
+	if err != nil {
+		grpcWriteStatus(w, err)
+		return
+	}
+	resp, err := method(config, r, body)
+	if err != nil {
+		if _, ok := err.(*grpcError); !ok {
+			log.Errorf("Error handling gRPC call %s: %s", r.URL.Path, err)
+		}
+		grpcWriteStatus(w, err)
+		return
+	}
+	data, err := proto.Marshal(resp)
+	if err != nil {
+		grpcWriteStatus(w, err)
+		return
+	}
+	var prefix [5]byte // not compressed, length
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(data)))
+	w.Write(prefix[:])
+	w.Write(data)
+	grpcWriteStatus(w, nil)
+}
+
+// grpcReadMessage reads the single, length-prefixed message of a unary call.
+func grpcReadMessage(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, &grpcError{grpcInvalidArgument, "error reading request: " + err.Error()}
+	}
+	if prefix[0] != 0 {
+		return nil, &grpcError{grpcUnimplemented, "compressed requests are not supported"}
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > grpcMaxMessageSize {
+		return nil, &grpcError{grpcResourceExhausted, fmt.Sprintf("request of %d bytes exceeds the maximum of %d bytes", size, grpcMaxMessageSize)}
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r, int64(size)))
+	if err != nil {
+		return nil, &grpcError{grpcInvalidArgument, "error reading request: " + err.Error()}
+	}
+	return body, nil
+}
+
+// grpcWriteStatus ends the call with the status of err, which is OK if err is
+// nil. The status is sent in the trailers.
+func grpcWriteStatus(w http.ResponseWriter, err error) {
+	code, msg := 0, ""
+	if err != nil {
+		code, msg = grpcInternal, err.Error()
+		if e, ok := err.(*grpcError); ok {
+			code = e.code
+		}
+	}
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", grpcEncodeMessage(msg))
+	}
+}
+
+// grpcEncodeMessage percent-encodes msg as required for the grpc-message
+// header.
+func grpcEncodeMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// grpcAuthorize checks the bearer token of r like authorize, but returns the
+// result as gRPC status.
+func grpcAuthorize(config *SafeConfig, r *http.Request, target string) error {
+	if !config.AuthRequired() {
+		return nil
+	}
+	known, allowed := config.TokenAllows(bearerToken(r), target)
+	if !known {
+		return &grpcError{grpcUnauthenticated, "valid bearer token required"}
+	}
+	if target != "" && !allowed {
+		return &grpcError{grpcPermissionDenied, fmt.Sprintf("target '%s' is not allowed for this token", target)}
+	}
+	return nil
+}
+
+func grpcScrapeTarget(config *SafeConfig, r *http.Request, body []byte) (proto.Message, error) {
+	var req grpcScrapeTargetRequest
+	if err := proto.Unmarshal(body, &req); err != nil {
+		return nil, &grpcError{grpcInvalidArgument, err.Error()}
+	}
+	if req.Target == "" {
+		return nil, &grpcError{grpcInvalidArgument, "target must be specified"}
+	}
+	if err := grpcAuthorize(config, r, req.Target); err != nil {
+		return nil, err
+	}
+	if !rateLimitAllows(config, r) {
+		return nil, &grpcError{grpcResourceExhausted, "rate limit exceeded"}
+	}
+	if !config.TargetAllowed(req.Target) {
+		return nil, &grpcError{grpcPermissionDenied, fmt.Sprintf("target '%s' is not allowed", req.Target)}
+	}
+	timeout := time.Minute
+	if req.TimeoutSeconds < 0 || req.TimeoutSeconds > sharedScrapeTimeout.Seconds() {
+		return nil, &grpcError{grpcInvalidArgument, fmt.Sprintf("timeout must be between 0 and %.0f seconds", sharedScrapeTimeout.Seconds())}
+	}
+	if req.TimeoutSeconds > 0 {
+		timeout = time.Duration(req.TimeoutSeconds * float64(time.Second))
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	mfs, err := scrapeTarget(ctx, config, req.Target, timeout)
+	if err != nil {
+		return nil, err
+	}
+	text, err := formatText(mfs)
+	if err != nil {
+		return nil, err
+	}
+	resp := &grpcScrapeTargetResponse{Metrics: string(text)}
+	for _, mf := range mfs {
+		if mf.GetName() == *metricsNamespace+"_up" && len(mf.Metric) == 1 {
+			resp.Up = mf.Metric[0].GetGauge().GetValue() == 1
+		}
+	}
+	return resp, nil
+}
+
+func grpcFlushCache(config *SafeConfig, r *http.Request, body []byte) (proto.Message, error) {
+	var req grpcFlushCacheRequest
+	if err := proto.Unmarshal(body, &req); err != nil {
+		return nil, &grpcError{grpcInvalidArgument, err.Error()}
+	}
+	if err := grpcAuthorize(config, r, req.Target); err != nil {
+		return nil, err
+	}
+	address := ""
+	if req.Target != "" {
+		address, _ = config.LookupTarget(req.Target)
+	} else if config.AuthRequired() {
+		// Flushing all targets is only allowed for tokens that may access
+		// all of them.
+		if _, allowed := config.TokenAllows(bearerToken(r), ""); !allowed {
+			return nil, &grpcError{grpcPermissionDenied, "flushing all targets is not allowed for this token"}
+		}
+	}
+	n := results.Flush(address) + staleResults.Flush(address)
+	log.Infof("Flushed %d cached results via gRPC", n)
+	return &grpcFlushCacheResponse{Flushed: int32(n)}, nil
+}
+
+func grpcListTargets(config *SafeConfig, r *http.Request, body []byte) (proto.Message, error) {
+	resp := &grpcListTargetsResponse{}
+	for _, t := range config.KnownTargets() {
+		if grpcAuthorize(config, r, t.Name) != nil {
+			continue
+		}
+		address, _ := config.LookupTarget(t.Name)
+		resp.Targets = append(resp.Targets, &grpcTarget{Name: t.Name, Address: address, Labels: t.Labels})
+	}
+	return resp, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// unreadableBody fails the test if the request body is read.
+type unreadableBody struct {
+	t *testing.T
+}
+
+func (b unreadableBody) Read(p []byte) (int, error) {
+	b.t.Error("expected the request body not to be read")
+	return 0, errors.New("unexpected read")
+}
+
+// grpcCall calls method with body and returns the gRPC status code.
+func grpcCall(t *testing.T, method, token string, body io.Reader) int {
+	t.Helper()
+	r := httptest.NewRequest("POST", "/ipmi_exporter.v1.Control/"+method, body)
+	r.Header.Set("Content-Type", "application/grpc")
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	grpcHandler(w, r)
+	code, err := strconv.Atoi(w.Result().Trailer.Get("Grpc-Status"))
+	if err != nil {
+		t.Fatalf("invalid status: %s", err)
+	}
+	return code
+}
+
+// grpcRequest returns msg as the length-prefixed body of a unary call.
+func grpcRequest(t *testing.T, msg proto.Message) io.Reader {
+	t.Helper()
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var prefix [5]byte
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(data)))
+	return bytes.NewReader(append(prefix[:], data...))
+}
+
+func TestGRPCLimits(t *testing.T) {
+	defer func(old *SafeConfig) { sc = old }(sc)
+	sc = loadTestConfig(t, `
+auth_tokens:
+  - token: all
+  - token: scoped
+    targets: [10.0.0.1]
+`)
+
+	if code := grpcCall(t, "ListTargets", "", unreadableBody{t}); code != grpcUnauthenticated {
+		t.Errorf("expected status %d without a token, got %d", grpcUnauthenticated, code)
+	}
+	huge := bytes.NewReader([]byte{0, 0xff, 0xff, 0xff, 0xff})
+	if code := grpcCall(t, "ListTargets", "all", huge); code != grpcResourceExhausted {
+		t.Errorf("expected status %d for a 4 GiB request, got %d", grpcResourceExhausted, code)
+	}
+
+	flushAll := &grpcFlushCacheRequest{}
+	if code := grpcCall(t, "FlushCache", "scoped", grpcRequest(t, flushAll)); code != grpcPermissionDenied {
+		t.Errorf("expected status %d flushing all targets with a scoped token, got %d", grpcPermissionDenied, code)
+	}
+	if code := grpcCall(t, "FlushCache", "all", grpcRequest(t, flushAll)); code != 0 {
+		t.Errorf("expected status 0 flushing all targets, got %d", code)
+	}
+	flushTarget := &grpcFlushCacheRequest{Target: "10.0.0.1"}
+	if code := grpcCall(t, "FlushCache", "scoped", grpcRequest(t, flushTarget)); code != 0 {
+		t.Errorf("expected status 0 flushing an allowed target, got %d", code)
+	}
+
+	scrape := &grpcScrapeTargetRequest{Target: "10.0.0.1", TimeoutSeconds: 3600}
+	if code := grpcCall(t, "ScrapeTarget", "all", grpcRequest(t, scrape)); code != grpcInvalidArgument {
+		t.Errorf("expected status %d for a timeout of an hour, got %d", grpcInvalidArgument, code)
+	}
+}
+
+func TestGRPCRateLimit(t *testing.T) {
+	defer func(old *SafeConfig) { sc = old }(sc)
+	sc = loadTestConfig(t, `
+rate_limit:
+  requests_per_second: 0.001
+  burst: 1
+`)
+	defer func() { limiter = rateLimiter{} }()
+	// The first call uses up the burst, whatever its result.
+	scrape := &grpcScrapeTargetRequest{Target: "invalid target"}
+	grpcCall(t, "ScrapeTarget", "", grpcRequest(t, scrape))
+	if code := grpcCall(t, "ScrapeTarget", "", grpcRequest(t, scrape)); code != grpcResourceExhausted {
+		t.Errorf("expected status %d, got %d", grpcResourceExhausted, code)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// inventoryEntry is what is known about the BMC of a target from its scrapes.
+// Target is the target as requested, e.g. an alias, and Address its address.
+type inventoryEntry struct {
+	Target                string    `json:"target"`
+	Address               string    `json:"address"`
+	Manufacturer          string    `json:"manufacturer"`
+	ProductID             string    `json:"product_id"`
+	DeviceID              string    `json:"device_id"`
+	IPMIVersion           string    `json:"ipmi_version"`
+	FirmwareRevision      string    `json:"firmware_revision"`
+	SystemFirmwareVersion string    `json:"system_firmware_version"`
+	AssetTag              string    `json:"asset_tag"`
+	SensorCount           *int      `json:"sensor_count"`
+	LastSeen              time.Time `json:"last_seen"`
+}
+
+// inventoryTracker collects the inventory of all scraped targets.
+type inventoryTracker struct {
+	sync.Mutex
+	entries map[string]*inventoryEntry
+}
+
+var inventory = &inventoryTracker{entries: make(map[string]*inventoryEntry)}
+
+// entry returns the entry of target at address, creating it if needed. It
+// must be called with t locked.
+func (t *inventoryTracker) entry(target, address string) *inventoryEntry {
+	e, ok := t.entries[target]
+	if !ok {
+		e = &inventoryEntry{Target: target}
+		t.entries[target] = e
+	}
+	e.Address = address
+	e.LastSeen = time.Now()
+	return e
+}
+
+func (t *inventoryTracker) setBMCInfo(target, address string, info bmcInfoData) {
+	t.Lock()
+	defer t.Unlock()
+	e := t.entry(target, address)
+	e.Manufacturer = info.ManufacturerID
+	e.ProductID = info.ProductID
+	e.DeviceID = info.DeviceID
+	e.IPMIVersion = info.IPMIVersion
+	e.FirmwareRevision = info.FirmwareRevision
+	e.SystemFirmwareVersion = info.SystemFirmwareVersion
+}
+
+func (t *inventoryTracker) setSensorCount(target, address string, n int) {
+	t.Lock()
+	defer t.Unlock()
+	t.entry(target, address).SensorCount = &n
+}
+
+func (t *inventoryTracker) setAssetTag(target, address, tag string) {
+	t.Lock()
+	defer t.Unlock()
+	t.entry(target, address).AssetTag = tag
+}
+
+// list returns all entries, sorted by target.
+func (t *inventoryTracker) list() []inventoryEntry {
+	t.Lock()
+	defer t.Unlock()
+	result := make([]inventoryEntry, 0, len(t.entries))
+	for _, e := range t.entries {
+		result = append(result, *e)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Target < result[j].Target })
+	return result
+}
+
+// writeInventory writes entries to w in the given format, either "json" or
+// "csv".
+func writeInventory(w io.Writer, format string, entries []inventoryEntry) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	}
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"target", "address", "manufacturer", "product_id", "device_id", "ipmi_version", "firmware_revision", "system_firmware_version", "asset_tag", "sensor_count", "last_seen"})
+	for _, e := range entries {
+		sensors := ""
+		if e.SensorCount != nil {
+			sensors = strconv.Itoa(*e.SensorCount)
+		}
+		cw.Write([]string{e.Target, e.Address, e.Manufacturer, e.ProductID, e.DeviceID, e.IPMIVersion, e.FirmwareRevision, e.SystemFirmwareVersion, e.AssetTag, sensors, e.LastSeen.UTC().Format(time.RFC3339)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// inventoryHandler serves /inventory, in JSON or, with format=csv, as CSV. If
+// tokens are configured, only the targets allowed for the token are listed.
+func inventoryHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorize(w, r, "") {
+		return
+	}
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "", "json":
+		format = "json"
+		w.Header().Set("Content-Type", "application/json")
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+	default:
+		http.Error(w, "format must be 'json' or 'csv'", 400)
+		return
+	}
+	entries := inventory.list()
+	if sc.AuthRequired() {
+		token := bearerToken(r)
+		allowed := entries[:0]
+		for _, e := range entries {
+			if _, ok := sc.TokenAllows(token, e.Target); ok {
+				allowed = append(allowed, e)
+			}
+		}
+		entries = allowed
+	}
+	if err := writeInventory(w, format, entries); err != nil {
+		log.Errorf("Error writing inventory: %s", err)
+	}
+}
+
+// writeInventoryFile writes the inventory to cfg.File, replacing it
+// atomically.
+func writeInventoryFile(cfg InventoryConfig) error {
+	var buf bytes.Buffer
+	if err := writeInventory(&buf, cfg.Format, inventory.list()); err != nil {
+		return err
+	}
+	tmp := cfg.File + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, cfg.File)
+}
+
+// runInventoryWriter writes the inventory file every interval. It never
+// returns; while no file is configured, it only watches for changes.
+func runInventoryWriter(config *SafeConfig) {
+	for {
+		cfg := config.Inventory()
+		if cfg.File == "" {
+			time.Sleep(10 * time.Second)
+			continue
+		}
+		if err := writeInventoryFile(cfg); err != nil {
+			log.Errorf("Error writing inventory file %s: %s", cfg.File, err)
+		}
+		time.Sleep(cfg.Interval)
+	}
+}
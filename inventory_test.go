@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestInventoryHandlerAliases(t *testing.T) {
+	defer func(old *SafeConfig) { sc = old }(sc)
+	sc = loadTestConfig(t, `
+auth_tokens:
+  - token: rack1
+    targets: [node1]
+targets:
+  node1:
+    address: 10.0.0.1
+  node2:
+    address: 10.0.0.2
+`)
+	defer func(old *inventoryTracker) { inventory = old }(inventory)
+	inventory = &inventoryTracker{entries: make(map[string]*inventoryEntry)}
+	inventory.setAssetTag("node1", "10.0.0.1", "INV-1")
+	inventory.setAssetTag("node2", "10.0.0.2", "INV-2")
+
+	r := httptest.NewRequest("GET", "/inventory", nil)
+	r.Header.Set("Authorization", "Bearer rack1")
+	w := httptest.NewRecorder()
+	inventoryHandler(w, r)
+	var entries []inventoryEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+		t.Fatalf("invalid response %q: %s", w.Body.String(), err)
+	}
+	if len(entries) != 1 || entries[0].Target != "node1" || entries[0].Address != "10.0.0.1" || entries[0].AssetTag != "INV-1" {
+		t.Errorf("expected only node1 to be listed, got %+v", entries)
+	}
+}
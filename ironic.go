@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ironicDiscoverer discovers targets from the IPMI driver_info of the nodes
+// in OpenStack Ironic, see https://docs.openstack.org/api-ref/baremetal/.
+type ironicDiscoverer struct {
+	config IronicConfig
+}
+
+// ironicMaskedPassword is what the Ironic API returns instead of passwords,
+// unless the policy allows showing them.
+const ironicMaskedPassword = "******"
+
+type ironicNode struct {
+	UUID          string `json:"uuid"`
+	Name          string `json:"name"`
+	ResourceClass string `json:"resource_class"`
+	DriverInfo    struct {
+		Address  string `json:"ipmi_address"`
+		Username string `json:"ipmi_username"`
+		Password string `json:"ipmi_password"`
+	} `json:"driver_info"`
+}
+
+type ironicNodeList struct {
+	Nodes []ironicNode `json:"nodes"`
+	Next  string       `json:"next"`
+}
+
+func (d ironicDiscoverer) discover(ctx context.Context) (map[string]Target, error) {
+	token, err := keystoneToken(ctx, d.config.Keystone)
+	if err != nil {
+		return nil, fmt.Errorf("error authenticating with Keystone: %s", err)
+	}
+
+	targets := make(map[string]Target)
+	next := strings.TrimSuffix(d.config.URL, "/") + "/v1/nodes?detail=true&limit=1000"
+	for next != "" {
+		var list ironicNodeList
+		if err := d.get(ctx, next, token, &list); err != nil {
+			return nil, err
+		}
+		for _, node := range list.Nodes {
+			// Nodes using other drivers, e.g. Redfish, have no IPMI address.
+			if node.DriverInfo.Address == "" {
+				continue
+			}
+			name := node.Name
+			if name == "" {
+				name = node.UUID
+			}
+			t := Target{
+				Address:     node.DriverInfo.Address,
+				Credentials: d.config.Credentials,
+				Labels: map[string]string{
+					"ironic_node_uuid":      node.UUID,
+					"ironic_resource_class": node.ResourceClass,
+				},
+			}
+			if t.Credentials == "" && node.DriverInfo.Username != "" && node.DriverInfo.Password != ironicMaskedPassword {
+				t.discoveredCredentials = &Credentials{
+					User:     node.DriverInfo.Username,
+					Password: node.DriverInfo.Password,
+				}
+			}
+			targets[name] = t
+		}
+		next = list.Next
+	}
+	return targets, nil
+}
+
+func (d ironicDiscoverer) get(ctx context.Context, url, token string, v interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	// Version 1.22 introduced the "next" link for pagination.
+	req.Header.Set("X-OpenStack-Ironic-API-Version", "1.22")
+	if token != "" {
+		req.Header.Set("X-Auth-Token", token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s from %s", resp.Status, url)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// keystoneToken requests a project-scoped token from Keystone using password
+// authentication. It returns an empty token if no Keystone is configured.
+func keystoneToken(ctx context.Context, cfg KeystoneConfig) (string, error) {
+	if cfg.AuthURL == "" {
+		return "", nil
+	}
+	body := map[string]interface{}{
+		"auth": map[string]interface{}{
+			"identity": map[string]interface{}{
+				"methods": []string{"password"},
+				"password": map[string]interface{}{
+					"user": map[string]interface{}{
+						"name":     cfg.Username,
+						"password": cfg.Password,
+						"domain":   map[string]string{"name": cfg.UserDomainName},
+					},
+				},
+			},
+			"scope": map[string]interface{}{
+				"project": map[string]interface{}{
+					"name":   cfg.ProjectName,
+					"domain": map[string]string{"name": cfg.ProjectDomainName},
+				},
+			},
+		},
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+	url := strings.TrimSuffix(cfg.AuthURL, "/")
+	if !strings.HasSuffix(url, "/v3") {
+		url += "/v3"
+	}
+	url += "/auth/tokens"
+	req, err := http.NewRequest("POST", url, bytes.NewReader(b))
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("unexpected status %s from %s", resp.Status, url)
+	}
+	return resp.Header.Get("X-Subject-Token"), nil
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// kafkaSink publishes SEL entries as JSON messages to a Kafka topic, keyed by
+// the target, so that the entries of a target stay in order in one partition.
+// It speaks just enough of the Kafka protocol to look up the partition leader
+// and produce to it, see https://kafka.apache.org/protocol.
+type kafkaSink struct {
+	config KafkaConfig
+}
+
+// Kafka API keys and versions used.
+const (
+	kafkaProduce         = 0
+	kafkaProduceVersion  = 3 // the first version using record batches
+	kafkaMetadata        = 3
+	kafkaMetadataVersion = 1
+)
+
+// kafkaMaxResponseSize is the size of the largest response accepted from a
+// broker. Metadata and produce responses for a single topic and partition
+// are much smaller.
+const kafkaMaxResponseSize = 1 << 20
+
+// kafkaMessage is the value of a message for a SEL entry.
+type kafkaMessage struct {
+	Target string `json:"target"`
+	ID     int    `json:"id"`
+	Time   string `json:"sel_time"`
+	Sensor string `json:"sensor"`
+	Type   string `json:"sensor_type"`
+	State  string `json:"state"`
+	Event  string `json:"event"`
+}
+
+// kafkaBroker is a broker as returned in metadata responses.
+type kafkaBroker struct {
+	id   int32
+	addr string
+}
+
+func (s kafkaSink) name() string {
+	return "kafka"
+}
+
+func (s kafkaSink) send(ctx context.Context, target string, entries []selEntry) error {
+	ctx, cancel := context.WithTimeout(ctx, s.config.Timeout)
+	defer cancel()
+	var values [][]byte
+	for _, e := range entries {
+		v, err := json.Marshal(kafkaMessage{target, e.ID, e.selTimestamp(), e.Name, e.Type, e.State, e.Event})
+		if err != nil {
+			return err
+		}
+		values = append(values, v)
+	}
+
+	key := []byte(target)
+	var (
+		leader    string
+		partition int32
+		err       error
+	)
+	for _, b := range s.config.Brokers {
+		leader, partition, err = s.partitionLeader(ctx, b, key)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return s.produce(ctx, leader, partition, key, values)
+}
+
+// partitionLeader asks broker for the metadata of the topic and returns the
+// address of the leader of the partition key belongs to.
+func (s kafkaSink) partitionLeader(ctx context.Context, broker string, key []byte) (string, int32, error) {
+	var req kafkaEncoder
+	req.array(1)
+	req.string(s.config.Topic)
+	resp, err := s.roundTrip(ctx, broker, kafkaMetadata, kafkaMetadataVersion, req.Bytes())
+	if err != nil {
+		return "", 0, err
+	}
+	return s.parseMetadata(resp, broker, key)
+}
+
+// parseMetadata parses the metadata response resp from broker and returns
+// the address of the leader of the partition key belongs to.
+func (s kafkaSink) parseMetadata(resp *kafkaDecoder, broker string, key []byte) (string, int32, error) {
+	// Node ID, host, port and rack.
+	brokers := make([]kafkaBroker, resp.arrayLen(4+2+4+2))
+	for i := range brokers {
+		brokers[i].id = resp.int32()
+		host := resp.string()
+		port := resp.int32()
+		resp.string() // rack
+		brokers[i].addr = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	resp.int32() // controller ID
+	leaders := make(map[int32]int32)
+	topicError := int16(0)
+	for i := resp.arrayLen(2 + 2 + 1 + 4); i > 0; i-- {
+		topicError = resp.int16()
+		resp.string() // name
+		resp.int8()   // is internal
+		for j := resp.arrayLen(2 + 4 + 4 + 4 + 4); j > 0; j-- {
+			resp.int16() // error code
+			p := resp.int32()
+			leaders[p] = resp.int32()
+			resp.skipInt32Array() // replicas
+			resp.skipInt32Array() // in-sync replicas
+		}
+	}
+	if resp.err != nil {
+		return "", 0, fmt.Errorf("invalid metadata response from %s: %s", broker, resp.err)
+	}
+	if topicError != 0 {
+		return "", 0, fmt.Errorf("error %d getting metadata of topic %s from %s", topicError, s.config.Topic, broker)
+	}
+	if len(leaders) == 0 {
+		return "", 0, fmt.Errorf("no partitions found for topic %s", s.config.Topic)
+	}
+
+	// This is the default partitioner of the Java client, so that consumers
+	// can rely on the same assignment as for other producers.
+	partition := int32(kafkaMurmur2(key)&0x7fffffff) % int32(len(leaders))
+	for _, b := range brokers {
+		if b.id == leaders[partition] {
+			return b.addr, partition, nil
+		}
+	}
+	return "", 0, fmt.Errorf("no leader available for partition %d of topic %s", partition, s.config.Topic)
+}
+
+// produce writes a record batch with values to the partition and waits for
+// all in-sync replicas to acknowledge it.
+func (s kafkaSink) produce(ctx context.Context, broker string, partition int32, key []byte, values [][]byte) error {
+	batch := kafkaRecordBatch(time.Now(), key, values)
+	var req kafkaEncoder
+	req.int16(-1) // no transactional ID
+	req.int16(-1) // acks from all in-sync replicas
+	req.int32(int32(s.config.Timeout / time.Millisecond))
+	req.array(1)
+	req.string(s.config.Topic)
+	req.array(1)
+	req.int32(partition)
+	req.bytes(batch)
+	resp, err := s.roundTrip(ctx, broker, kafkaProduce, kafkaProduceVersion, req.Bytes())
+	if err != nil {
+		return err
+	}
+	return s.parseProduce(resp, broker)
+}
+
+// parseProduce checks the produce response resp from broker for errors.
+func (s kafkaSink) parseProduce(resp *kafkaDecoder, broker string) error {
+	for i := resp.arrayLen(2 + 4); i > 0; i-- {
+		resp.string() // topic
+		for j := resp.arrayLen(4 + 2 + 8 + 8); j > 0; j-- {
+			p := resp.int32()
+			if code := resp.int16(); code != 0 && resp.err == nil {
+				return fmt.Errorf("error %d producing to partition %d of topic %s", code, p, s.config.Topic)
+			}
+			resp.int64() // base offset
+			resp.int64() // log append time
+		}
+	}
+	if resp.err != nil {
+		return fmt.Errorf("invalid produce response from %s: %s", broker, resp.err)
+	}
+	return nil
+}
+
+// roundTrip sends a single request to broker and returns the body of the
+// response.
+func (s kafkaSink) roundTrip(ctx context.Context, broker string, apiKey, apiVersion int16, body []byte) (*kafkaDecoder, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", broker)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	const correlationID = 1
+	var req kafkaEncoder
+	req.int32(0) // size, filled in below
+	req.int16(apiKey)
+	req.int16(apiVersion)
+	req.int32(correlationID)
+	req.string(s.config.ClientID)
+	req.Write(body)
+	b := req.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	if _, err := conn.Write(b); err != nil {
+		return nil, err
+	}
+
+	var size int32
+	if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	if size < 4 || size > kafkaMaxResponseSize {
+		return nil, fmt.Errorf("invalid response size %d from %s", size, broker)
+	}
+	resp := make([]byte, size)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	dec := &kafkaDecoder{buf: resp}
+	if id := dec.int32(); id != correlationID {
+		return nil, fmt.Errorf("unexpected correlation ID %d from %s", id, broker)
+	}
+	return dec, nil
+}
+
+// kafkaRecordBatch encodes values as a record batch of format version 2, all
+// with the same key.
+func kafkaRecordBatch(now time.Time, key []byte, values [][]byte) []byte {
+	timestamp := now.UnixNano() / int64(time.Millisecond)
+
+	// The part of the batch covered by the CRC.
+	var b kafkaEncoder
+	b.int16(0) // attributes: no compression, create time
+	b.int32(int32(len(values) - 1))
+	b.int64(timestamp)
+	b.int64(timestamp)
+	b.int64(-1) // producer ID
+	b.int16(-1) // producer epoch
+	b.int32(-1) // base sequence
+	b.array(len(values))
+	for i, v := range values {
+		var r kafkaEncoder
+		r.WriteByte(0)  // attributes
+		r.varint(0)     // timestamp delta
+		r.varint(i)     // offset delta
+		r.varbytes(key) // key
+		r.varbytes(v)   // value
+		r.varint(0)     // headers
+		b.varint(r.Len())
+		b.Write(r.Bytes())
+	}
+
+	var batch kafkaEncoder
+	batch.int64(0) // base offset, assigned by the broker
+	batch.int32(int32(4 + 1 + 4 + b.Len()))
+	batch.int32(-1) // partition leader epoch
+	batch.WriteByte(2)
+	batch.int32(int32(crc32.Checksum(b.Bytes(), crc32.MakeTable(crc32.Castagnoli))))
+	batch.Write(b.Bytes())
+	return batch.Bytes()
+}
+
+// kafkaMurmur2 is the variant of MurmurHash2 used by Kafka's default
+// partitioner.
+func kafkaMurmur2(data []byte) uint32 {
+	const (
+		seed = 0x9747b28c
+		m    = 0x5bd1e995
+		r    = 24
+	)
+	length := len(data)
+	h := uint32(seed) ^ uint32(length)
+	for i := 0; i+4 <= length; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+	tail := data[length&^3:]
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return h
+}
+
+// kafkaEncoder writes the primitive types of the Kafka protocol.
+type kafkaEncoder struct {
+	bytes.Buffer
+}
+
+func (e *kafkaEncoder) int16(v int16) {
+	binary.Write(e, binary.BigEndian, v)
+}
+
+func (e *kafkaEncoder) int32(v int32) {
+	binary.Write(e, binary.BigEndian, v)
+}
+
+func (e *kafkaEncoder) int64(v int64) {
+	binary.Write(e, binary.BigEndian, v)
+}
+
+func (e *kafkaEncoder) array(n int) {
+	e.int32(int32(n))
+}
+
+func (e *kafkaEncoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.WriteString(s)
+}
+
+func (e *kafkaEncoder) bytes(b []byte) {
+	e.int32(int32(len(b)))
+	e.Write(b)
+}
+
+// varint writes a zigzag encoded variable length integer, as used within
+// records.
+func (e *kafkaEncoder) varint(v int) {
+	var b [binary.MaxVarintLen64]byte
+	e.Write(b[:binary.PutVarint(b[:], int64(v))])
+}
+
+func (e *kafkaEncoder) varbytes(b []byte) {
+	e.varint(len(b))
+	e.Write(b)
+}
+
+// kafkaDecoder reads the primitive types of the Kafka protocol. After the
+// first error, all reads return zero values and err is set.
+type kafkaDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *kafkaDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.buf) {
+		d.err = io.ErrUnexpectedEOF
+		d.buf = nil
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *kafkaDecoder) int8() int8 {
+	if b := d.next(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	if b := d.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	if b := d.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	if b := d.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+// string reads a nullable string, returning "" for null.
+func (d *kafkaDecoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.next(int(n)))
+}
+
+// arrayLen reads the length of an array whose elements take at least
+// minSize bytes each. A null array has length 0. A length the rest of the
+// response cannot hold sets err.
+func (d *kafkaDecoder) arrayLen(minSize int) int {
+	n := int(d.int32())
+	if n < 0 {
+		return 0
+	}
+	if d.err == nil && n > len(d.buf)/minSize {
+		d.err = fmt.Errorf("array of %d elements exceeds the response", n)
+		d.buf = nil
+		return 0
+	}
+	return n
+}
+
+func (d *kafkaDecoder) skipInt32Array() {
+	d.next(4 * d.arrayLen(4))
+}
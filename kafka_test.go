@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestKafkaMurmur2(t *testing.T) {
+	// The test cases of the Java client.
+	tests := map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	}
+	for data, expected := range tests {
+		if h := int32(kafkaMurmur2([]byte(data))); h != expected {
+			t.Errorf("%q: expected %d, got %d", data, expected, h)
+		}
+	}
+}
+
+// decodeRecordBatch decodes a record batch as written by kafkaRecordBatch and
+// returns the keys and values of its records.
+func decodeRecordBatch(t *testing.T, batch []byte) ([]string, []string) {
+	t.Helper()
+	d := &kafkaDecoder{buf: batch}
+	d.int64() // base offset
+	if length := d.int32(); int(length) != len(d.buf) {
+		t.Fatalf("batch length %d does not match the %d bytes following it", length, len(d.buf))
+	}
+	d.int32() // partition leader epoch
+	if magic := d.int8(); magic != 2 {
+		t.Fatalf("expected magic 2, got %d", magic)
+	}
+	crc := uint32(d.int32())
+	if expected := crc32.Checksum(d.buf, crc32.MakeTable(crc32.Castagnoli)); crc != expected {
+		t.Fatalf("expected CRC %x, got %x", expected, crc)
+	}
+	d.int16() // attributes
+	lastOffsetDelta := d.int32()
+	d.int64() // first timestamp
+	d.int64() // max timestamp
+	d.int64() // producer ID
+	d.int16() // producer epoch
+	d.int32() // base sequence
+	n := int(d.int32())
+	if int(lastOffsetDelta) != n-1 {
+		t.Errorf("last offset delta %d does not match %d records", lastOffsetDelta, n)
+	}
+	varint := func() int {
+		v, size := binary.Varint(d.buf)
+		if size <= 0 {
+			t.Fatal("invalid varint")
+		}
+		d.buf = d.buf[size:]
+		return int(v)
+	}
+	var keys, values []string
+	for i := 0; i < n; i++ {
+		length := varint()
+		rest := len(d.buf)
+		d.int8() // attributes
+		varint() // timestamp delta
+		if delta := varint(); delta != i {
+			t.Errorf("record %d has offset delta %d", i, delta)
+		}
+		keys = append(keys, string(d.next(varint())))
+		values = append(values, string(d.next(varint())))
+		if headers := varint(); headers != 0 {
+			t.Errorf("record %d has %d headers", i, headers)
+		}
+		if rest-len(d.buf) != length {
+			t.Errorf("record %d has length %d, but takes %d bytes", i, length, rest-len(d.buf))
+		}
+	}
+	if d.err != nil {
+		t.Fatal(d.err)
+	}
+	if len(d.buf) != 0 {
+		t.Errorf("%d bytes left after the records", len(d.buf))
+	}
+	return keys, values
+}
+
+func TestKafkaRecordBatch(t *testing.T) {
+	batch := kafkaRecordBatch(time.Unix(1700000000, 0), []byte("node1"), [][]byte{[]byte("one"), []byte("two")})
+	keys, values := decodeRecordBatch(t, batch)
+	if len(keys) != 2 || keys[0] != "node1" || keys[1] != "node1" {
+		t.Errorf("unexpected keys %q", keys)
+	}
+	if len(values) != 2 || values[0] != "one" || values[1] != "two" {
+		t.Errorf("unexpected values %q", values)
+	}
+}
+
+// fakeKafkaBroker answers requests with handle, which gets the API key and
+// the request body and returns the response body.
+func fakeKafkaBroker(t *testing.T, handle func(apiKey int16, body *kafkaDecoder) []byte) (string, func()) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			var size int32
+			if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+				conn.Close()
+				continue
+			}
+			req := make([]byte, size)
+			if _, err := io.ReadFull(conn, req); err != nil {
+				conn.Close()
+				continue
+			}
+			d := &kafkaDecoder{buf: req}
+			apiKey := d.int16()
+			d.int16() // API version
+			correlationID := d.int32()
+			d.string() // client ID
+			var resp kafkaEncoder
+			resp.int32(correlationID)
+			resp.Write(handle(apiKey, d))
+			binary.Write(conn, binary.BigEndian, int32(resp.Len()))
+			conn.Write(resp.Bytes())
+			conn.Close()
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
+
+// kafkaMetadataResponse returns a metadata response with the broker at addr
+// as leader of the only partition of topic.
+func kafkaMetadataResponse(t *testing.T, addr, topic string) []byte {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := strconv.Atoi(port)
+	var resp kafkaEncoder
+	resp.array(1)
+	resp.int32(1) // node ID
+	resp.string(host)
+	resp.int32(int32(p))
+	resp.int16(-1) // rack
+	resp.int32(1)  // controller ID
+	resp.array(1)
+	resp.int16(0) // error code
+	resp.string(topic)
+	resp.WriteByte(0) // is internal
+	resp.array(1)
+	resp.int16(0) // error code
+	resp.int32(0) // partition
+	resp.int32(1) // leader
+	resp.array(1)
+	resp.int32(1) // replicas
+	resp.array(1)
+	resp.int32(1) // in-sync replicas
+	return resp.Bytes()
+}
+
+func TestKafkaSend(t *testing.T) {
+	var (
+		addr     string
+		produced []string
+	)
+	addr, stop := fakeKafkaBroker(t, func(apiKey int16, body *kafkaDecoder) []byte {
+		switch apiKey {
+		case kafkaMetadata:
+			if n := body.int32(); n != 1 {
+				t.Errorf("expected metadata of one topic, got %d", n)
+			}
+			if topic := body.string(); topic != "ipmi-sel" {
+				t.Errorf("expected metadata of topic ipmi-sel, got %q", topic)
+			}
+			return kafkaMetadataResponse(t, addr, "ipmi-sel")
+		case kafkaProduce:
+			body.int16() // transactional ID
+			if acks := body.int16(); acks != -1 {
+				t.Errorf("expected acks -1, got %d", acks)
+			}
+			body.int32() // timeout
+			body.int32() // topics
+			if topic := body.string(); topic != "ipmi-sel" {
+				t.Errorf("expected to produce to topic ipmi-sel, got %q", topic)
+			}
+			body.int32() // partitions
+			if p := body.int32(); p != 0 {
+				t.Errorf("expected to produce to partition 0, got %d", p)
+			}
+			_, produced = decodeRecordBatch(t, body.next(int(body.int32())))
+			var resp kafkaEncoder
+			resp.array(1)
+			resp.string("ipmi-sel")
+			resp.array(1)
+			resp.int32(0)  // partition
+			resp.int16(0)  // error code
+			resp.int64(42) // base offset
+			resp.int64(-1) // log append time
+			resp.int32(0)  // throttle time
+			return resp.Bytes()
+		}
+		t.Errorf("unexpected API key %d", apiKey)
+		return nil
+	})
+	defer stop()
+
+	s := kafkaSink{KafkaConfig{Brokers: []string{addr}, Topic: "ipmi-sel", ClientID: "test", Timeout: 5 * time.Second}}
+	err := s.send(context.Background(), "node1", []selEntry{{ID: 7, Name: "PS 1", State: "Critical", Event: "Power Supply AC lost"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(produced) != 1 {
+		t.Fatalf("expected one message, got %d", len(produced))
+	}
+	var msg kafkaMessage
+	if err := json.Unmarshal([]byte(produced[0]), &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Target != "node1" || msg.ID != 7 || msg.Event != "Power Supply AC lost" {
+		t.Errorf("unexpected message %+v", msg)
+	}
+}
+
+func TestKafkaMalformedMetadata(t *testing.T) {
+	s := kafkaSink{KafkaConfig{Topic: "ipmi-sel"}}
+	tests := map[string]func(e *kafkaEncoder){
+		"negative broker count": func(e *kafkaEncoder) { e.int32(-5) },
+		"huge broker count":     func(e *kafkaEncoder) { e.int32(0x7fffffff) },
+		"huge partition count": func(e *kafkaEncoder) {
+			e.array(0)
+			e.int32(1) // controller ID
+			e.array(1)
+			e.int16(0)
+			e.string("ipmi-sel")
+			e.WriteByte(0)
+			e.int32(100000)
+		},
+		"huge replica count": func(e *kafkaEncoder) {
+			e.array(0)
+			e.int32(1) // controller ID
+			e.array(1)
+			e.int16(0)
+			e.string("ipmi-sel")
+			e.WriteByte(0)
+			e.array(1)
+			e.int16(0)
+			e.int32(0)
+			e.int32(1)
+			e.int32(0x7fffffff)
+		},
+		"truncated": func(e *kafkaEncoder) { e.int16(1) },
+	}
+	for name, encode := range tests {
+		var e kafkaEncoder
+		encode(&e)
+		if _, _, err := s.parseMetadata(&kafkaDecoder{buf: e.Bytes()}, "broker", []byte("node1")); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestKafkaOversizedResponse(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		binary.Write(conn, binary.BigEndian, int32(0x7fffffff))
+	}()
+	s := kafkaSink{KafkaConfig{Topic: "ipmi-sel", Timeout: 5 * time.Second}}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := s.roundTrip(ctx, l.Addr().String(), kafkaMetadata, kafkaMetadataVersion, nil); err == nil {
+		t.Error("expected an error for a response of 2 GiB")
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// kubernetesServiceAccountDir holds the credentials Kubernetes provides to
+// pods, see
+// https://kubernetes.io/docs/tasks/run-application/access-api-from-pod/.
+const kubernetesServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubernetesDiscoverer discovers targets from ConfigMaps selected by a label
+// selector, watching them for changes. Each data entry of a ConfigMap is a
+// target, see kubernetesTarget.
+type kubernetesDiscoverer struct {
+	config KubernetesConfig
+	*kubernetesClient
+	// resourceVersion is the version of the last list of ConfigMaps.
+	resourceVersion string
+}
+
+// kubernetesClient accesses the Kubernetes API server with the service
+// account of the pod.
+type kubernetesClient struct {
+	client *http.Client
+	server string
+	// tokenFile is read for every request, as the kubelet rotates
+	// projected service account tokens.
+	tokenFile string
+	namespace string
+}
+
+// kubernetesTarget is the format of a target in a ConfigMap.
+type kubernetesTarget struct {
+	Address string `yaml:"address"`
+	// Credentials is the name of an entry in the credentials section.
+	Credentials string `yaml:"credentials"`
+	// CredentialsSecret is the name of a Secret in the same namespace with
+	// the keys user and pass.
+	CredentialsSecret string            `yaml:"credentials_secret"`
+	Labels            map[string]string `yaml:"labels"`
+}
+
+type kubernetesObjectMeta struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace"`
+	ResourceVersion string `json:"resourceVersion"`
+}
+
+type kubernetesConfigMapList struct {
+	Metadata kubernetesObjectMeta `json:"metadata"`
+	Items    []struct {
+		Metadata kubernetesObjectMeta `json:"metadata"`
+		Data     map[string]string    `json:"data"`
+	} `json:"items"`
+}
+
+type kubernetesSecret struct {
+	Data map[string][]byte `json:"data"`
+}
+
+// newKubernetesClient sets up a client from the service account of the pod.
+// If namespace is empty, the pod's own namespace is used.
+func newKubernetesClient(namespace string) (*kubernetesClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a Kubernetes cluster")
+	}
+	tokenFile := kubernetesServiceAccountDir + "/token"
+	if _, err := readKubernetesToken(tokenFile); err != nil {
+		return nil, err
+	}
+	ca, err := ioutil.ReadFile(kubernetesServiceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in %s/ca.crt", kubernetesServiceAccountDir)
+	}
+	if namespace == "" {
+		ns, err := ioutil.ReadFile(kubernetesServiceAccountDir + "/namespace")
+		if err != nil {
+			return nil, err
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+	return &kubernetesClient{
+		client:    &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}},
+		server:    "https://" + net.JoinHostPort(host, port),
+		tokenFile: tokenFile,
+		namespace: namespace,
+	}, nil
+}
+
+func readKubernetesToken(file string) (string, error) {
+	token, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(token)), nil
+}
+
+// watches reports whether the next call blocks until a ConfigMap changes,
+// which requires the resource version of a previous list.
+func (d *kubernetesDiscoverer) watches() bool {
+	return d.resourceVersion != ""
+}
+
+func (d *kubernetesDiscoverer) discover(ctx context.Context) (map[string]Target, error) {
+	if d.kubernetesClient == nil {
+		c, err := newKubernetesClient(d.config.Namespace)
+		if err != nil {
+			return nil, err
+		}
+		d.kubernetesClient = c
+	}
+	if d.resourceVersion != "" {
+		err := d.waitForChange(ctx)
+		// The ConfigMaps have changed or the watch failed, so the resource
+		// version is outdated either way. If listing them fails below, the
+		// next call has to list them right away instead of watching again.
+		d.resourceVersion = ""
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var list kubernetesConfigMapList
+	query := url.Values{"labelSelector": {d.config.LabelSelector}}
+	if err := d.get(ctx, d.configMapsPath()+"?"+query.Encode(), &list); err != nil {
+		return nil, err
+	}
+	targets := make(map[string]Target)
+	for _, cm := range list.Items {
+		for name, value := range cm.Data {
+			var kt kubernetesTarget
+			if err := yaml.Unmarshal([]byte(value), &kt); err != nil {
+				return nil, fmt.Errorf("invalid target %s in ConfigMap %s: %s", name, cm.Metadata.Name, err)
+			}
+			if kt.Address == "" {
+				return nil, fmt.Errorf("no address given for target %s in ConfigMap %s", name, cm.Metadata.Name)
+			}
+			t := Target{
+				Address:     kt.Address,
+				Credentials: kt.Credentials,
+				Labels:      kt.Labels,
+			}
+			if kt.CredentialsSecret != "" {
+				var secret kubernetesSecret
+				path := fmt.Sprintf("/api/v1/namespaces/%s/secrets/%s", url.PathEscape(d.namespace), url.PathEscape(kt.CredentialsSecret))
+				if err := d.get(ctx, path, &secret); err != nil {
+					return nil, fmt.Errorf("error reading credentials of target %s: %s", name, err)
+				}
+				t.discoveredCredentials = &Credentials{
+					User:     string(secret.Data["user"]),
+					Password: string(secret.Data["pass"]),
+				}
+			}
+			targets[name] = t
+		}
+	}
+	d.resourceVersion = list.Metadata.ResourceVersion
+	return targets, nil
+}
+
+func (d *kubernetesDiscoverer) configMapsPath() string {
+	return fmt.Sprintf("/api/v1/namespaces/%s/configmaps", url.PathEscape(d.namespace))
+}
+
+// waitForChange watches the selected ConfigMaps and returns on the first
+// change, or shortly before ctx expires.
+func (d *kubernetesDiscoverer) waitForChange(ctx context.Context) error {
+	timeout := 5 * time.Minute
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Duration(float64(time.Until(deadline)) * 0.9)
+	}
+	query := url.Values{
+		"labelSelector":   {d.config.LabelSelector},
+		"watch":           {"true"},
+		"resourceVersion": {d.resourceVersion},
+		"timeoutSeconds":  {strconv.Itoa(int(timeout.Seconds()))},
+	}
+	resp, err := d.do(ctx, "GET", d.configMapsPath()+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Any event, including an error because the resource version is too
+	// old, means the ConfigMaps need to be listed again.
+	bufio.NewReader(resp.Body).ReadString('\n')
+	return nil
+}
+
+func (c *kubernetesClient) get(ctx context.Context, path string, v interface{}) error {
+	resp, err := c.do(ctx, "GET", path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// kubernetesStatusError is returned for responses with an unexpected status.
+type kubernetesStatusError struct {
+	path string
+	code int
+}
+
+func (e kubernetesStatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d %s from %s", e.code, http.StatusText(e.code), e.path)
+}
+
+// do sends a request with body encoded as JSON, unless it is nil. Responses
+// with a status other than 200 or 201 are returned as kubernetesStatusError.
+func (c *kubernetesClient) do(ctx context.Context, method, path string, body interface{}) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.server+path, r)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	token, err := readKubernetesToken(c.tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		resp.Body.Close()
+		return nil, kubernetesStatusError{path: path, code: resp.StatusCode}
+	}
+	return resp, nil
+}
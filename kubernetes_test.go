@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// testKubernetesClient returns a client for the API served by srv in the
+// namespace "ipmi" and a function removing its token file.
+func testKubernetesClient(t *testing.T, srv *httptest.Server) (*kubernetesClient, func()) {
+	t.Helper()
+	tokenFile, err := ioutil.TempFile("", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenFile.WriteString("secret")
+	tokenFile.Close()
+	client := &kubernetesClient{client: srv.Client(), server: srv.URL, tokenFile: tokenFile.Name(), namespace: "ipmi"}
+	return client, func() { os.Remove(tokenFile.Name()) }
+}
+
+func TestKubernetesDiscoveryErrorAfterChange(t *testing.T) {
+	tests := map[string]func(w http.ResponseWriter, r *http.Request){
+		"list": func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		},
+		"secret": func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/api/v1/namespaces/ipmi/configmaps" {
+				w.Write([]byte(`{"metadata": {"resourceVersion": "2"}, "items": [{"metadata": {"name": "targets"}, "data": {"node1": "address: 10.0.0.1\ncredentials_secret: node1"}}]}`))
+				return
+			}
+			http.Error(w, "forbidden", http.StatusForbidden)
+		},
+	}
+	for name, handle := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Query().Get("watch") == "true" {
+				w.Write([]byte(`{"type": "MODIFIED"}` + "\n"))
+				return
+			}
+			handle(w, r)
+		}))
+		client, cleanup := testKubernetesClient(t, srv)
+		d := &kubernetesDiscoverer{kubernetesClient: client, resourceVersion: "1"}
+		if _, err := d.discover(context.Background()); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+		if d.watches() {
+			t.Errorf("%s: expected the next call to list the ConfigMaps without watching", name)
+		}
+		cleanup()
+		srv.Close()
+	}
+}
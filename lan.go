@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Parameters of the Get LAN Configuration Parameters command, see section
+// 23.2 of the IPMI specification.
+const (
+	netFnTransport         = 0x0c
+	cmdGetLANConfigParams  = 0x02
+	lanParamIPAddress      = 3
+	lanParamIPSource       = 4
+	lanParamMACAddress     = 5
+	lanParamVLANID         = 20
+	lanVLANEnabledBit      = 0x80
+	lanVLANIDHighBitsMask  = 0x0f
+	lanIPSourceStatic      = 1
+	lanIPSourceDHCP        = 2
+	lanIPSourceBIOS        = 3
+	lanIPSourceOther       = 4
+	lanIPSourceMask        = 0x0f
+	lanConfigParamRevision = 1
+)
+
+var bmcLANInfoDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, "bmc", "lan_info"),
+	"Constant metric with value '1' providing details about the LAN configuration of the BMC.",
+	[]string{"channel", "mac_address", "ip_address", "ip_source", "vlan_id"},
+	nil,
+)
+
+type lanInfoData struct {
+	MACAddress string
+	IPAddress  string
+	IPSource   string
+	// VLANID is empty if no VLAN is configured.
+	VLANID string
+}
+
+// getLANParam returns the data of a LAN configuration parameter of channel,
+// without the parameter revision.
+func (c collector) getLANParam(ctx context.Context, creds Credentials, channel, param uint8) ([]byte, error) {
+	resp, err := rawCommand(ctx, c.getExecutor(), c.target, creds.User, creds.Password, rawRequest{
+		NetFn:   netFnTransport,
+		Command: cmdGetLANConfigParams,
+		Data:    []byte{channel, param, 0, 0},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < lanConfigParamRevision {
+		return nil, &parseError{fmt.Errorf("empty response for LAN parameter %d", param)}
+	}
+	return resp[lanConfigParamRevision:], nil
+}
+
+func (c collector) getLANInfo(ctx context.Context, creds Credentials, channel uint8) (lanInfoData, error) {
+	var info lanInfoData
+
+	mac, err := c.getLANParam(ctx, creds, channel, lanParamMACAddress)
+	if err != nil {
+		return info, err
+	}
+	if len(mac) < 6 {
+		return info, &parseError{fmt.Errorf("MAC address too short: %x", mac)}
+	}
+	info.MACAddress = net.HardwareAddr(mac[:6]).String()
+
+	ip, err := c.getLANParam(ctx, creds, channel, lanParamIPAddress)
+	if err != nil {
+		return info, err
+	}
+	if len(ip) < 4 {
+		return info, &parseError{fmt.Errorf("IP address too short: %x", ip)}
+	}
+	info.IPAddress = net.IP(ip[:4]).String()
+
+	source, err := c.getLANParam(ctx, creds, channel, lanParamIPSource)
+	if err != nil {
+		return info, err
+	}
+	if len(source) < 1 {
+		return info, &parseError{fmt.Errorf("IP address source missing")}
+	}
+	switch source[0] & lanIPSourceMask {
+	case lanIPSourceStatic:
+		info.IPSource = "static"
+	case lanIPSourceDHCP:
+		info.IPSource = "dhcp"
+	case lanIPSourceBIOS:
+		info.IPSource = "bios"
+	case lanIPSourceOther:
+		info.IPSource = "other"
+	default:
+		info.IPSource = "unspecified"
+	}
+
+	vlan, err := c.getLANParam(ctx, creds, channel, lanParamVLANID)
+	if err != nil {
+		// The VLAN parameter is optional, so BMCs without VLAN support
+		// reject it.
+		if _, ok := err.(*rawCompletionError); !ok {
+			return info, err
+		}
+	} else if len(vlan) >= 2 && vlan[1]&lanVLANEnabledBit != 0 {
+		id := int(vlan[1]&lanVLANIDHighBitsMask)<<8 | int(vlan[0])
+		info.VLANID = strconv.Itoa(id)
+	}
+	return info, nil
+}
+
+func lanInfoEnabled(config *SafeConfig) bool {
+	return config.LANChannel() != 0
+}
+
+func (c collector) collectLANInfo(ctx context.Context, ch chan<- prometheus.Metric, creds Credentials) error {
+	channel := c.config.LANChannel()
+	info, err := c.getLANInfo(ctx, creds, channel)
+	if err != nil {
+		return err
+	}
+	ch <- prometheus.MustNewConstMetric(
+		bmcLANInfoDesc,
+		prometheus.GaugeValue,
+		1,
+		strconv.Itoa(int(channel)), info.MACAddress, info.IPAddress, info.IPSource, info.VLANID,
+	)
+	return nil
+}
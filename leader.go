@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// kubernetesMicroTime is the format of timestamps in a Lease.
+const kubernetesMicroTime = "2006-01-02T15:04:05.000000Z07:00"
+
+var (
+	agentLeader = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace + "_exporter",
+			Name:      "agent_leader",
+			Help:      "'1' if this instance holds the leader election lease and scrapes in agent mode, '0' otherwise.",
+		},
+	)
+
+	// leading is 1 while this instance holds the lease.
+	leading int32
+)
+
+type kubernetesLease struct {
+	APIVersion string               `json:"apiVersion"`
+	Kind       string               `json:"kind"`
+	Metadata   kubernetesObjectMeta `json:"metadata"`
+	Spec       struct {
+		HolderIdentity       string `json:"holderIdentity,omitempty"`
+		LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+		AcquireTime          string `json:"acquireTime,omitempty"`
+		RenewTime            string `json:"renewTime,omitempty"`
+		LeaseTransitions     int    `json:"leaseTransitions"`
+	} `json:"spec"`
+}
+
+// isLeader reports whether this instance may scrape in agent mode, which is
+// the case if leader election is disabled or this instance holds the lease.
+func isLeader(config *SafeConfig) bool {
+	if config.Agent().LeaderElection.LeaseName == "" {
+		return true
+	}
+	return atomic.LoadInt32(&leading) == 1
+}
+
+// runLeaderElection tries to acquire and then keeps renewing the configured
+// Lease. It never returns; while leader election is not configured, it only
+// watches for config changes.
+func runLeaderElection(config *SafeConfig) {
+	identity, err := os.Hostname()
+	if err != nil {
+		log.Fatalf("Error determining identity for leader election: %s", err)
+	}
+	var (
+		client    *kubernetesClient
+		clientFor string // namespace setting the client was created for
+		lastRenew time.Time
+	)
+	for {
+		cfg := config.Agent().LeaderElection
+		if cfg.LeaseName == "" {
+			setLeading(false)
+			time.Sleep(10 * time.Second)
+			continue
+		}
+		if client == nil || clientFor != cfg.Namespace {
+			client, err = newKubernetesClient(cfg.Namespace)
+			if err != nil {
+				log.Errorf("Error setting up leader election: %s", err)
+				time.Sleep(cfg.RetryPeriod)
+				continue
+			}
+			clientFor = cfg.Namespace
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.RetryPeriod)
+		acquired, err := tryAcquireLease(ctx, client, cfg, identity)
+		cancel()
+		if err != nil {
+			log.Errorf("Error renewing leader election lease %s: %s", cfg.LeaseName, err)
+		}
+		switch {
+		case acquired:
+			lastRenew = time.Now()
+			setLeading(true)
+		case err == nil || time.Since(lastRenew) > cfg.LeaseDuration*2/3:
+			// Someone else holds the lease, or it could not be renewed for
+			// so long that someone else might have taken it over.
+			setLeading(false)
+		}
+		time.Sleep(cfg.RetryPeriod)
+	}
+}
+
+func setLeading(l bool) {
+	var v int32
+	if l {
+		v = 1
+	}
+	if atomic.SwapInt32(&leading, v) != v {
+		if l {
+			log.Infoln("Became leader, scraping in agent mode")
+		} else {
+			log.Infoln("Lost leadership, not scraping in agent mode")
+		}
+	}
+	agentLeader.Set(float64(v))
+}
+
+// tryAcquireLease creates, renews or takes over the Lease. It returns false
+// if another instance holds it.
+func tryAcquireLease(ctx context.Context, client *kubernetesClient, cfg LeaderElectionConfig, identity string) (bool, error) {
+	path := fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%s/leases", url.PathEscape(client.namespace))
+	now := time.Now()
+
+	var lease kubernetesLease
+	err := client.get(ctx, path+"/"+url.PathEscape(cfg.LeaseName), &lease)
+	if e, ok := err.(kubernetesStatusError); ok && e.code == 404 {
+		lease.APIVersion = "coordination.k8s.io/v1"
+		lease.Kind = "Lease"
+		lease.Metadata.Name = cfg.LeaseName
+		lease.Metadata.Namespace = client.namespace
+		lease.Spec.HolderIdentity = identity
+		lease.Spec.LeaseDurationSeconds = int(cfg.LeaseDuration.Seconds())
+		lease.Spec.AcquireTime = now.UTC().Format(kubernetesMicroTime)
+		lease.Spec.RenewTime = lease.Spec.AcquireTime
+		return leaseRequest(ctx, client, "POST", path, &lease)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if lease.Spec.HolderIdentity != identity {
+		renewed, err := time.Parse(kubernetesMicroTime, lease.Spec.RenewTime)
+		expiry := renewed.Add(time.Duration(lease.Spec.LeaseDurationSeconds) * time.Second)
+		if lease.Spec.HolderIdentity != "" && err == nil && now.Before(expiry) {
+			return false, nil
+		}
+		lease.Spec.HolderIdentity = identity
+		lease.Spec.AcquireTime = now.UTC().Format(kubernetesMicroTime)
+		lease.Spec.LeaseTransitions++
+	}
+	lease.Spec.LeaseDurationSeconds = int(cfg.LeaseDuration.Seconds())
+	lease.Spec.RenewTime = now.UTC().Format(kubernetesMicroTime)
+	// The resource version in the metadata makes the update fail if someone
+	// else updated the lease in the meantime.
+	return leaseRequest(ctx, client, "PUT", path+"/"+url.PathEscape(cfg.LeaseName), &lease)
+}
+
+// leaseRequest creates or updates a Lease. A conflict means another instance
+// was faster and is not an error.
+func leaseRequest(ctx context.Context, client *kubernetesClient, method, path string, lease *kubernetesLease) (bool, error) {
+	resp, err := client.do(ctx, method, path, lease)
+	if e, ok := err.(kubernetesStatusError); ok && e.code == 409 {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return true, nil
+}
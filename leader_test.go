@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTryAcquireLease(t *testing.T) {
+	cfg := LeaderElectionConfig{LeaseName: "ipmi-exporter", LeaseDuration: 15 * time.Second, RetryPeriod: 2 * time.Second}
+	leasePath := "/apis/coordination.k8s.io/v1/namespaces/ipmi/leases/ipmi-exporter"
+	lease := func(holder string, renewed time.Time, transitions int) *kubernetesLease {
+		l := &kubernetesLease{}
+		l.Metadata.Name = "ipmi-exporter"
+		l.Spec.HolderIdentity = holder
+		l.Spec.LeaseDurationSeconds = 15
+		l.Spec.RenewTime = renewed.UTC().Format(kubernetesMicroTime)
+		l.Spec.LeaseTransitions = transitions
+		return l
+	}
+
+	tests := map[string]struct {
+		existing *kubernetesLease
+		// status is the status of the create or update request.
+		status   int
+		acquired bool
+		// method and holder are those of the create or update request, if
+		// one is expected.
+		method      string
+		holder      string
+		transitions int
+	}{
+		"create": {
+			status:   http.StatusCreated,
+			acquired: true,
+			method:   "POST",
+			holder:   "node-a",
+		},
+		"renew": {
+			existing:    lease("node-a", time.Now().Add(-5*time.Second), 1),
+			status:      http.StatusOK,
+			acquired:    true,
+			method:      "PUT",
+			holder:      "node-a",
+			transitions: 1,
+		},
+		"held by another instance": {
+			existing: lease("node-b", time.Now().Add(-5*time.Second), 1),
+		},
+		"take over expired lease": {
+			existing:    lease("node-b", time.Now().Add(-time.Minute), 1),
+			status:      http.StatusOK,
+			acquired:    true,
+			method:      "PUT",
+			holder:      "node-a",
+			transitions: 2,
+		},
+		"conflict": {
+			existing:    lease("node-b", time.Now().Add(-time.Minute), 1),
+			status:      http.StatusConflict,
+			method:      "PUT",
+			holder:      "node-a",
+			transitions: 2,
+		},
+	}
+	for name, test := range tests {
+		var (
+			method string
+			sent   kubernetesLease
+		)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "GET" {
+				if r.URL.Path != leasePath || test.existing == nil {
+					http.Error(w, "not found", http.StatusNotFound)
+					return
+				}
+				json.NewEncoder(w).Encode(test.existing)
+				return
+			}
+			method = r.Method
+			json.NewDecoder(r.Body).Decode(&sent)
+			w.WriteHeader(test.status)
+			w.Write([]byte("{}"))
+		}))
+		client, cleanup := testKubernetesClient(t, srv)
+
+		acquired, err := tryAcquireLease(context.Background(), client, cfg, "node-a")
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", name, err)
+		}
+		if acquired != test.acquired {
+			t.Errorf("%s: expected acquired %v, got %v", name, test.acquired, acquired)
+		}
+		if method != test.method {
+			t.Errorf("%s: expected request %q, got %q", name, test.method, method)
+		}
+		if test.method != "" {
+			if sent.Spec.HolderIdentity != test.holder || sent.Spec.LeaseTransitions != test.transitions {
+				t.Errorf("%s: expected holder %s with %d transitions, got %s with %d", name, test.holder, test.transitions, sent.Spec.HolderIdentity, sent.Spec.LeaseTransitions)
+			}
+			if sent.Spec.LeaseDurationSeconds != 15 {
+				t.Errorf("%s: expected a lease duration of 15s, got %ds", name, sent.Spec.LeaseDurationSeconds)
+			}
+		}
+		cleanup()
+		srv.Close()
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"syscall"
+)
+
+// limitedArgv returns the command line that runs argv with the limits of cfg
+// in place from its first instruction on. The exporter binary is run again as
+// a helper that applies the limits to itself, changes its root to chroot, if
+// set, and then replaces itself with argv, so that the limits also cover a
+// command wrapper and everything it starts.
+func limitedArgv(argv []string, cfg ResourceLimitsConfig, chroot string) ([]string, error) {
+	if chroot != "" && !filepath.IsAbs(argv[0]) {
+		return nil, fmt.Errorf("running %s in a chroot requires an absolute path", argv[0])
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("cannot find the exporter binary to apply resource limits: %s", err)
+	}
+	var cpuSeconds uint64
+	if cfg.CPUTime > 0 {
+		cpuSeconds = uint64(cfg.CPUTime.Seconds())
+		if cpuSeconds == 0 {
+			cpuSeconds = 1
+		}
+	}
+	result := []string{
+		self, limitedExecArg,
+		strconv.Itoa(cfg.Nice),
+		strconv.FormatUint(cpuSeconds, 10),
+		strconv.FormatInt(cfg.MaxMemoryBytes, 10),
+		chroot,
+		"--",
+	}
+	return append(result, argv...), nil
+}
+
+// runLimited is the helper started with the command line built by
+// limitedArgv. It does not return: it either executes the command or exits
+// with an error, which makes the command fail.
+func runLimited(args []string) {
+	if err := execLimited(args); err != nil {
+		fmt.Fprintf(os.Stderr, "Error applying resource limits: %s\n", err)
+		os.Exit(126)
+	}
+}
+
+func execLimited(args []string) error {
+	if len(args) < 6 || args[4] != "--" {
+		return fmt.Errorf("invalid arguments %q", args)
+	}
+	nice, err := strconv.Atoi(args[0])
+	if err != nil {
+		return err
+	}
+	cpuSeconds, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return err
+	}
+	maxMemory, err := strconv.ParseUint(args[2], 10, 64)
+	if err != nil {
+		return err
+	}
+	chroot, argv := args[3], args[5:]
+
+	// The niceness is a property of the thread on Linux, so it has to be set
+	// on the thread that executes the command.
+	runtime.LockOSThread()
+	if nice != 0 {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, nice); err != nil {
+			return fmt.Errorf("setting niceness %d: %s", nice, err)
+		}
+	}
+	if cpuSeconds > 0 {
+		if err := syscall.Setrlimit(syscall.RLIMIT_CPU, &syscall.Rlimit{Cur: cpuSeconds, Max: cpuSeconds}); err != nil {
+			return fmt.Errorf("limiting CPU time: %s", err)
+		}
+	}
+	if chroot != "" {
+		if err := syscall.Chroot(chroot); err != nil {
+			return fmt.Errorf("changing root to %s: %s", chroot, err)
+		}
+		if err := os.Chdir("/"); err != nil {
+			return err
+		}
+	}
+	cmd, err := exec.LookPath(argv[0])
+	if err != nil {
+		return err
+	}
+	// The address space is limited last, as the limit applies to the helper
+	// as well until the command is executed.
+	if maxMemory > 0 {
+		if err := syscall.Setrlimit(syscall.RLIMIT_AS, &syscall.Rlimit{Cur: maxMemory, Max: maxMemory}); err != nil {
+			return fmt.Errorf("limiting address space: %s", err)
+		}
+	}
+	return syscall.Exec(cmd, argv, os.Environ())
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+var errLimitsUnsupported = errors.New("resource limits are only supported on Linux")
+
+// limitedArgv returns the command line that runs argv with the limits of cfg
+// in place from its first instruction on.
+func limitedArgv(argv []string, cfg ResourceLimitsConfig, chroot string) ([]string, error) {
+	return nil, errLimitsUnsupported
+}
+
+// runLimited is the helper started with the command line built by
+// limitedArgv.
+func runLimited(args []string) {
+	fmt.Fprintf(os.Stderr, "Error applying resource limits: %s\n", errLimitsUnsupported)
+	os.Exit(126)
+}
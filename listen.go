@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strings"
+)
+
+// stringSlice is a flag.Value collecting the values of a repeated flag.
+type stringSlice []string
+
+func (s *stringSlice) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringSlice) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// listen listens on address, which is either a TCP address or a unix socket
+// path given as unix:///path/to.sock.
+func listen(address string) (net.Listener, error) {
+	if !strings.HasPrefix(address, "unix://") {
+		return net.Listen("tcp", address)
+	}
+	path := strings.TrimPrefix(address, "unix://")
+	// Remove a stale socket left behind by a previous run.
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/prometheus/common/log"
+)
+
+// setupLogging configures the level and format of the exporter's log.
+func setupLogging(level, format string) error {
+	if err := log.Base().SetLevel(level); err != nil {
+		return err
+	}
+	switch format {
+	case "logfmt":
+	case "json":
+		if err := log.Base().SetFormat("logger:stderr?json=true"); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported log format %q", format)
+	}
+	return nil
+}
@@ -3,14 +3,18 @@ package main
 import (
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/version"
 )
 
 var (
@@ -23,10 +27,104 @@ var (
 		"path", "",
 		"Path to FreeIPMI executables (default: rely on $PATH).",
 	)
-	listenAddress = flag.String(
-		"web.listen-address", ":9290",
-		"Address to listen on for web interface and telemetry.",
+	adminListenAddress = flag.String(
+		"web.admin-listen-address", "",
+		"Address to listen on for admin and debug endpoints (default: same as web.listen-address).",
 	)
+	logLevel = flag.String(
+		"log.level", "info",
+		"Only log messages with the given severity or above, one of 'debug', 'info', 'warn', 'error' or 'fatal'.",
+	)
+	logFormat = flag.String(
+		"log.format", "logfmt",
+		"Format of the log, either 'logfmt' or 'json'.",
+	)
+	accessLogFormat = flag.String(
+		"web.access-log-format", "",
+		"Format of the access log, either 'logfmt' or 'json' (default: no access log).",
+	)
+	maxProcesses = flag.Int(
+		"freeipmi.max-processes", 0,
+		"Maximum number of FreeIPMI processes running at the same time (default: no limit).",
+	)
+	replayDir = flag.String(
+		"freeipmi.replay-dir", "",
+		"Replay FreeIPMI outputs recorded in <command>.out files in this directory instead of running FreeIPMI (for debugging).",
+	)
+	durationHistogram = flag.Bool(
+		"web.scrape-duration-histogram", false,
+		"Export a histogram of the durations of all scrapes on /metrics.",
+	)
+	dumpDir = flag.String(
+		"debug.dump-dir", "",
+		"Directory to write the redacted output of every FreeIPMI invocation to (default: no dumps).",
+	)
+	dumpMaxFiles = flag.Int(
+		"debug.dump-max-files", 1000,
+		"Maximum number of files kept in debug.dump-dir, older files are removed (0: no limit).",
+	)
+	tracingEndpoint = flag.String(
+		"tracing.otlp-endpoint", "",
+		"OTLP/HTTP endpoint to send traces of scrapes to, e.g. http://localhost:4318/v1/traces (default: no tracing).",
+	)
+	metricsNamespace = flag.String(
+		"metrics.namespace", namespace,
+		"Namespace, i.e. prefix, of the exported metric names.",
+	)
+	sdFile = flag.String(
+		"sd.file", "",
+		"Path of a file to write all known targets to, in the format of the Prometheus file-based service discovery (default: no file).",
+	)
+	sdFileAddress = flag.String(
+		"sd.file-exporter-address", "localhost:9290",
+		"Address under which Prometheus reaches the exporter, used as target address in sd.file.",
+	)
+	sdFileInterval = flag.Duration(
+		"sd.file-refresh-interval", time.Minute,
+		"Interval in which sd.file is updated.",
+	)
+	once = flag.Bool(
+		"once", false,
+		"Scrape once.target once, write its metrics to output.file and exit, instead of serving HTTP.",
+	)
+	onceTarget = flag.String(
+		"once.target", "",
+		"Target to scrape with -once, either an address or an alias from the config file.",
+	)
+	onceTimeout = flag.Duration(
+		"once.timeout", time.Minute,
+		"Timeout of the scrape with -once.",
+	)
+	outputFile = flag.String(
+		"output.file", "",
+		"File to write the metrics to with -once, e.g. in the directory of the node exporter's textfile collector.",
+	)
+	grpcListenAddress = flag.String(
+		"grpc.listen-address", "",
+		"Address to serve the gRPC control API on (default: no gRPC API).",
+	)
+	startupValidate = flag.Bool(
+		"startup.validate", false,
+		"Exit with an error on startup if the FreeIPMI commands or files needed with the config file are missing.",
+	)
+	startupValidateCredentials = flag.Bool(
+		"startup.validate-credentials", false,
+		"With startup.validate, also require the credentials of at least one target known from the config file to authenticate.",
+	)
+	timeoutOffset = flag.Float64(
+		"timeout-offset", 0.5,
+		"Offset to subtract from the timeout requested by Prometheus, in seconds.",
+	)
+
+	listenAddresses stringSlice
+
+	// commands maps the names of subcommands, given after the flags, to
+	// their implementation, which parses the remaining arguments.
+	commands = map[string]func(*SafeConfig, []string) error{
+		"scrape":           runScrapeCommand,
+		"list-sensors":     runListSensorsCommand,
+		"test-credentials": runTestCredentialsCommand,
+	}
 
 	sc = &SafeConfig{
 		C: &Config{},
@@ -40,15 +138,59 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "'target' parameter must be specified", 400)
 		return
 	}
-	log.Debugf("Scraping target '%s'", target)
+	if !authorize(w, r, target) {
+		return
+	}
+	if rateLimited(w, r) {
+		return
+	}
+	// A config reload during the scrape must not mix old and new settings.
+	config := sc.Snapshot()
+	if !config.TargetAllowed(target) {
+		log.Warnf("Refusing to scrape target '%s' not listed in allowed_targets", target)
+		http.Error(w, fmt.Sprintf("target '%s' is not allowed", target), http.StatusForbidden)
+		return
+	}
+	address, credentials := config.LookupTarget(target)
+	if _, err := freeipmiHost(address); err != nil {
+		http.Error(w, fmt.Sprintf("invalid target address '%s': %s", address, err), 400)
+		return
+	}
+	log.Debugf("Scraping target '%s' (%s)", target, address)
+
+	timeout, err := scrapeTimeout(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
 
 	registry := prometheus.NewRegistry()
-	collector := collector{target: target, config: sc}
+	collector := collector{ctx: r.Context(), name: target, target: address, credentials: credentials, config: config, timeout: timeout}
 	registry.MustRegister(collector)
-	h := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+	gatherer := withLabels(registry, config.CredentialsLabels(credentials))
+	h := promhttp.HandlerFor(withNamespace(gatherer, *metricsNamespace), promhttp.HandlerOpts{})
 	h.ServeHTTP(w, r)
 }
 
+// scrapeTimeout returns the timeout to apply to a scrape, based on the
+// timeout Prometheus announces in the X-Prometheus-Scrape-Timeout-Seconds
+// header minus the configured offset. Zero means no timeout.
+func scrapeTimeout(r *http.Request) (time.Duration, error) {
+	header := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds")
+	if header == "" {
+		return 0, nil
+	}
+	seconds, err := strconv.ParseFloat(header, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse timeout from Prometheus header: %s", err)
+	}
+	seconds -= *timeoutOffset
+	if seconds <= 0 {
+		return 0, fmt.Errorf("timeout of %s seconds is too short for a timeout offset of %.1f seconds", header, *timeoutOffset)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
 func updateConfiguration(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "POST":
@@ -63,25 +205,120 @@ func updateConfiguration(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func init() {
+	flag.Var(&listenAddresses, "web.listen-address", "Address to listen on for web interface and telemetry, either host:port or unix:///path/to.sock. Can be repeated. (default \":9290\")")
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == limitedExecArg {
+		runLimited(os.Args[2:])
+	}
 	flag.Parse()
-	log.Infoln("Starting ipmi_exporter")
+	if len(listenAddresses) == 0 {
+		listenAddresses = stringSlice{":9290"}
+	}
+	if *showVersion {
+		fmt.Fprintln(os.Stdout, version.Print("ipmi_exporter"))
+		os.Exit(0)
+	}
+	if err := setupLogging(*logLevel, *logFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "Error setting up logging: %s\n", err)
+		os.Exit(1)
+	}
+	log.Infoln("Starting ipmi_exporter", version.Info())
+	log.Infoln("Build context", version.BuildContext())
 
+	if err := checkNamespace(*metricsNamespace); err != nil {
+		log.Fatal(err)
+	}
 	// Bail early if the config is bad.
 	if err := sc.ReloadConfig(*configFile); err != nil {
 		log.Fatalf("Error parsing config file: %s", err)
 	}
+	checkCommands(sc)
+
+	if *tracingEndpoint != "" {
+		startTracing(*tracingEndpoint)
+	}
+
+	if *replayDir != "" {
+		log.Warnf("Replaying FreeIPMI outputs from %s instead of running FreeIPMI", *replayDir)
+		defaultExecutor = replayExecutor{dir: *replayDir}
+	}
+	if *maxProcesses > 0 {
+		commandSlots = make(chan struct{}, *maxProcesses)
+	}
+	if *startupValidate {
+		if err := validateStartup(sc, *startupValidateCredentials, 30*time.Second); err != nil {
+			log.Fatal(err)
+		}
+		log.Infoln("Startup validation succeeded")
+	}
+	if flag.NArg() > 0 {
+		command, ok := commands[flag.Arg(0)]
+		if !ok {
+			log.Fatalf("Unknown command %q", flag.Arg(0))
+		}
+		if err := command(sc, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+	if *once {
+		if *onceTarget == "" || *outputFile == "" {
+			log.Fatal("-once requires -once.target and -output.file")
+		}
+		if err := scrapeOnce(sc, *onceTarget, *outputFile, *onceTimeout); err != nil {
+			log.Fatalf("Error scraping target %s: %s", *onceTarget, err)
+		}
+		os.Exit(0)
+	}
+	prometheus.MustRegister(
+		commandsWaiting, commandWaitDuration, commandRetries,
+		commandStarts, commandFailures, commandKills, parseErrors,
+		scrapesInFlight, commandsRunning,
+		configReloadSuccess, configReloadSeconds,
+		scrapeErrors, sdrCacheRecreations, sdrCacheLastRecreation, commandAvailable,
+		remoteWriteRequests, pushgatewayPushes, discoveredTargets, discoveryFailures,
+		agentLeader, selNotifications,
+		version.NewCollector("ipmi_exporter"),
+	)
+	if *durationHistogram {
+		prometheus.MustRegister(scrapeDurations)
+	}
 
-	hup := make(chan os.Signal)
+	if cfg := sc.SDRCache(); cfg.WarmUp {
+		go warmUpSDRCaches(sc, cfg.WarmUpConcurrency)
+	}
+	go runDiscovery(sc)
+	go runLeaderElection(sc)
+	go runAgent(sc)
+	go runInventoryWriter(sc)
+	if *sdFile != "" {
+		go runSDFileWriter(*sdFile, *sdFileAddress, *sdFileInterval)
+	}
+
+	var watchdog <-chan time.Time
+	if interval := sdWatchdogInterval(); interval > 0 {
+		log.Infof("Notifying systemd watchdog every %s", interval)
+		watchdog = time.Tick(interval)
+	}
+
+	hup := make(chan os.Signal, 1)
 	reloadCh = make(chan chan error)
 	signal.Notify(hup, syscall.SIGHUP)
 	go func() {
 		for {
 			select {
+			case <-watchdog:
+				if err := sdNotify("WATCHDOG=1"); err != nil {
+					log.Errorf("Error notifying systemd watchdog: %s", err)
+				}
 			case <-hup:
 				if err := sc.ReloadConfig(*configFile); err != nil {
 					log.Errorf("Error reloading config: %s", err)
 				}
+				checkCommands(sc)
 			case rc := <-reloadCh:
 				if err := sc.ReloadConfig(*configFile); err != nil {
 					log.Errorf("Error reloading config: %s", err)
@@ -89,15 +326,36 @@ func main() {
 				} else {
 					rc <- nil
 				}
+				checkCommands(sc)
 			}
 		}
 	}()
 
-	http.Handle("/metrics", promhttp.Handler())       // Normal metrics endpoint for IPMI exporter itself.
-	http.HandleFunc("/ipmi", handler)                 // Endpoint to do IPMI scrapes.
-	http.HandleFunc("/-/reload", updateConfiguration) // Endpoint to reload configuration.
+	// Admin endpoints are served on a separate address if configured.
+	mux := http.NewServeMux()
+	adminMux := mux
+	if *adminListenAddress != "" {
+		adminMux = http.NewServeMux()
+	}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	metricsHandler := promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer,
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			promhttp.HandlerFor(prometheus.Gatherers{
+				withNamespace(prometheus.DefaultGatherer, *metricsNamespace),
+				exposedGatherer(r), // Metrics of targets, if agent.expose is set.
+			}, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+		}),
+	)
+	mux.Handle("/metrics", metricsHandler)                // Normal metrics endpoint for IPMI exporter itself.
+	mux.HandleFunc("/ipmi", handler)                      // Endpoint to do IPMI scrapes.
+	mux.HandleFunc("/api/v1/targets/", apiHandler)        // JSON API for sensor readings.
+	mux.HandleFunc("/sd", sdHandler)                      // Prometheus HTTP service discovery.
+	adminMux.HandleFunc("/-/reload", updateConfiguration) // Endpoint to reload configuration.
+	adminMux.HandleFunc("/debug/last-scrape", debugLastScrapeHandler)
+	adminMux.HandleFunc("/inventory", inventoryHandler)
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
             <head>
             <title>IPMI Exporter</title>
@@ -125,9 +383,61 @@ func main() {
             </html>`))
 	})
 
-	log.Infof("Listening on %s", *listenAddress)
-	err := http.ListenAndServe(*listenAddress, nil)
+	listeners, err := sdListeners()
 	if err != nil {
 		log.Fatal(err)
 	}
+	if listeners == nil {
+		for _, address := range listenAddresses {
+			l, err := listen(address)
+			if err != nil {
+				log.Fatal(err)
+			}
+			listeners = append(listeners, l)
+		}
+	}
+	var adminListener net.Listener
+	if *adminListenAddress != "" {
+		adminListener, err = listen(*adminListenAddress)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := sdNotify("READY=1"); err != nil {
+		log.Errorf("Error notifying systemd: %s", err)
+	}
+	var publicHandler, adminHandler http.Handler = mux, adminMux
+	if *accessLogFormat != "" {
+		accessLogger, err := newAccessLogger(*accessLogFormat)
+		if err != nil {
+			log.Fatal(err)
+		}
+		publicHandler = withAccessLog(accessLogger, mux)
+		adminHandler = withAccessLog(accessLogger, adminMux)
+	}
+
+	errCh := make(chan error)
+	for _, l := range listeners {
+		log.Infof("Listening on %s", l.Addr())
+		go func(l net.Listener) {
+			errCh <- http.Serve(l, publicHandler)
+		}(l)
+	}
+	if *grpcListenAddress != "" {
+		l, err := listen(*grpcListenAddress)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("Listening on %s for the gRPC control API", l.Addr())
+		go func() {
+			errCh <- serveGRPC(l)
+		}()
+	}
+	if adminListener != nil {
+		log.Infof("Listening on %s for admin endpoints", adminListener.Addr())
+		go func() {
+			errCh <- http.Serve(adminListener, adminHandler)
+		}()
+	}
+	log.Fatal(<-errCh)
 }
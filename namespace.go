@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+// checkNamespace checks that ns yields valid metric names as namespace.
+func checkNamespace(ns string) error {
+	if !model.IsValidMetricName(model.LabelValue(ns)) {
+		return fmt.Errorf("invalid metrics namespace %q, must match %s", ns, model.MetricNameRE)
+	}
+	return nil
+}
+
+// withNamespace returns a gatherer that replaces the namespace of the metrics
+// gathered by g, i.e. the "ipmi" prefix, with ns.
+func withNamespace(g prometheus.Gatherer, ns string) prometheus.Gatherer {
+	if ns == namespace {
+		return g
+	}
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs, err := g.Gather()
+		for _, mf := range mfs {
+			name := mf.GetName()
+			if strings.HasPrefix(name, namespace+"_") {
+				name = ns + strings.TrimPrefix(name, namespace)
+				mf.Name = &name
+			}
+		}
+		return mfs, err
+	})
+}
+
+// withLabels returns a gatherer that adds labels to all metrics gathered by g,
+// unless they already have a label of the same name.
+func withLabels(g prometheus.Gatherer, labels map[string]string) prometheus.Gatherer {
+	if len(labels) == 0 {
+		return g
+	}
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs, err := g.Gather()
+		for _, mf := range mfs {
+			for _, m := range mf.Metric {
+				have := make(map[string]bool, len(m.Label))
+				for _, lp := range m.Label {
+					have[lp.GetName()] = true
+				}
+				for name, value := range labels {
+					if !have[name] {
+						name, value := name, value
+						m.Label = append(m.Label, &dto.LabelPair{Name: &name, Value: &value})
+					}
+				}
+				sort.Slice(m.Label, func(i, j int) bool { return m.Label[i].GetName() < m.Label[j].GetName() })
+			}
+		}
+		return mfs, err
+	})
+}
@@ -0,0 +1,16 @@
+package main
+
+import "testing"
+
+func TestCheckNamespace(t *testing.T) {
+	for _, ns := range []string{"ipmi", "oob", "site_a", "_x"} {
+		if err := checkNamespace(ns); err != nil {
+			t.Errorf("%q: unexpected error: %s", ns, err)
+		}
+	}
+	for _, ns := range []string{"", "ipmi-oob", "1ipmi", "ip mi"} {
+		if err := checkNamespace(ns); err == nil {
+			t.Errorf("%q: expected an error", ns)
+		}
+	}
+}
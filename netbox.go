@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// netboxDiscoverer discovers targets from the out-of-band management IPs of
+// devices in Netbox, see https://docs.netbox.dev/en/stable/integrations/rest-api/.
+type netboxDiscoverer struct {
+	config NetboxConfig
+}
+
+type netboxDevice struct {
+	Name  string `json:"name"`
+	OOBIP *struct {
+		Address string `json:"address"`
+	} `json:"oob_ip"`
+	Site *struct {
+		Slug string `json:"slug"`
+	} `json:"site"`
+	Rack *struct {
+		Name string `json:"name"`
+	} `json:"rack"`
+	Role *struct {
+		Slug string `json:"slug"`
+	} `json:"role"`
+	// DeviceRole is the name of Role before Netbox 4.0.
+	DeviceRole *struct {
+		Slug string `json:"slug"`
+	} `json:"device_role"`
+}
+
+type netboxDeviceList struct {
+	Next    string         `json:"next"`
+	Results []netboxDevice `json:"results"`
+}
+
+func (d netboxDiscoverer) discover(ctx context.Context) (map[string]Target, error) {
+	query := url.Values{}
+	for k, v := range d.config.Filters {
+		query.Set(k, v)
+	}
+	query.Set("has_oob_ip", "true")
+	query.Set("limit", "1000")
+	next := strings.TrimSuffix(d.config.URL, "/") + "/api/dcim/devices/?" + query.Encode()
+
+	targets := make(map[string]Target)
+	for next != "" {
+		var list netboxDeviceList
+		if err := d.get(ctx, next, &list); err != nil {
+			return nil, err
+		}
+		for _, dev := range list.Results {
+			if dev.Name == "" || dev.OOBIP == nil {
+				continue
+			}
+			// Netbox returns addresses with their prefix length.
+			address := strings.SplitN(dev.OOBIP.Address, "/", 2)[0]
+			labels := map[string]string{}
+			if dev.Site != nil {
+				labels["netbox_site"] = dev.Site.Slug
+			}
+			if dev.Rack != nil {
+				labels["netbox_rack"] = dev.Rack.Name
+			}
+			if dev.Role != nil {
+				labels["netbox_role"] = dev.Role.Slug
+			} else if dev.DeviceRole != nil {
+				labels["netbox_role"] = dev.DeviceRole.Slug
+			}
+			targets[dev.Name] = Target{
+				Address:     address,
+				Credentials: d.config.Credentials,
+				Labels:      labels,
+			}
+		}
+		next = list.Next
+	}
+	return targets, nil
+}
+
+func (d netboxDiscoverer) get(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if d.config.Token != "" {
+		req.Header.Set("Authorization", "Token "+d.config.Token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s from %s", resp.Status, url)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// scrapeText scrapes target and returns its metrics in the text format.
+func scrapeText(config *SafeConfig, target string, timeout time.Duration) ([]byte, error) {
+	if !config.TargetAllowed(target) {
+		return nil, fmt.Errorf("target '%s' is not allowed", target)
+	}
+	mfs, err := scrapeTarget(context.Background(), config, target, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return formatText(mfs)
+}
+
+// formatText returns mfs in the text format.
+func formatText(mfs []*dto.MetricFamily) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(&buf, mf); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// runScrapeCommand implements the scrape subcommand, which scrapes a single
+// target and prints its metrics to stdout.
+func runScrapeCommand(config *SafeConfig, args []string) error {
+	fs := flag.NewFlagSet("scrape", flag.ContinueOnError)
+	target := fs.String("target", "", "Target to scrape, either an address or an alias from the config file.")
+	timeout := fs.Duration("timeout", time.Minute, "Timeout of the scrape.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *target == "" || fs.NArg() > 0 {
+		return fmt.Errorf("usage: ipmi_exporter [flags] scrape --target=<target> [--timeout=<duration>]")
+	}
+	text, err := scrapeText(config, *target, *timeout)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(text)
+	return err
+}
+
+// runListSensorsCommand implements the list-sensors subcommand, which prints
+// a table of all sensors of a target, including those excluded in the config.
+func runListSensorsCommand(config *SafeConfig, args []string) error {
+	fs := flag.NewFlagSet("list-sensors", flag.ContinueOnError)
+	target := fs.String("target", "", "Target to list the sensors of, either an address or an alias from the config file.")
+	timeout := fs.Duration("timeout", time.Minute, "Timeout of the FreeIPMI command.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *target == "" || fs.NArg() > 0 {
+		return fmt.Errorf("usage: ipmi_exporter [flags] list-sensors --target=<target> [--timeout=<duration>]")
+	}
+	if !config.TargetAllowed(*target) {
+		return fmt.Errorf("target '%s' is not allowed", *target)
+	}
+	address, credentials := config.LookupTarget(*target)
+	creds, err := config.CredentialsForTarget(credentials)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	if ctx, err = withScrapeResolution(ctx, config, address, credentials); err != nil {
+		return err
+	}
+	c := collector{ctx: ctx, name: *target, target: address, credentials: credentials, config: config}
+	sdrArgs, recreate := sdrCacheArgs(address, config.SDRCache())
+	output, err := ipmiMonitoringOutput(ctx, c.getExecutor(), address, creds.User, creds.Password, sdrArgs...)
+	if recreate {
+		sdrCaches.recreated(address, err == nil)
+	}
+	if err != nil {
+		return err
+	}
+	sensors, _, err := splitMonitoringOutput(output)
+	if err != nil {
+		return err
+	}
+
+	excluded := config.ExcludeSensorIDs()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tTYPE\tSTATE\tVALUE\tUNIT\tEXCLUDED")
+	for _, s := range sensors {
+		value := "N/A"
+		if !math.IsNaN(s.Value) {
+			value = strconv.FormatFloat(s.Value, 'f', -1, 64)
+		}
+		isExcluded := "no"
+		if contains(excluded, s.ID) {
+			isExcluded = "yes"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", s.ID, s.Name, s.Type, s.State, value, s.Unit, isExcluded)
+	}
+	return w.Flush()
+}
+
+// runTestCredentialsCommand implements the test-credentials subcommand, which
+// runs a cheap command against a target with the credentials the config
+// resolves for it and reports whether they work.
+func runTestCredentialsCommand(config *SafeConfig, args []string) error {
+	fs := flag.NewFlagSet("test-credentials", flag.ContinueOnError)
+	target := fs.String("target", "", "Target to test the credentials of, either an address or an alias from the config file.")
+	timeout := fs.Duration("timeout", 30*time.Second, "Timeout of the FreeIPMI command.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *target == "" || fs.NArg() > 0 {
+		return fmt.Errorf("usage: ipmi_exporter [flags] test-credentials --target=<target> [--timeout=<duration>]")
+	}
+	user, address, err := testCredentials(config, *target, *timeout)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("OK: authenticated as user %q on %s\n", user, address)
+	return nil
+}
+
+// testCredentials runs a cheap command against target with the credentials
+// the config resolves for it. It returns the user and address used.
+func testCredentials(config *SafeConfig, target string, timeout time.Duration) (string, string, error) {
+	address, credentials := config.LookupTarget(target)
+	creds, err := config.CredentialsForTarget(credentials)
+	if err != nil {
+		return "", address, fmt.Errorf("failed (%s): %s", reasonNoCredentials, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if ctx, err = withScrapeResolution(ctx, config, address, credentials); err != nil {
+		return creds.User, address, fmt.Errorf("failed (%s): %s", reasonDNS, err)
+	}
+	c := collector{ctx: ctx, target: address, config: config}
+	// Getting the device ID is a single IPMI command after the session has
+	// been established.
+	if _, err := freeipmiOutput(ctx, c.getExecutor(), "bmc-info", address, creds.User, creds.Password, "--get-device-id"); err != nil {
+		return creds.User, address, fmt.Errorf("failed (%s) as user %q on %s: %s", failureReason(err), creds.User, address, err)
+	}
+	return creds.User, address, nil
+}
+
+// scrapeOnce scrapes target and writes its metrics in the text format to
+// path, e.g. for the textfile collector of the node exporter. The file is
+// replaced atomically, so that it is never read half-written.
+func scrapeOnce(config *SafeConfig, target, path string, timeout time.Duration) error {
+	text, err := scrapeText(config, target, timeout)
+	if err != nil {
+		return err
+	}
+	// The temporary file is in the same directory, as renaming does not work
+	// across filesystems, and has a name the textfile collector ignores.
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(text); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
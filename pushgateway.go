@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// pushgatewayURL returns the URL to push metrics with the given grouping key
+// to, see https://github.com/prometheus/pushgateway#url. Label values are
+// always base64 encoded, so they may contain slashes or be empty.
+func pushgatewayURL(base, job string, grouping map[string]string) string {
+	var names []string
+	for name := range grouping {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	url := strings.TrimSuffix(base, "/") + "/metrics/job@base64/" + encodeGroupingValue(job)
+	for _, name := range names {
+		url += "/" + name + "@base64/" + encodeGroupingValue(grouping[name])
+	}
+	return url
+}
+
+func encodeGroupingValue(value string) string {
+	if value == "" {
+		// An empty value must be encoded as a single "=".
+		return "="
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(value))
+}
+
+// pushgatewayPush replaces the metrics of a grouping key on the Pushgateway
+// configured in cfg with mfs.
+func pushgatewayPush(ctx context.Context, cfg PushgatewayConfig, job string, grouping map[string]string, mfs []*dto.MetricFamily) error {
+	var buf bytes.Buffer
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(&buf, mf); err != nil {
+			return err
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+	url := pushgatewayURL(cfg.URL, job, grouping)
+	req, err := http.NewRequest("PUT", url, &buf)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", string(expfmt.FmtText))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("push to %s failed with %s: %s", url, resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestPushgatewayURL(t *testing.T) {
+	url := pushgatewayURL("http://pushgateway:9091/", "ipmi", map[string]string{
+		"instance": "node1",
+		"path":     "a/b",
+		"empty":    "",
+	})
+	expected := "http://pushgateway:9091/metrics/job@base64/aXBtaQ" +
+		"/empty@base64/=" +
+		"/instance@base64/bm9kZTE" +
+		"/path@base64/YS9i"
+	if url != expected {
+		t.Errorf("expected %s, got %s", expected, url)
+	}
+}
+
+func TestPushgatewayPush(t *testing.T) {
+	var (
+		method, path, body string
+		status             = http.StatusOK
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.Path
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(status)
+		w.Write([]byte("bad metrics\n"))
+	}))
+	defer srv.Close()
+
+	cfg := PushgatewayConfig{URL: srv.URL, Timeout: 5 * time.Second}
+	mfs := []*dto.MetricFamily{{
+		Name: proto.String("ipmi_up"),
+		Help: proto.String("'1' if a scrape of the IPMI device was successful, '0' otherwise."),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{{
+			Gauge: &dto.Gauge{Value: proto.Float64(1)},
+		}},
+	}}
+	if err := pushgatewayPush(context.Background(), cfg, "ipmi", map[string]string{"instance": "node1"}, mfs); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if method != "PUT" {
+		t.Errorf("expected a PUT request, got %s", method)
+	}
+	if expected := "/metrics/job@base64/aXBtaQ/instance@base64/bm9kZTE"; path != expected {
+		t.Errorf("expected path %s, got %s", expected, path)
+	}
+	if !strings.Contains(body, "ipmi_up 1\n") {
+		t.Errorf("expected the metrics in the text format, got %q", body)
+	}
+
+	status = http.StatusBadRequest
+	err := pushgatewayPush(context.Background(), cfg, "ipmi", nil, mfs)
+	if err == nil || !strings.Contains(err.Error(), "bad metrics") {
+		t.Errorf("expected an error with the response body, got %v", err)
+	}
+}
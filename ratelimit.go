@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// tokenBucket is the rate limiting state of a single client.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter limits the request rate per client IP.
+type rateLimiter struct {
+	mtx       sync.Mutex
+	clients   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// Allow reports whether client may make another request, given a rate in
+// requests per second and a burst size.
+func (rl *rateLimiter) Allow(client string, rate float64, burst int) bool {
+	rl.mtx.Lock()
+	defer rl.mtx.Unlock()
+	now := time.Now()
+	if rl.clients == nil {
+		rl.clients = make(map[string]*tokenBucket)
+	}
+	// Forget clients whose bucket has been refilled completely.
+	full := time.Duration(float64(burst) / rate * float64(time.Second))
+	if now.Sub(rl.lastSweep) > time.Minute {
+		for c, b := range rl.clients {
+			if now.Sub(b.last) > full {
+				delete(rl.clients, c)
+			}
+		}
+		rl.lastSweep = now
+	}
+
+	b, ok := rl.clients[client]
+	if !ok {
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		rl.clients[client] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+var limiter rateLimiter
+
+// rateLimited checks whether the client of r exceeded the configured rate
+// limit. If so, an error is written to w and true is returned.
+func rateLimited(w http.ResponseWriter, r *http.Request) bool {
+	if rateLimitAllows(sc, r) {
+		return false
+	}
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+	return true
+}
+
+// rateLimitAllows reports whether the client of r may make another request
+// within the rate limit configured in config.
+func rateLimitAllows(config *SafeConfig, r *http.Request) bool {
+	rlc := config.RateLimit()
+	if rlc.Rate <= 0 {
+		return true
+	}
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	return limiter.Allow(client, rlc.Rate, rlc.Burst)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var rl rateLimiter
+	for i := 0; i < 3; i++ {
+		if !rl.Allow("10.0.0.1", 1, 3) {
+			t.Fatalf("expected request %d within the burst to be allowed", i+1)
+		}
+	}
+	if rl.Allow("10.0.0.1", 1, 3) {
+		t.Error("expected a request beyond the burst to be refused")
+	}
+	if !rl.Allow("10.0.0.2", 1, 3) {
+		t.Error("expected another client to have its own burst")
+	}
+
+	// Two seconds later, two more requests are allowed at one per second.
+	rl.clients["10.0.0.1"].last = time.Now().Add(-2 * time.Second)
+	for i := 0; i < 2; i++ {
+		if !rl.Allow("10.0.0.1", 1, 3) {
+			t.Fatalf("expected request %d after refilling to be allowed", i+1)
+		}
+	}
+	if rl.Allow("10.0.0.1", 1, 3) {
+		t.Error("expected the refilled tokens to be used up")
+	}
+
+	// The bucket never holds more than the burst.
+	rl.clients["10.0.0.1"].last = time.Now().Add(-time.Hour)
+	for i := 0; i < 3; i++ {
+		rl.Allow("10.0.0.1", 1, 3)
+	}
+	if rl.Allow("10.0.0.1", 1, 3) {
+		t.Error("expected the bucket to be capped at the burst")
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// IPMI completion codes, see section 5.2 of the IPMI specification.
+const (
+	completionCodeOK             = 0x00
+	completionCodeInvalidCommand = 0xc1
+)
+
+// rawRequest is a raw IPMI request as sent by ipmi-raw.
+type rawRequest struct {
+	// Channel is the channel to bridge the request to. Zero sends the
+	// request to the BMC itself.
+	Channel      uint8
+	SlaveAddress uint8
+	LUN          uint8
+	NetFn        uint8
+	Command      uint8
+	Data         []byte
+}
+
+func (r rawRequest) args() []string {
+	var args []string
+	if r.Channel != 0 {
+		args = append(args,
+			"--channel-number", strconv.Itoa(int(r.Channel)),
+			"--slave-address", fmt.Sprintf("0x%02x", r.SlaveAddress),
+		)
+	}
+	args = append(args,
+		fmt.Sprintf("0x%02x", r.LUN),
+		fmt.Sprintf("0x%02x", r.NetFn),
+		fmt.Sprintf("0x%02x", r.Command),
+	)
+	for _, b := range r.Data {
+		args = append(args, fmt.Sprintf("0x%02x", b))
+	}
+	return args
+}
+
+// rawCompletionError is returned if the BMC answered a raw request with a
+// completion code other than 0x00.
+type rawCompletionError struct {
+	command uint8
+	code    uint8
+}
+
+func (e *rawCompletionError) Error() string {
+	return fmt.Sprintf("command 0x%02x failed with completion code 0x%02x", e.command, e.code)
+}
+
+// rawCommand sends req to host using ipmi-raw and returns the data bytes of
+// the response, i.e. without the command and completion code.
+func rawCommand(ctx context.Context, e executor, host, user, password string, req rawRequest) ([]byte, error) {
+	output, err := freeipmiOutput(ctx, e, "ipmi-raw", host, user, password, req.args()...)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := parseRawResponse(output)
+	if err != nil {
+		return nil, &parseError{err}
+	}
+	if len(resp) < 2 {
+		return nil, &parseError{fmt.Errorf("response too short: %x", resp)}
+	}
+	if resp[0] != req.Command {
+		return nil, &parseError{fmt.Errorf("response for command 0x%02x, expected 0x%02x", resp[0], req.Command)}
+	}
+	if resp[1] != completionCodeOK {
+		return nil, &rawCompletionError{command: req.Command, code: resp[1]}
+	}
+	return resp[2:], nil
+}
+
+// parseRawResponse decodes the "rcvd: 01 00 ..." line printed by ipmi-raw.
+func parseRawResponse(ipmiOutput []byte) ([]byte, error) {
+	for _, line := range strings.Split(string(ipmiOutput), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "rcvd:") {
+			continue
+		}
+		return hex.DecodeString(strings.Join(strings.Fields(line[len("rcvd:"):]), ""))
+	}
+	return nil, fmt.Errorf("Could not find response in output: %s", string(ipmiOutput))
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/common/model"
+)
+
+// relabel applies cfgs to the label set lset like Prometheus does and returns
+// the resulting label set, or nil if it was dropped. lset is modified.
+func relabel(lset map[string]string, cfgs []RelabelConfig) map[string]string {
+	for _, cfg := range cfgs {
+		values := make([]string, len(cfg.SourceLabels))
+		for i, name := range cfg.SourceLabels {
+			values[i] = lset[name]
+		}
+		val := strings.Join(values, cfg.Separator)
+
+		switch cfg.Action {
+		case "keep":
+			if !cfg.regex.MatchString(val) {
+				return nil
+			}
+		case "drop":
+			if cfg.regex.MatchString(val) {
+				return nil
+			}
+		case "replace":
+			indexes := cfg.regex.FindStringSubmatchIndex(val)
+			if indexes == nil {
+				break
+			}
+			target := string(cfg.regex.ExpandString(nil, cfg.TargetLabel, val, indexes))
+			if !model.LabelName(target).IsValid() {
+				break
+			}
+			res := string(cfg.regex.ExpandString(nil, cfg.Replacement, val, indexes))
+			if res == "" {
+				delete(lset, target)
+				break
+			}
+			lset[target] = res
+		case "lowercase":
+			lset[cfg.TargetLabel] = strings.ToLower(val)
+		case "uppercase":
+			lset[cfg.TargetLabel] = strings.ToUpper(val)
+		case "hashmod":
+			sum := md5.Sum([]byte(val))
+			lset[cfg.TargetLabel] = fmt.Sprint(binary.BigEndian.Uint64(sum[8:]) % cfg.Modulus)
+		case "labelmap":
+			mapped := make(map[string]string)
+			for name, value := range lset {
+				if cfg.regex.MatchString(name) {
+					mapped[cfg.regex.ReplaceAllString(name, cfg.Replacement)] = value
+				}
+			}
+			for name, value := range mapped {
+				lset[name] = value
+			}
+		case "labeldrop":
+			for name := range lset {
+				if cfg.regex.MatchString(name) {
+					delete(lset, name)
+				}
+			}
+		case "labelkeep":
+			for name := range lset {
+				if !cfg.regex.MatchString(name) {
+					delete(lset, name)
+				}
+			}
+		}
+	}
+	return lset
+}
+
+// relabelSeries applies cfgs to the labels of all series, dropping those
+// that are dropped by a rule or lose their name.
+func relabelSeries(series []*prompbTimeSeries, cfgs []RelabelConfig) []*prompbTimeSeries {
+	if len(cfgs) == 0 {
+		return series
+	}
+	var result []*prompbTimeSeries
+	for _, s := range series {
+		lset := make(map[string]string, len(s.Labels))
+		for _, l := range s.Labels {
+			lset[l.Name] = l.Value
+		}
+		lset = relabel(lset, cfgs)
+		if lset == nil || lset["__name__"] == "" {
+			continue
+		}
+		s.Labels = s.Labels[:0]
+		for name, value := range lset {
+			s.Labels = append(s.Labels, &prompbLabel{Name: name, Value: value})
+		}
+		sort.Slice(s.Labels, func(i, j int) bool { return s.Labels[i].Name < s.Labels[j].Name })
+		result = append(result, s)
+	}
+	return result
+}
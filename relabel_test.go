@@ -0,0 +1,254 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// The test cases follow those of Prometheus' relabel package, whose behaviour
+// relabel mirrors.
+func TestRelabel(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    map[string]string
+		config   string
+		expected map[string]string
+	}{
+		{
+			name:  "replace with capture groups",
+			input: map[string]string{"a": "foo", "b": "bar", "c": "baz"},
+			config: `
+- source_labels: [a]
+  regex: f(.*)
+  target_label: d
+  replacement: ch${1}-ch${1}`,
+			expected: map[string]string{"a": "foo", "b": "bar", "c": "baz", "d": "choo-choo"},
+		},
+		{
+			name:  "replace with several source labels",
+			input: map[string]string{"a": "foo", "b": "bar", "c": "baz"},
+			config: `
+- source_labels: [a, b]
+  regex: f(.*);(.*)r
+  target_label: a
+  replacement: b${1}${2}m
+- source_labels: [c, a]
+  regex: (b).*b(.*)ba(.*)
+  target_label: d
+  replacement: $1$2$2$3`,
+			expected: map[string]string{"a": "boobam", "b": "bar", "c": "baz", "d": "boooom"},
+		},
+		{
+			name:  "replace with custom separator",
+			input: map[string]string{"a": "foo", "b": "bar"},
+			config: `
+- source_labels: [a, b]
+  separator: "-"
+  target_label: c`,
+			expected: map[string]string{"a": "foo", "b": "bar", "c": "foo-bar"},
+		},
+		{
+			name:  "regex is anchored",
+			input: map[string]string{"a": "foo"},
+			config: `
+- source_labels: [a]
+  regex: o
+  target_label: b
+  replacement: matched`,
+			expected: map[string]string{"a": "foo"},
+		},
+		{
+			name:  "regex with alternatives is anchored as a whole",
+			input: map[string]string{"a": "foobar"},
+			config: `
+- source_labels: [a]
+  regex: foo|bar
+  action: drop`,
+			expected: map[string]string{"a": "foobar"},
+		},
+		{
+			name:  "replace without match",
+			input: map[string]string{"a": "boo"},
+			config: `
+- source_labels: [a]
+  regex: f(.*)
+  target_label: b
+  replacement: bar`,
+			expected: map[string]string{"a": "boo"},
+		},
+		{
+			name:  "replace with empty result deletes the label",
+			input: map[string]string{"a": "foo", "b": "bar"},
+			config: `
+- source_labels: [c]
+  target_label: b`,
+			expected: map[string]string{"a": "foo"},
+		},
+		{
+			name:  "replace with invalid target label",
+			input: map[string]string{"a": "some-name-value"},
+			config: `
+- source_labels: [a]
+  regex: some-([^-]+)-([^,]+)
+  target_label: ${1}-${2}
+  replacement: ${2}`,
+			expected: map[string]string{"a": "some-name-value"},
+		},
+		{
+			name:  "replace with target label from capture group",
+			input: map[string]string{"a": "some-name-value"},
+			config: `
+- source_labels: [a]
+  regex: some-([^-]+)-([^,]+)
+  target_label: ${1}
+  replacement: ${2}`,
+			expected: map[string]string{"a": "some-name-value", "name": "value"},
+		},
+		{
+			name:  "keep matching",
+			input: map[string]string{"a": "foo"},
+			config: `
+- source_labels: [a]
+  regex: f.*
+  action: keep`,
+			expected: map[string]string{"a": "foo"},
+		},
+		{
+			name:  "keep not matching",
+			input: map[string]string{"a": "boo"},
+			config: `
+- source_labels: [a]
+  regex: f.*
+  action: keep`,
+			expected: nil,
+		},
+		{
+			name:  "drop matching",
+			input: map[string]string{"a": "foo"},
+			config: `
+- source_labels: [a]
+  regex: f.*
+  action: drop`,
+			expected: nil,
+		},
+		{
+			name:  "drop with missing source label",
+			input: map[string]string{"a": "foo"},
+			config: `
+- source_labels: [b]
+  regex: ""
+  action: drop`,
+			expected: nil,
+		},
+		{
+			name:  "hashmod",
+			input: map[string]string{"a": "foo", "b": "bar", "c": "baz"},
+			config: `
+- source_labels: [c]
+  target_label: d
+  modulus: 1000
+  action: hashmod`,
+			expected: map[string]string{"a": "foo", "b": "bar", "c": "baz", "d": "976"},
+		},
+		{
+			name:  "labelmap",
+			input: map[string]string{"a": "foo", "b1": "bar", "b2": "baz"},
+			config: `
+- regex: (b.*)
+  replacement: bar_${1}
+  action: labelmap`,
+			expected: map[string]string{"a": "foo", "b1": "bar", "b2": "baz", "bar_b1": "bar", "bar_b2": "baz"},
+		},
+		{
+			name:  "labelmap strips a prefix",
+			input: map[string]string{"__meta_rack": "r1", "a": "foo"},
+			config: `
+- regex: __meta_(.+)
+  action: labelmap`,
+			expected: map[string]string{"__meta_rack": "r1", "a": "foo", "rack": "r1"},
+		},
+		{
+			name:  "labeldrop",
+			input: map[string]string{"a": "foo", "b1": "bar", "b2": "baz"},
+			config: `
+- regex: b.*
+  action: labeldrop`,
+			expected: map[string]string{"a": "foo"},
+		},
+		{
+			name:  "labelkeep",
+			input: map[string]string{"a": "foo", "b1": "bar", "b2": "baz"},
+			config: `
+- regex: b.*
+  action: labelkeep`,
+			expected: map[string]string{"b1": "bar", "b2": "baz"},
+		},
+		{
+			name:  "lowercase and uppercase",
+			input: map[string]string{"a": "FooBar"},
+			config: `
+- source_labels: [a]
+  target_label: lower
+  action: lowercase
+- source_labels: [a]
+  target_label: upper
+  action: uppercase`,
+			expected: map[string]string{"a": "FooBar", "lower": "foobar", "upper": "FOOBAR"},
+		},
+	}
+	for _, test := range tests {
+		var cfgs []RelabelConfig
+		if err := yaml.Unmarshal([]byte(test.config), &cfgs); err != nil {
+			t.Errorf("%s: error parsing config: %s", test.name, err)
+			continue
+		}
+		if result := relabel(test.input, cfgs); !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, result)
+		}
+	}
+}
+
+func TestRelabelConfigErrors(t *testing.T) {
+	for _, config := range []string{
+		"- action: hashmod\n  target_label: a\n",
+		"- action: replace\n",
+		"- action: unknown\n",
+		"- regex: \"(\"\n  action: drop\n",
+	} {
+		var cfgs []RelabelConfig
+		if err := yaml.Unmarshal([]byte(config), &cfgs); err == nil {
+			t.Errorf("%q: expected an error", config)
+		}
+	}
+}
+
+func TestRelabelSeries(t *testing.T) {
+	series := []*prompbTimeSeries{
+		{Labels: []*prompbLabel{{Name: "__name__", Value: "ipmi_up"}, {Name: "instance", Value: "node1"}}},
+		{Labels: []*prompbLabel{{Name: "__name__", Value: "ipmi_temperature_celsius"}, {Name: "instance", Value: "node1"}}},
+	}
+	var cfgs []RelabelConfig
+	config := `
+- source_labels: [__name__]
+  regex: ipmi_temperature_.*
+  target_label: __name__
+  replacement: ""
+- source_labels: [instance]
+  target_label: host`
+	if err := yaml.Unmarshal([]byte(config), &cfgs); err != nil {
+		t.Fatal(err)
+	}
+	result := relabelSeries(series, cfgs)
+	if len(result) != 1 {
+		t.Fatalf("expected the series without a name to be dropped, got %d series", len(result))
+	}
+	var names []string
+	for _, l := range result[0].Labels {
+		names = append(names, l.Name)
+	}
+	if expected := []string{"__name__", "host", "instance"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected sorted labels %v, got %v", expected, names)
+	}
+}
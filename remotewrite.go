@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// The types below mirror the messages of the Prometheus remote write
+// protocol, see
+// https://github.com/prometheus/prometheus/blob/main/prompb/remote.proto and
+// https://github.com/prometheus/prometheus/blob/main/prompb/types.proto.
+
+type prompbWriteRequest struct {
+	Timeseries []*prompbTimeSeries `protobuf:"bytes,1,rep,name=timeseries"`
+}
+
+func (m *prompbWriteRequest) Reset()         { *m = prompbWriteRequest{} }
+func (m *prompbWriteRequest) String() string { return proto.CompactTextString(m) }
+func (*prompbWriteRequest) ProtoMessage()    {}
+
+type prompbTimeSeries struct {
+	Labels  []*prompbLabel  `protobuf:"bytes,1,rep,name=labels"`
+	Samples []*prompbSample `protobuf:"bytes,2,rep,name=samples"`
+}
+
+func (m *prompbTimeSeries) Reset()         { *m = prompbTimeSeries{} }
+func (m *prompbTimeSeries) String() string { return proto.CompactTextString(m) }
+func (*prompbTimeSeries) ProtoMessage()    {}
+
+type prompbLabel struct {
+	Name  string `protobuf:"bytes,1,opt,name=name,proto3"`
+	Value string `protobuf:"bytes,2,opt,name=value,proto3"`
+}
+
+func (m *prompbLabel) Reset()         { *m = prompbLabel{} }
+func (m *prompbLabel) String() string { return proto.CompactTextString(m) }
+func (*prompbLabel) ProtoMessage()    {}
+
+type prompbSample struct {
+	Value     float64 `protobuf:"fixed64,1,opt,name=value,proto3"`
+	Timestamp int64   `protobuf:"varint,2,opt,name=timestamp,proto3"`
+}
+
+func (m *prompbSample) Reset()         { *m = prompbSample{} }
+func (m *prompbSample) String() string { return proto.CompactTextString(m) }
+func (*prompbSample) ProtoMessage()    {}
+
+// snappyEncode encodes src in the snappy block format required by remote
+// write. The data is stored as literals only, i.e. uncompressed, which every
+// snappy decoder accepts.
+func snappyEncode(src []byte) []byte {
+	var buf bytes.Buffer
+	var tmp [binary.MaxVarintLen64]byte
+	buf.Write(tmp[:binary.PutUvarint(tmp[:], uint64(len(src)))])
+	for len(src) > 0 {
+		n := len(src)
+		if n > 65536 {
+			n = 65536
+		}
+		// A literal of up to 65536 bytes has a tag byte of 61<<2 followed
+		// by its length minus one as two little-endian bytes.
+		buf.WriteByte(61 << 2)
+		buf.WriteByte(byte(n - 1))
+		buf.WriteByte(byte((n - 1) >> 8))
+		buf.Write(src[:n])
+		src = src[n:]
+	}
+	return buf.Bytes()
+}
+
+// remoteWrite sends series to the remote write endpoint configured in cfg.
+func remoteWrite(ctx context.Context, cfg RemoteWriteConfig, series []*prompbTimeSeries) error {
+	data, err := proto.Marshal(&prompbWriteRequest{Timeseries: series})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+	req, err := http.NewRequest("POST", cfg.URL, bytes.NewReader(snappyEncode(data)))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	for name, value := range cfg.Headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("remote write to %s failed with %s: %s", cfg.URL, resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// snappyDecode decodes a snappy block consisting of literals only, as
+// written by snappyEncode.
+func snappyDecode(t *testing.T, src []byte) []byte {
+	t.Helper()
+	length, n := binary.Uvarint(src)
+	if n <= 0 {
+		t.Fatal("invalid length")
+	}
+	src = src[n:]
+	var dst []byte
+	for len(src) > 0 {
+		tag := src[0]
+		src = src[1:]
+		if tag&3 != 0 {
+			t.Fatalf("unexpected copy element %x", tag)
+		}
+		size := int(tag >> 2)
+		if size >= 60 {
+			extra := size - 59
+			if len(src) < extra {
+				t.Fatal("truncated literal length")
+			}
+			size = 0
+			for i := extra - 1; i >= 0; i-- {
+				size = size<<8 | int(src[i])
+			}
+			src = src[extra:]
+		}
+		size++
+		if len(src) < size {
+			t.Fatalf("literal of %d bytes exceeds the %d bytes left", size, len(src))
+		}
+		dst = append(dst, src[:size]...)
+		src = src[size:]
+	}
+	if uint64(len(dst)) != length {
+		t.Fatalf("decoded %d bytes, expected %d", len(dst), length)
+	}
+	return dst
+}
+
+func TestSnappyEncode(t *testing.T) {
+	for _, size := range []int{0, 1, 60, 65535, 65536, 65537, 200000} {
+		src := make([]byte, size)
+		for i := range src {
+			src[i] = byte(i * 7)
+		}
+		if got := snappyDecode(t, snappyEncode(src)); !bytes.Equal(got, src) {
+			t.Errorf("%d bytes: round trip changed the data", size)
+		}
+	}
+}
+
+// protoField is a field of an encoded protobuf message.
+type protoField struct {
+	num    int
+	varint uint64
+	bytes  []byte
+}
+
+// parseProto splits an encoded protobuf message into its fields, supporting
+// the wire types used by remote write.
+func parseProto(t *testing.T, b []byte) []protoField {
+	t.Helper()
+	var fields []protoField
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatal("invalid field key")
+		}
+		b = b[n:]
+		f := protoField{num: int(key >> 3)}
+		switch key & 7 {
+		case 0:
+			f.varint, n = binary.Uvarint(b)
+			if n <= 0 {
+				t.Fatal("invalid varint")
+			}
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				t.Fatal("truncated fixed64")
+			}
+			f.varint = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case 2:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < size {
+				t.Fatal("invalid length-delimited field")
+			}
+			f.bytes = b[n : n+int(size)]
+			b = b[n+int(size):]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+func TestRemoteWriteEncoding(t *testing.T) {
+	req := &prompbWriteRequest{Timeseries: []*prompbTimeSeries{{
+		Labels:  []*prompbLabel{{Name: "__name__", Value: "ipmi_up"}, {Name: "job", Value: "ipmi"}},
+		Samples: []*prompbSample{{Value: 1.5, Timestamp: 1700000000000}},
+	}}}
+	data, err := proto.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = snappyDecode(t, snappyEncode(data))
+
+	request := parseProto(t, data)
+	if len(request) != 1 || request[0].num != 1 {
+		t.Fatalf("expected one time series as field 1, got %+v", request)
+	}
+	var labels [][2]string
+	var samples []protoField
+	for _, f := range parseProto(t, request[0].bytes) {
+		switch f.num {
+		case 1:
+			var l [2]string
+			for _, lf := range parseProto(t, f.bytes) {
+				l[lf.num-1] = string(lf.bytes)
+			}
+			labels = append(labels, l)
+		case 2:
+			samples = append(samples, parseProto(t, f.bytes)...)
+		default:
+			t.Errorf("unexpected field %d in time series", f.num)
+		}
+	}
+	expected := [][2]string{{"__name__", "ipmi_up"}, {"job", "ipmi"}}
+	if len(labels) != len(expected) || labels[0] != expected[0] || labels[1] != expected[1] {
+		t.Errorf("expected labels %v, got %v", expected, labels)
+	}
+	if len(samples) != 2 || samples[0].num != 1 || samples[1].num != 2 {
+		t.Fatalf("expected the value as field 1 and the timestamp as field 2, got %+v", samples)
+	}
+	if v := math.Float64frombits(samples[0].varint); v != 1.5 {
+		t.Errorf("expected value 1.5, got %v", v)
+	}
+	if ts := samples[1].varint; ts != 1700000000000 {
+		t.Errorf("expected timestamp 1700000000000, got %d", ts)
+	}
+}
+
+func TestToTimeSeriesLabelClash(t *testing.T) {
+	mfs := []*dto.MetricFamily{{
+		Name: proto.String("ipmi_up"),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{{
+			Label: []*dto.LabelPair{
+				{Name: proto.String("instance"), Value: proto.String("10.0.0.1")},
+				{Name: proto.String("job"), Value: proto.String("other")},
+				{Name: proto.String("rack"), Value: proto.String("r1")},
+			},
+			Gauge: &dto.Gauge{Value: proto.Float64(1)},
+		}},
+	}}
+	series := toTimeSeries(mfs, map[string]string{"job": "ipmi", "instance": "node1"}, time.Now())
+	if len(series) != 1 {
+		t.Fatalf("expected one series, got %d", len(series))
+	}
+	var names []string
+	values := make(map[string]string)
+	for _, l := range series[0].Labels {
+		names = append(names, l.Name)
+		values[l.Name] = l.Value
+	}
+	expected := []string{"__name__", "instance", "job", "rack"}
+	if len(names) != len(expected) {
+		t.Fatalf("expected labels %v, got %v", expected, names)
+	}
+	for i := range expected {
+		if names[i] != expected[i] {
+			t.Fatalf("expected labels %v, got %v", expected, names)
+		}
+	}
+	if values["job"] != "ipmi" || values["instance"] != "node1" {
+		t.Errorf("expected the added labels to win, got job %q and instance %q", values["job"], values["instance"])
+	}
+}
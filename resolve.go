@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// DNS resolution policies for targets, see Config.DNSResolution.
+const (
+	dnsResolutionPass    = "pass"
+	dnsResolutionScrape  = "scrape"
+	dnsResolutionCommand = "command"
+)
+
+type resolutionKey struct{}
+
+// resolution is how the commands run with a context find the address of their
+// target.
+type resolution struct {
+	policy string
+	// pinned is the address all commands of a scrape use with the "scrape"
+	// policy.
+	pinned string
+}
+
+// withResolution returns a context whose commands resolve their target
+// according to policy, using pinned as address with the "scrape" policy.
+func withResolution(ctx context.Context, policy, pinned string) context.Context {
+	return context.WithValue(ctx, resolutionKey{}, resolution{policy, pinned})
+}
+
+// withScrapeResolution returns a context for the commands of a scrape of the
+// target at address with the named credentials, resolving its host name first
+// if the configured policy is to pin one IP address for the whole scrape.
+func withScrapeResolution(ctx context.Context, config *SafeConfig, address, credentials string) (context.Context, error) {
+	policy := config.DNSResolution(credentials)
+	var pinned string
+	if policy == dnsResolutionScrape {
+		var err error
+		if pinned, err = resolveAddress(ctx, address); err != nil {
+			return ctx, err
+		}
+	}
+	return withResolution(ctx, policy, pinned), nil
+}
+
+// resolveAddress replaces the host name in address with one of its IP
+// addresses, keeping the port, if any. IP addresses are returned unchanged.
+func resolveAddress(ctx context.Context, address string) (string, error) {
+	host, port := splitAddress(address)
+	if net.ParseIP(host) != nil {
+		return address, nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	if len(addrs) == 0 {
+		return "", &net.DNSError{Err: "no addresses found", Name: host}
+	}
+	ip := addrs[0].String()
+	if port != "" {
+		return net.JoinHostPort(ip, port), nil
+	}
+	return ip, nil
+}
+
+// commandAddress returns the address a command run with ctx uses to reach
+// the target at address.
+func commandAddress(ctx context.Context, address string) (string, error) {
+	r, _ := ctx.Value(resolutionKey{}).(resolution)
+	switch r.policy {
+	case dnsResolutionScrape:
+		if r.pinned == "" {
+			return "", fmt.Errorf("address of %s was not resolved", address)
+		}
+		return r.pinned, nil
+	case dnsResolutionCommand:
+		return resolveAddress(ctx, address)
+	}
+	return address, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+var commandRetries = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: namespace + "_exporter",
+		Name:      "command_retries_total",
+		Help:      "Number of times FreeIPMI commands were retried after a transient failure.",
+	},
+	[]string{"command"},
+)
+
+// transientErrors are messages printed by FreeIPMI for failures that are
+// likely to go away when trying again.
+var transientErrors = []string{
+	"connection timeout",
+	"session timeout",
+	"BMC busy",
+	"node busy",
+}
+
+// transientFailure reports whether a command failed in a way that is likely
+// to go away when trying again.
+func transientFailure(r commandResult, err error) bool {
+	if err == nil || err == errCommandTimeout || err == context.Canceled {
+		return false
+	}
+	for _, msg := range transientErrors {
+		if strings.Contains(string(r.stderr), msg) || strings.Contains(string(r.stdout), msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryExecutor retries commands that failed transiently, with exponential
+// backoff.
+type retryExecutor struct {
+	executor
+	cfg RetryConfig
+}
+
+// Execute implements executor.
+func (e retryExecutor) Execute(ctx context.Context, cmd string, args []string, stdin []byte) (commandResult, error) {
+	backoff := e.cfg.InitialBackoff
+	for attempt := 0; ; attempt++ {
+		r, err := e.executor.Execute(ctx, cmd, args, stdin)
+		if attempt >= e.cfg.MaxRetries || !transientFailure(r, err) {
+			return r, err
+		}
+		log.Debugf("Retrying %s after transient failure in %s: %s", cmd, backoff, err)
+		commandRetries.WithLabelValues(cmd).Inc()
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return r, err
+		}
+		backoff *= 2
+		if backoff > e.cfg.MaxBackoff {
+			backoff = e.cfg.MaxBackoff
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// sdTargetGroup is a target group in the format of the Prometheus HTTP
+// service discovery.
+type sdTargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// sdTargetGroups returns a target group for each target known to the
+// exporter, to be scraped via the exporter at address. Targets for which
+// allowed returns false are left out.
+func sdTargetGroups(address string, allowed func(target string) bool) []sdTargetGroup {
+	groups := []sdTargetGroup{}
+	for _, t := range sc.KnownTargets() {
+		if !allowed(t.Name) {
+			continue
+		}
+		labels := map[string]string{
+			"__metrics_path__": "/ipmi",
+			"__param_target":   t.Name,
+		}
+		for k, v := range t.Labels {
+			labels[k] = v
+		}
+		groups = append(groups, sdTargetGroup{
+			Targets: []string{address},
+			Labels:  labels,
+		})
+	}
+	return groups
+}
+
+// sdHandler serves /sd, listing all targets known to the exporter in the
+// format of the Prometheus HTTP service discovery.
+func sdHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorize(w, r, "") {
+		return
+	}
+	token := bearerToken(r)
+	groups := sdTargetGroups(r.Host, func(target string) bool {
+		_, allowed := sc.TokenAllows(token, target)
+		return allowed || !sc.AuthRequired()
+	})
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(groups); err != nil {
+		log.Errorf("Error writing service discovery response: %s", err)
+	}
+}
+
+// writeSDFile writes all targets known to the exporter to path in the format
+// of the Prometheus file-based service discovery. The file is replaced
+// atomically, and only if its content changed.
+func writeSDFile(path, address string) error {
+	groups := sdTargetGroups(address, func(string) bool { return true })
+	data, err := json.MarshalIndent(groups, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if old, err := ioutil.ReadFile(path); err == nil && bytes.Equal(old, data) {
+		return nil
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// runSDFileWriter writes the file-based service discovery file every
+// interval, so that it reflects configuration reloads.
+func runSDFileWriter(path, address string, interval time.Duration) {
+	for {
+		if err := writeSDFile(path, address); err != nil {
+			log.Errorf("Error writing service discovery file %s: %s", path, err)
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+var (
+	sdrCacheRecreations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace + "_exporter",
+			Name:      "sdr_cache_recreations_total",
+			Help:      "Number of times the SDR cache of a target was recreated, by result.",
+		},
+		[]string{"target", "result"},
+	)
+
+	sdrCacheLastRecreation = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace + "_exporter",
+			Name:      "sdr_cache_last_recreation_timestamp_seconds",
+			Help:      "Unix timestamp of the last successful recreation of the SDR cache of a target.",
+		},
+		[]string{"target"},
+	)
+)
+
+// sdrCacheTracker keeps track of when the SDR cache of each target was last
+// recreated.
+type sdrCacheTracker struct {
+	mtx          sync.Mutex
+	lastRecreate map[string]time.Time
+}
+
+var sdrCaches sdrCacheTracker
+
+// needsRecreate reports whether the SDR cache of target has to be recreated
+// according to cfg.
+func (t *sdrCacheTracker) needsRecreate(target string, cfg SDRCacheConfig) bool {
+	if cfg.NeverFlush {
+		return false
+	}
+	if cfg.MaxAge <= 0 {
+		return true
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	last, ok := t.lastRecreate[target]
+	return !ok || time.Since(last) > cfg.MaxAge
+}
+
+// recreated records that the SDR cache of target was just recreated, or that
+// recreating it failed.
+func (t *sdrCacheTracker) recreated(target string, success bool) {
+	if !success {
+		sdrCacheRecreations.WithLabelValues(target, "failure").Inc()
+		return
+	}
+	sdrCacheRecreations.WithLabelValues(target, "success").Inc()
+	sdrCacheLastRecreation.WithLabelValues(target).SetToCurrentTime()
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.lastRecreate == nil {
+		t.lastRecreate = make(map[string]time.Time)
+	}
+	t.lastRecreate[target] = time.Now()
+}
+
+// sdrCacheArgs returns the FreeIPMI arguments for using the SDR cache of
+// target according to cfg, and whether the cache is recreated.
+func sdrCacheArgs(target string, cfg SDRCacheConfig) ([]string, bool) {
+	var args []string
+	if cfg.Directory != "" {
+		args = append(args, "--sdr-cache-directory", cfg.Directory)
+	}
+	recreate := sdrCaches.needsRecreate(target, cfg)
+	if recreate {
+		args = append(args, "--sdr-cache-recreate")
+	}
+	return args, recreate
+}
+
+// warmUpSDRCaches creates the SDR caches of all targets known from the config,
+// running at most concurrency commands at a time.
+func warmUpSDRCaches(config *SafeConfig, concurrency int) {
+	start := time.Now()
+	targets := config.KnownTargets()
+	log.Infof("Warming up SDR caches of %d targets", len(targets))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for _, t := range targets {
+		address, credentials := config.LookupTarget(t.Name)
+		creds, err := config.CredentialsForTarget(credentials)
+		if err != nil {
+			log.Errorf("Not warming up SDR cache of target %s: %s", t.Name, err)
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(c collector) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if _, _, err := c.getSensorData(context.Background(), creds); err != nil {
+				log.Errorf("Error warming up SDR cache of target %s: %s", c.target, err)
+			}
+		}(collector{target: address, credentials: credentials, config: config})
+	}
+	wg.Wait()
+	log.Infof("Warmed up SDR caches in %s", time.Since(start))
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+var (
+	selEntriesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "sel", "logs_count"),
+		"Current number of entries in the System Event Log (SEL).",
+		nil,
+		nil,
+	)
+
+	selFreeSpaceDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "sel", "free_space_bytes"),
+		"Current free space remaining for new SEL entries.",
+		nil,
+		nil,
+	)
+
+	selSizeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "sel", "size_bytes"),
+		"Total size of the System Event Log (SEL).",
+		nil,
+		nil,
+	)
+
+	selUtilizationDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "sel", "utilization_percent"),
+		"Percentage of the System Event Log (SEL) in use.",
+		nil,
+		nil,
+	)
+
+	selInfoEntriesRegex   = regexp.MustCompile(`^Number of log entries\s*:\s*(?P<value>[0-9]+)`)
+	selInfoFreeSpaceRegex = regexp.MustCompile(`^Free space remaining\s*:\s*(?P<value>[0-9]+)\s*bytes`)
+	selInfoUnitsRegex     = regexp.MustCompile(`^Number of possible allocation units\s*:\s*(?P<value>[0-9]+)`)
+	selInfoUnitSizeRegex  = regexp.MustCompile(`^Allocation unit size\s*:\s*(?P<value>[0-9]+)\s*bytes`)
+
+	selNotifications = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace + "_exporter",
+			Name:      "sel_notifications_total",
+			Help:      "Number of times new SEL entries were sent to a sink or dropped, by sink and result.",
+		},
+		[]string{"sink", "result"},
+	)
+
+	// selEntriesSeen tracks the SEL entries already seen for each target.
+	selEntriesSeen = newSELTracker()
+)
+
+// selEntry is an entry of the System Event Log as printed by ipmi-sel.
+type selEntry struct {
+	ID    int
+	Date  string
+	Time  string
+	Name  string
+	Type  string
+	State string
+	Event string
+}
+
+// selSink receives new SEL entries of a target.
+type selSink interface {
+	name() string
+	send(ctx context.Context, target string, entries []selEntry) error
+}
+
+// selSinks returns the sinks configured in cfg.
+func selSinks(cfg SELConfig) []selSink {
+	var result []selSink
+	if cfg.Alertmanager.URL != "" {
+		result = append(result, alertmanagerSink{cfg.Alertmanager})
+	}
+	if cfg.Loki.URL != "" {
+		result = append(result, lokiSink{cfg.Loki})
+	}
+	if cfg.Syslog.Destination != "" {
+		result = append(result, syslogSink{cfg.Syslog})
+	}
+	if len(cfg.Kafka.Brokers) > 0 {
+		result = append(result, kafkaSink{cfg.Kafka})
+	}
+	return result
+}
+
+func ipmiSELOutput(ctx context.Context, e executor, host, user, password string) ([]byte, error) {
+	return freeipmiOutput(ctx, e, "ipmi-sel", host, user, password,
+		"-Q", "--comma-separated-output", "--no-header-output", "--output-event-state")
+}
+
+func ipmiSELInfoOutput(ctx context.Context, e executor, host, user, password string) ([]byte, error) {
+	return freeipmiOutput(ctx, e, "ipmi-sel", host, user, password, "--info")
+}
+
+// selRecordSize is the size of a SEL entry in bytes, as defined by the IPMI
+// specification.
+const selRecordSize = 16
+
+// selInfo is the size information printed by ipmi-sel --info.
+type selInfo struct {
+	freeBytes  float64
+	totalBytes float64
+	// entries is the number of entries in the SEL, or -1 if not printed.
+	entries int
+}
+
+// parseSELInfo parses the output of ipmi-sel --info. The total size is taken
+// from the allocation information if the BMC supports it, and otherwise
+// derived from the number of entries and the free space.
+func parseSELInfo(output []byte) (selInfo, error) {
+	info := selInfo{entries: -1}
+	if entries, err := getValue(output, selInfoEntriesRegex); err == nil {
+		info.entries, _ = strconv.Atoi(entries)
+	}
+	free, err := getValue(output, selInfoFreeSpaceRegex)
+	if err != nil {
+		return info, err
+	}
+	if info.freeBytes, err = strconv.ParseFloat(free, 64); err != nil {
+		return info, err
+	}
+	units, unitsErr := getValue(output, selInfoUnitsRegex)
+	unitSize, unitSizeErr := getValue(output, selInfoUnitSizeRegex)
+	if unitsErr == nil && unitSizeErr == nil {
+		u, _ := strconv.ParseFloat(units, 64)
+		size, _ := strconv.ParseFloat(unitSize, 64)
+		info.totalBytes = u * size
+	}
+	if info.totalBytes < info.freeBytes || info.totalBytes == 0 {
+		if info.entries < 0 {
+			return info, fmt.Errorf("could not find number of log entries in output: %s", output)
+		}
+		info.totalBytes = float64(info.entries)*selRecordSize + info.freeBytes
+	}
+	return info, nil
+}
+
+// parseSELOutput parses the CSV output of ipmi-sel with the columns ID, Date,
+// Time, Name, Type, State and Event.
+func parseSELOutput(output []byte) ([]selEntry, error) {
+	r := csv.NewReader(bytes.NewReader(output))
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	var result []selEntry
+	for {
+		line, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(line) < 7 {
+			return nil, fmt.Errorf("unexpected number of fields in SEL entry: %q", line)
+		}
+		id, err := strconv.Atoi(strings.TrimSpace(line[0]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid SEL entry ID: %s", err)
+		}
+		result = append(result, selEntry{
+			ID:    id,
+			Date:  line[1],
+			Time:  line[2],
+			Name:  line[3],
+			Type:  line[4],
+			State: line[5],
+			Event: strings.Join(line[6:], ","),
+		})
+	}
+	return result, nil
+}
+
+// selMaxPending is the maximum number of entries kept for each target and
+// sink while they cannot be delivered. Older entries are dropped.
+const selMaxPending = 1000
+
+// selTracker remembers the highest SEL entry ID seen for each target, and the
+// entries that still have to be delivered to each sink.
+type selTracker struct {
+	sync.Mutex
+	lastID map[string]int
+	// pending are the undelivered entries of each target by sink name.
+	pending map[string]map[string][]selEntry
+	// sending is set for the targets whose entries are being delivered.
+	sending map[string]bool
+}
+
+func newSELTracker() *selTracker {
+	return &selTracker{
+		lastID:  make(map[string]int),
+		pending: make(map[string]map[string][]selEntry),
+		sending: make(map[string]bool),
+	}
+}
+
+// update records entries as seen for target and returns those that are new.
+// When a target is seen for the first time, nothing is new, so that the whole
+// SEL is not reported on startup. If the IDs went backwards, the SEL was
+// cleared, and all entries are new.
+func (t *selTracker) update(target string, entries []selEntry) []selEntry {
+	max := 0
+	for _, e := range entries {
+		if e.ID > max {
+			max = e.ID
+		}
+	}
+	t.Lock()
+	last, ok := t.lastID[target]
+	t.lastID[target] = max
+	t.Unlock()
+	if !ok {
+		return nil
+	}
+	if max < last {
+		last = 0
+	}
+	var result []selEntry
+	for _, e := range entries {
+		if e.ID > last {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+func selEnabled(config *SafeConfig) bool {
+	return config.SEL().enabled()
+}
+
+func (c collector) collectSEL(ctx context.Context, ch chan<- prometheus.Metric, creds Credentials) error {
+	cfg := c.config.SEL()
+	entries := -1
+	if len(selSinks(cfg)) > 0 {
+		output, err := ipmiSELOutput(ctx, c.getExecutor(), c.target, creds.User, creds.Password)
+		if err != nil {
+			return err
+		}
+		parsed, err := parseSELOutput(output)
+		if err != nil {
+			return &parseError{err}
+		}
+		newEntries := selEntriesSeen.update(c.target, parsed)
+		selEntriesSeen.notify(selSinks(cfg), c.target, newEntries)
+		entries = len(parsed)
+	}
+	if cfg.SizeMetrics {
+		// The size of the SEL is informational only, so failing to read it
+		// must not get in the way of forwarding entries.
+		info, err := c.getSELInfo(ctx, creds)
+		if err != nil {
+			log.Warnf("Not exporting SEL size of %s: %s", c.target, err)
+		} else {
+			if entries < 0 {
+				entries = info.entries
+			}
+			collectSELInfo(ch, info)
+		}
+	}
+	if entries >= 0 {
+		ch <- prometheus.MustNewConstMetric(
+			selEntriesDesc,
+			prometheus.GaugeValue,
+			float64(entries),
+		)
+	}
+	return nil
+}
+
+func (c collector) getSELInfo(ctx context.Context, creds Credentials) (selInfo, error) {
+	output, err := ipmiSELInfoOutput(ctx, c.getExecutor(), c.target, creds.User, creds.Password)
+	if err != nil {
+		return selInfo{}, err
+	}
+	return parseSELInfo(output)
+}
+
+func collectSELInfo(ch chan<- prometheus.Metric, info selInfo) {
+	ch <- prometheus.MustNewConstMetric(
+		selFreeSpaceDesc,
+		prometheus.GaugeValue,
+		info.freeBytes,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		selSizeDesc,
+		prometheus.GaugeValue,
+		info.totalBytes,
+	)
+	if info.totalBytes > 0 {
+		ch <- prometheus.MustNewConstMetric(
+			selUtilizationDesc,
+			prometheus.GaugeValue,
+			(info.totalBytes-info.freeBytes)/info.totalBytes*100,
+		)
+	}
+}
+
+// notify queues entries of target for sinks and starts sending what is queued
+// in the background, unless that is in progress already. Entries a sink fails
+// to receive stay queued and are sent again on the next call for target.
+func (t *selTracker) notify(sinks []selSink, target string, entries []selEntry) {
+	t.Lock()
+	defer t.Unlock()
+	queues := make(map[string][]selEntry)
+	for _, sink := range sinks {
+		// The queues of sinks removed from the configuration are dropped.
+		queues[sink.name()] = t.queue(target, sink.name(), t.pending[target][sink.name()], entries)
+	}
+	t.pending[target] = queues
+	if t.sending[target] || !hasPending(queues) {
+		return
+	}
+	t.sending[target] = true
+	// Do not hold up the scrape while the sinks are busy.
+	go t.send(sinks, target)
+}
+
+// queue appends entries to the queue of target for sink, dropping the oldest
+// entries beyond selMaxPending. t must be locked.
+func (t *selTracker) queue(target, sink string, queue, entries []selEntry) []selEntry {
+	queue = append(queue, entries...)
+	if dropped := len(queue) - selMaxPending; dropped > 0 {
+		log.Errorf("Dropping %d undelivered SEL entries of %s for %s", dropped, target, sink)
+		selNotifications.WithLabelValues(sink, "dropped").Inc()
+		queue = queue[dropped:]
+	}
+	return queue
+}
+
+// send delivers the queued entries of target to sinks until nothing is left
+// or a sink fails.
+func (t *selTracker) send(sinks []selSink, target string) {
+	for {
+		t.Lock()
+		queues := make(map[string][]selEntry)
+		for name, entries := range t.pending[target] {
+			queues[name] = entries
+			t.pending[target][name] = nil
+		}
+		t.Unlock()
+
+		failed := false
+		for _, sink := range sinks {
+			entries := queues[sink.name()]
+			if len(entries) == 0 {
+				continue
+			}
+			if err := sink.send(context.Background(), target, entries); err != nil {
+				log.Errorf("Error sending SEL entries of %s to %s: %s", target, sink.name(), err)
+				selNotifications.WithLabelValues(sink.name(), "error").Inc()
+				t.requeue(target, sink.name(), entries)
+				failed = true
+				continue
+			}
+			selNotifications.WithLabelValues(sink.name(), "success").Inc()
+		}
+
+		t.Lock()
+		if failed || !hasPending(t.pending[target]) {
+			t.sending[target] = false
+			t.Unlock()
+			return
+		}
+		t.Unlock()
+	}
+}
+
+// requeue puts entries that failed to be delivered to sink back in front of
+// the entries of target queued meanwhile, unless sink is no longer
+// configured.
+func (t *selTracker) requeue(target, sink string, entries []selEntry) {
+	t.Lock()
+	defer t.Unlock()
+	queued, ok := t.pending[target][sink]
+	if !ok {
+		return
+	}
+	t.pending[target][sink] = t.queue(target, sink, entries, queued)
+}
+
+func hasPending(queues map[string][]selEntry) bool {
+	for _, entries := range queues {
+		if len(entries) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// selTimestamp returns the time of the entry as a string, as far as known.
+func (e selEntry) selTimestamp() string {
+	return strings.TrimSpace(e.Date + " " + e.Time)
+}
+
+// alertmanagerSink posts critical SEL entries as alerts to an Alertmanager,
+// see https://github.com/prometheus/alertmanager/blob/main/api/v2/openapi.yaml.
+type alertmanagerSink struct {
+	config AlertmanagerConfig
+}
+
+func (s alertmanagerSink) name() string {
+	return "alertmanager"
+}
+
+type alertmanagerAlert struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	StartsAt    time.Time         `json:"startsAt"`
+}
+
+func (s alertmanagerSink) send(ctx context.Context, target string, entries []selEntry) error {
+	var alerts []alertmanagerAlert
+	now := time.Now()
+	for _, e := range entries {
+		if e.State != "Critical" {
+			continue
+		}
+		labels := map[string]string{
+			"alertname":   "IPMISELCriticalEvent",
+			"severity":    "critical",
+			"target":      target,
+			"sensor":      e.Name,
+			"sensor_type": e.Type,
+			"sel_id":      strconv.Itoa(e.ID),
+		}
+		for k, v := range s.config.Labels {
+			labels[k] = v
+		}
+		alerts = append(alerts, alertmanagerAlert{
+			Labels: labels,
+			Annotations: map[string]string{
+				"summary":     fmt.Sprintf("%s: %s", e.Name, e.Event),
+				"description": fmt.Sprintf("SEL entry %d of %s at %s: %s (%s) %s", e.ID, target, e.selTimestamp(), e.Name, e.Type, e.Event),
+			},
+			StartsAt: now,
+		})
+	}
+	if len(alerts) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.config.Timeout)
+	defer cancel()
+	return postJSON(ctx, strings.TrimSuffix(s.config.URL, "/")+"/api/v2/alerts", nil, alerts)
+}
+
+// lokiSink pushes SEL entries as log lines to Loki, see
+// https://grafana.com/docs/loki/latest/reference/loki-http-api/#ingest-logs.
+type lokiSink struct {
+	config LokiConfig
+}
+
+func (s lokiSink) name() string {
+	return "loki"
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+// lokiLine is the content of a log line for a SEL entry.
+type lokiLine struct {
+	ID     int    `json:"id"`
+	Time   string `json:"sel_time"`
+	Sensor string `json:"sensor"`
+	Type   string `json:"sensor_type"`
+	State  string `json:"state"`
+	Event  string `json:"event"`
+}
+
+func (s lokiSink) send(ctx context.Context, target string, entries []selEntry) error {
+	stream := lokiStream{Stream: map[string]string{"job": "ipmi_sel", "target": target}}
+	for k, v := range s.config.Labels {
+		stream.Stream[k] = v
+	}
+	// The SEL time is in the BMC's local time zone, which is unknown, so the
+	// lines are timestamped with the time they were found instead. Adding the
+	// index keeps them in order.
+	now := time.Now().UnixNano()
+	for i, e := range entries {
+		line, err := json.Marshal(lokiLine{e.ID, e.selTimestamp(), e.Name, e.Type, e.State, e.Event})
+		if err != nil {
+			return err
+		}
+		stream.Values = append(stream.Values, [2]string{strconv.FormatInt(now+int64(i), 10), string(line)})
+	}
+	var headers map[string]string
+	if s.config.TenantID != "" {
+		headers = map[string]string{"X-Scope-OrgID": s.config.TenantID}
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.config.Timeout)
+	defer cancel()
+	body := map[string][]lokiStream{"streams": {stream}}
+	return postJSON(ctx, strings.TrimSuffix(s.config.URL, "/")+"/loki/api/v1/push", headers, body)
+}
+
+// postJSON posts v encoded as JSON to url with the given additional headers
+// and expects a 2xx response.
+func postJSON(ctx context.Context, url string, headers map[string]string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s from %s: %s", resp.Status, url, bytes.TrimSpace(msg))
+	}
+	return nil
+}
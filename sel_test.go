@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSELSink records the entries it receives and fails while failing is
+// set.
+type fakeSELSink struct {
+	mtx      sync.Mutex
+	failing  bool
+	received []int
+	sent     chan struct{}
+}
+
+func (s *fakeSELSink) name() string {
+	return "fake"
+}
+
+func (s *fakeSELSink) send(ctx context.Context, target string, entries []selEntry) error {
+	s.mtx.Lock()
+	defer func() {
+		s.mtx.Unlock()
+		s.sent <- struct{}{}
+	}()
+	if s.failing {
+		return errors.New("unavailable")
+	}
+	for _, e := range entries {
+		s.received = append(s.received, e.ID)
+	}
+	return nil
+}
+
+func (s *fakeSELSink) wait(t *testing.T) {
+	t.Helper()
+	select {
+	case <-s.sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the sink")
+	}
+}
+
+// idle waits until no entries of target are being sent.
+func (tr *selTracker) idle(target string) {
+	for {
+		tr.Lock()
+		sending := tr.sending[target]
+		tr.Unlock()
+		if !sending {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSELTrackerUpdate(t *testing.T) {
+	tr := newSELTracker()
+	if entries := tr.update("node1", []selEntry{{ID: 1}, {ID: 2}}); len(entries) != 0 {
+		t.Errorf("expected no new entries on the first scrape, got %v", entries)
+	}
+	if entries := tr.update("node1", []selEntry{{ID: 1}, {ID: 2}, {ID: 3}}); len(entries) != 1 || entries[0].ID != 3 {
+		t.Errorf("expected entry 3 to be new, got %v", entries)
+	}
+	if entries := tr.update("node1", []selEntry{{ID: 1}}); len(entries) != 1 || entries[0].ID != 1 {
+		t.Errorf("expected all entries to be new after the SEL was cleared, got %v", entries)
+	}
+}
+
+func TestSELTrackerRetry(t *testing.T) {
+	tr := newSELTracker()
+	sink := &fakeSELSink{failing: true, sent: make(chan struct{}, 10)}
+	sinks := []selSink{sink}
+
+	tr.notify(sinks, "node1", []selEntry{{ID: 1}})
+	sink.wait(t)
+	tr.idle("node1")
+
+	sink.mtx.Lock()
+	sink.failing = false
+	sink.mtx.Unlock()
+	tr.notify(sinks, "node1", []selEntry{{ID: 2}})
+	sink.wait(t)
+	tr.idle("node1")
+
+	sink.mtx.Lock()
+	defer sink.mtx.Unlock()
+	if len(sink.received) != 2 || sink.received[0] != 1 || sink.received[1] != 2 {
+		t.Errorf("expected entries 1 and 2 in order, got %v", sink.received)
+	}
+	if hasPending(tr.pending["node1"]) {
+		t.Error("expected no pending entries")
+	}
+}
+
+func TestSELTrackerMaxPending(t *testing.T) {
+	tr := newSELTracker()
+	sink := &fakeSELSink{failing: true, sent: make(chan struct{}, 10)}
+	var entries []selEntry
+	for i := 1; i <= selMaxPending+10; i++ {
+		entries = append(entries, selEntry{ID: i})
+	}
+	tr.notify([]selSink{sink}, "node1", entries)
+	sink.wait(t)
+	tr.idle("node1")
+
+	queue := tr.pending["node1"]["fake"]
+	if len(queue) != selMaxPending || queue[0].ID != 11 {
+		t.Errorf("expected the newest %d entries to be kept, got %d starting with %d", selMaxPending, len(queue), queue[0].ID)
+	}
+
+	// The entries of sinks no longer configured are dropped.
+	tr.notify(nil, "node1", nil)
+	if len(tr.pending["node1"]) != 0 {
+		t.Errorf("expected the queue of the removed sink to be dropped, got %d", len(tr.pending["node1"]))
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// scrapeCall is a scrape in progress or completed.
+type scrapeCall struct {
+	done   chan struct{}
+	result scrapeResult
+}
+
+// scrapeGroup coalesces concurrent scrapes of the same target, so that the
+// BMC only sees one set of commands and all callers get the same result.
+type scrapeGroup struct {
+	mtx   sync.Mutex
+	calls map[string]*scrapeCall
+}
+
+// Do runs fn unless a call with the same key is already in progress, and
+// waits for the result of the call. fn runs on its own, so that it is not
+// affected by the caller giving up: if ctx is done first, its error is
+// returned, while fn completes for the other callers. The returned bool
+// reports whether the call was started by another caller.
+func (g *scrapeGroup) Do(ctx context.Context, key string, fn func() scrapeResult) (scrapeResult, bool, error) {
+	g.mtx.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*scrapeCall)
+	}
+	c, shared := g.calls[key]
+	if !shared {
+		c = &scrapeCall{done: make(chan struct{})}
+		g.calls[key] = c
+		go func() {
+			c.result = fn()
+			g.mtx.Lock()
+			delete(g.calls, key)
+			g.mtx.Unlock()
+			close(c.done)
+		}()
+	}
+	g.mtx.Unlock()
+
+	select {
+	case <-c.done:
+		return c.result, shared, nil
+	case <-ctx.Done():
+		return scrapeResult{}, shared, ctx.Err()
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestScrapeGroupCallerGivesUp(t *testing.T) {
+	var g scrapeGroup
+	release := make(chan struct{})
+	started := make(chan struct{})
+	fn := func() scrapeResult {
+		close(started)
+		<-release
+		return scrapeResult{success: true}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error)
+	go func() {
+		_, _, err := g.Do(ctx, "node1", fn)
+		first <- err
+	}()
+	<-started
+
+	second := make(chan scrapeResult)
+	go func() {
+		r, shared, err := g.Do(context.Background(), "node1", func() scrapeResult {
+			t.Error("expected the running scrape to be shared")
+			return scrapeResult{}
+		})
+		if err != nil || !shared {
+			t.Errorf("expected a shared result, got shared %t and error %v", shared, err)
+		}
+		second <- r
+	}()
+
+	cancel()
+	if err := <-first; err != context.Canceled {
+		t.Errorf("expected the first caller to be cancelled, got %v", err)
+	}
+	// The second caller may not have joined the call yet.
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	if r := <-second; !r.success {
+		t.Error("expected the second caller to get the result of the scrape")
+	}
+
+	r, shared, err := g.Do(context.Background(), "node1", func() scrapeResult {
+		return scrapeResult{}
+	})
+	if err != nil || shared || r.success {
+		t.Errorf("expected a new scrape after the first one completed, got shared %t and error %v", shared, err)
+	}
+}
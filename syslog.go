@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// syslogFacilities maps the names of syslog facilities to their codes, see
+// RFC 5424, section 6.2.1.
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// Syslog severities, see RFC 5424, section 6.2.1.
+const (
+	syslogSeverityCritical = 2
+	syslogSeverityWarning  = 4
+	syslogSeverityInfo     = 6
+)
+
+// journaldSocket is the socket of the native journal protocol, see
+// https://systemd.io/JOURNAL_NATIVE_PROTOCOL/.
+const journaldSocket = "/run/systemd/journal/socket"
+
+// syslogSink writes SEL entries to syslog or the systemd journal.
+type syslogSink struct {
+	config SyslogConfig
+}
+
+func (s syslogSink) name() string {
+	return "syslog"
+}
+
+// severity maps the state of a SEL entry to a syslog severity.
+func (e selEntry) severity() int {
+	switch e.State {
+	case "Critical":
+		return syslogSeverityCritical
+	case "Warning":
+		return syslogSeverityWarning
+	default:
+		return syslogSeverityInfo
+	}
+}
+
+// fields returns the structured fields of the entry.
+func (e selEntry) fields(target string) [][2]string {
+	return [][2]string{
+		{"target", target},
+		{"sel_id", strconv.Itoa(e.ID)},
+		{"sel_time", e.selTimestamp()},
+		{"sensor", e.Name},
+		{"sensor_type", e.Type},
+		{"state", e.State},
+		{"event", e.Event},
+	}
+}
+
+func (s syslogSink) send(ctx context.Context, target string, entries []selEntry) error {
+	if s.config.Destination == "journald" {
+		return s.sendJournald(target, entries)
+	}
+	// Syslog has no structured fields, so they are written in logfmt.
+	var messages []string
+	for _, e := range entries {
+		var parts []string
+		for _, f := range e.fields(target) {
+			parts = append(parts, f[0]+"="+strconv.Quote(f[1]))
+		}
+		messages = append(messages, strings.Join(parts, " "))
+	}
+	return sendSyslog(s.config, entries, messages)
+}
+
+// sendJournald writes the entries to the journal, with their fields as
+// journal fields prefixed with IPMI_.
+func (s syslogSink) sendJournald(target string, entries []selEntry) error {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journaldSocket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for _, e := range entries {
+		var b strings.Builder
+		message := fmt.Sprintf("SEL entry %d of %s: %s (%s) %s", e.ID, target, e.Name, e.Type, e.Event)
+		fmt.Fprintf(&b, "MESSAGE=%s\n", strings.Replace(message, "\n", " ", -1))
+		fmt.Fprintf(&b, "PRIORITY=%d\n", e.severity())
+		fmt.Fprintf(&b, "SYSLOG_FACILITY=%d\n", syslogFacilities[s.config.Facility])
+		fmt.Fprintf(&b, "SYSLOG_IDENTIFIER=%s\n", s.config.Tag)
+		for _, f := range e.fields(target) {
+			// The simple format of the protocol does not allow newlines in
+			// values.
+			fmt.Fprintf(&b, "IPMI_%s=%s\n", strings.ToUpper(f[0]), strings.Replace(f[1], "\n", " ", -1))
+		}
+		if _, err := conn.Write([]byte(b.String())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"log/syslog"
+	"strings"
+)
+
+// sendSyslog writes one message per entry to the local syslog daemon, or to a
+// remote one if the destination is a udp:// or tcp:// URL.
+func sendSyslog(cfg SyslogConfig, entries []selEntry, messages []string) error {
+	var network, address string
+	if i := strings.Index(cfg.Destination, "://"); i >= 0 {
+		network, address = cfg.Destination[:i], cfg.Destination[i+3:]
+	}
+	facility := syslog.Priority(syslogFacilities[cfg.Facility] << 3)
+	w, err := syslog.Dial(network, address, facility|syslog.LOG_INFO, cfg.Tag)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	for i, e := range entries {
+		switch e.severity() {
+		case syslogSeverityCritical:
+			err = w.Crit(messages[i])
+		case syslogSeverityWarning:
+			err = w.Warning(messages[i])
+		default:
+			err = w.Info(messages[i])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+package main
+
+import "errors"
+
+// sendSyslog fails, as there is no syslog on Windows.
+func sendSyslog(cfg SyslogConfig, entries []selEntry, messages []string) error {
+	return errors.New("syslog is not supported on Windows")
+}
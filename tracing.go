@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// The tracer exports spans to an OpenTelemetry collector using OTLP over
+// HTTP with JSON encoding, see
+// https://opentelemetry.io/docs/specs/otlp/#otlphttp.
+
+const (
+	traceBatchSize     = 512
+	traceFlushInterval = 5 * time.Second
+)
+
+// span is a finished or running operation of a trace.
+type span struct {
+	traceID    [16]byte
+	spanID     [8]byte
+	parentID   [8]byte
+	name       string
+	start      time.Time
+	end        time.Time
+	attributes map[string]string
+	err        error
+}
+
+// SetError marks the span as failed. It is safe to call on a nil span.
+func (s *span) SetError(err error) {
+	if s != nil {
+		s.err = err
+	}
+}
+
+// End finishes the span and hands it to the tracer for export. It is safe to
+// call on a nil span.
+func (s *span) End() {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	select {
+	case tracer.spans <- s:
+	default:
+		log.Debugf("Dropping span %s, export queue is full", s.name)
+	}
+}
+
+type spanKey struct{}
+
+// otlpTracer batches finished spans and posts them to an OTLP endpoint.
+type otlpTracer struct {
+	endpoint string
+	spans    chan *span
+	client   *http.Client
+}
+
+// tracer is nil unless tracing is enabled.
+var tracer *otlpTracer
+
+// startTracing enables tracing, sending spans to the OTLP/HTTP traces
+// endpoint, e.g. http://localhost:4318/v1/traces.
+func startTracing(endpoint string) {
+	tracer = &otlpTracer{
+		endpoint: endpoint,
+		spans:    make(chan *span, 4*traceBatchSize),
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+	go tracer.run()
+}
+
+// startSpan starts a span as a child of the span in ctx, if any, and returns
+// a context carrying the new span. If tracing is disabled, the span is nil.
+func startSpan(ctx context.Context, name string, attributes map[string]string) (context.Context, *span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+	s := &span{name: name, start: time.Now(), attributes: attributes}
+	if parent, ok := ctx.Value(spanKey{}).(*span); ok {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func (t *otlpTracer) run() {
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+	var batch []*span
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) < traceBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := t.export(batch); err != nil {
+			log.Errorf("Error exporting %d spans: %s", len(batch), err)
+		}
+		batch = nil
+	}
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+func newOTLPAttributes(attributes map[string]string) []otlpAttribute {
+	var result []otlpAttribute
+	for k, v := range attributes {
+		a := otlpAttribute{Key: k}
+		a.Value.StringValue = v
+		result = append(result, a)
+	}
+	return result
+}
+
+func (t *otlpTracer) export(batch []*span) error {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              1, // SPAN_KIND_INTERNAL
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        newOTLPAttributes(s.attributes),
+		}
+		if s.parentID != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		if s.err != nil {
+			o.Status.Code = 2 // STATUS_CODE_ERROR
+			o.Status.Message = s.err.Error()
+		}
+		spans = append(spans, o)
+	}
+
+	body := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": newOTLPAttributes(map[string]string{"service.name": "ipmi_exporter"}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "ipmi_exporter"},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import "strings"
+
+// canonicalUnits maps unit spellings used by some BMCs to the ones used by
+// ipmimonitoring by default.
+var canonicalUnits = map[string]string{
+	"degrees c":  "C",
+	"celsius":    "C",
+	"degrees f":  "F",
+	"fahrenheit": "F",
+	"volts":      "V",
+	"volt":       "V",
+	"amps":       "A",
+	"amperes":    "A",
+	"watts":      "W",
+	"watt":       "W",
+	"rpm":        "RPM",
+	"percent":    "%",
+}
+
+// normalizeUnit canonicalizes the unit of data and converts its reading to
+// the unit of the corresponding typed sensor metric where possible. Fan
+// speeds in percent are only converted if fanMaxRPM is set.
+func normalizeUnit(data sensorData, fanMaxRPM float64) sensorData {
+	if unit, ok := canonicalUnits[strings.ToLower(strings.TrimSpace(data.Unit))]; ok {
+		data.Unit = unit
+	}
+	switch {
+	case data.Unit == "F":
+		data.Value = (data.Value - 32) * 5 / 9
+		data.Unit = "C"
+	case data.Unit == "%" && data.Type == "Fan" && fanMaxRPM > 0:
+		data.Value = data.Value / 100 * fanMaxRPM
+		data.Unit = "RPM"
+	}
+	return data
+}
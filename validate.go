@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// requiredCommands returns the FreeIPMI commands the exporter runs with
+// config, sorted by name.
+func requiredCommands(config *SafeConfig) []string {
+	cmds := make(map[string]bool)
+	for _, ic := range enabledCollectors(config) {
+		cmds[ic.command] = true
+	}
+	if config.SkipWhenPoweredOff() {
+		cmds["ipmi-chassis"] = true
+	}
+	if config.CapabilityProbing().Enabled {
+		for _, p := range capabilityProbes {
+			if p.enabled == nil || p.enabled(config) {
+				cmds[p.cmd] = true
+			}
+		}
+	}
+	var result []string
+	for cmd := range cmds {
+		result = append(result, cmd)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// validateStartup checks that the exporter can work with config beyond the
+// config file parsing: that the FreeIPMI commands it needs are executable and
+// the files it reads exist. With checkCredentials, at least one of the
+// targets known from the config must also accept the credentials configured
+// for it. All problems found are returned in one error.
+func validateStartup(config *SafeConfig, checkCredentials bool, timeout time.Duration) error {
+	var problems []string
+	if chroot := config.Chroot(); chroot != "" {
+		if fi, err := os.Stat(chroot); err != nil || !fi.IsDir() {
+			problems = append(problems, fmt.Sprintf("chroot %s is not a directory", chroot))
+		}
+	}
+	for _, cmd := range requiredCommands(config) {
+		if err := findCommand(cmd, config.Chroot()); err != nil {
+			problems = append(problems, fmt.Sprintf("command %s is not executable: %s", cmd, err))
+		}
+	}
+	if le := config.Agent().LeaderElection; le.LeaseName != "" {
+		if _, err := newKubernetesClient(le.Namespace); err != nil {
+			problems = append(problems, fmt.Sprintf("cannot use Kubernetes service account for leader election: %s", err))
+		}
+	}
+	if k := config.Discovery().Kubernetes; k.LabelSelector != "" {
+		if _, err := newKubernetesClient(k.Namespace); err != nil {
+			problems = append(problems, fmt.Sprintf("cannot use Kubernetes service account for discovery: %s", err))
+		}
+	}
+	if checkCredentials && len(problems) == 0 {
+		if err := validateCredentials(config, timeout); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("startup validation failed: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// validateCredentials tests the credentials of the targets known from config
+// in turn until one of them authenticates.
+func validateCredentials(config *SafeConfig, timeout time.Duration) error {
+	targets := config.KnownTargets()
+	if len(targets) == 0 {
+		return fmt.Errorf("no targets known from the config to test credentials against")
+	}
+	var errs []string
+	for _, t := range targets {
+		user, address, err := testCredentials(config, t.Name, timeout)
+		if err == nil {
+			log.Infof("Startup validation: authenticated as user %q on %s", user, address)
+			return nil
+		}
+		errs = append(errs, err.Error())
+	}
+	return fmt.Errorf("no configured credentials authenticate: %s", strings.Join(errs, "; "))
+}